@@ -69,6 +69,34 @@ Monitoring namespace
 {{- .Values.namespaces.monitoring }}
 {{- end }}
 
+{{/*
+Whether a Sock Shop microservice is installed: sockShop.services lists the services
+to install, or is empty for all of them.
+Usage: {{ if include "sock-shop-litmus.serviceEnabled" (list . "carts") }}
+*/}}
+{{- define "sock-shop-litmus.serviceEnabled" -}}
+{{- $root := index . 0 -}}
+{{- $name := index . 1 -}}
+{{- if or (not $root.Values.sockShop.services) (has $name $root.Values.sockShop.services) -}}
+true
+{{- end -}}
+{{- end }}
+
+{{/*
+Name of a cluster-scoped resource, suffixed with the instance id so that several
+instances of the chart can be installed side by side.
+Usage: {{ include "sock-shop-litmus.clusterName" (list . "prometheus") }}
+*/}}
+{{- define "sock-shop-litmus.clusterName" -}}
+{{- $root := index . 0 -}}
+{{- $name := index . 1 -}}
+{{- if $root.Values.instance -}}
+{{- printf "%s-%s" $name $root.Values.instance -}}
+{{- else -}}
+{{- $name -}}
+{{- end -}}
+{{- end }}
+
 {{/*
 Resolves the full image reference.
 Usage: {{ include "sock-shop-litmus.image" (list .Values.global.imageRegistry "weaveworksdemos/front-end:0.3.12") }}
@@ -86,3 +114,18 @@ Usage: {{ include "sock-shop-litmus.image" (list .Values.global.imageRegistry "w
 {{- $image -}}
 {{- end -}}
 {{- end -}}
+
+{{/*
+Java options for the Spring services, with Zipkin/Sleuth switched off when tracing is
+disabled or no collector is configured.
+Usage: {{ include "sock-shop-litmus.javaOpts" (list .Values.sockShop.carts.javaOpts .Values.sockShop.tracing) }}
+*/}}
+{{- define "sock-shop-litmus.javaOpts" -}}
+{{- $opts := index . 0 -}}
+{{- $tracing := index . 1 -}}
+{{- if or $tracing.disableSleuth (not $tracing.zipkinHost) -}}
+{{- printf "%s -Dspring.zipkin.enabled=false -Dspring.sleuth.enabled=false" $opts -}}
+{{- else -}}
+{{- $opts -}}
+{{- end -}}
+{{- end -}}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// accessAnnotation is the Chart.yaml annotation listing the endpoints people use,
+// as name=service/path pairs, e.g.
+//
+//	install-app/access: front-end=front-end/,grafana=grafana/,kubernetes-mcp=kubernetes-mcp-server/mcp
+//
+// Each gets ready-to-use URLs in the access summary.
+const accessAnnotation = "install-app/access"
+
+// accessSummary tells how to reach the release's Services once installed.
+type accessSummary struct {
+	Services []serviceAccess `json:"services"`
+	// NodeAddresses are the addresses NodePorts are reachable on, one per node.
+	NodeAddresses []string         `json:"nodeAddresses,omitempty"`
+	Endpoints     []accessEndpoint `json:"endpoints,omitempty"`
+}
+
+// serviceAccess describes an exposed Service.
+type serviceAccess struct {
+	Service string              `json:"service"` // namespace/name
+	Type    string              `json:"type"`
+	DNSName string              `json:"dnsName"`
+	Ports   []servicePortAccess `json:"ports"`
+	// LoadBalancer lists the ingress IPs or hostnames of a LoadBalancer Service; it's
+	// empty while the load balancer is pending.
+	LoadBalancer []string `json:"loadBalancer,omitempty"`
+}
+
+type servicePortAccess struct {
+	Name     string `json:"name,omitempty"`
+	Port     int64  `json:"port"`
+	NodePort int64  `json:"nodePort,omitempty"`
+}
+
+// accessEndpoint is a ready-to-use URL for one of the chart's endpoints. URL is
+// reachable from outside the cluster (load balancer, else NodePort) and is empty for
+// Services only exposed in the cluster.
+type accessEndpoint struct {
+	Name       string `json:"name"`
+	URL        string `json:"url,omitempty"`
+	ClusterURL string `json:"clusterURL"`
+}
+
+// summarizeAccess reads the rendered Services back from the cluster. Services of
+// type NodePort or LoadBalancer are listed, as well as those named in the chart's
+// accessAnnotation.
+func summarizeAccess(config *Config, resources []k8sResource) (*accessSummary, error) {
+	annotations, err := chartAnnotations(config.chartPath())
+	if err != nil {
+		return nil, err
+	}
+	endpoints, err := parseAccessAnnotation(annotations[accessAnnotation])
+	if err != nil {
+		return nil, err
+	}
+
+	rendered := map[string]bool{}
+	for _, res := range resources {
+		if res.Kind == "Service" {
+			rendered[res.Namespace+"/"+res.Name] = true
+		}
+	}
+
+	out, err := exec.Command("kubectl", kubectlArgs(config, "get", "services", "-A", "-o", "json")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+	var services struct {
+		Items []struct {
+			Metadata struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+			Spec struct {
+				Type  string `json:"type"`
+				Ports []struct {
+					Name     string `json:"name"`
+					Port     int64  `json:"port"`
+					NodePort int64  `json:"nodePort"`
+				} `json:"ports"`
+			} `json:"spec"`
+			Status struct {
+				LoadBalancer struct {
+					Ingress []struct {
+						IP       string `json:"ip"`
+						Hostname string `json:"hostname"`
+					} `json:"ingress"`
+				} `json:"loadBalancer"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &services); err != nil {
+		return nil, fmt.Errorf("failed to parse services: %w", err)
+	}
+
+	named := map[string]bool{}
+	for _, e := range endpoints {
+		named[e.service] = true
+	}
+
+	summary := &accessSummary{}
+	byName := map[string]serviceAccess{}
+	for _, svc := range services.Items {
+		id := svc.Metadata.Namespace + "/" + svc.Metadata.Name
+		if !rendered[id] {
+			continue
+		}
+		access := serviceAccess{
+			Service: id,
+			Type:    svc.Spec.Type,
+			DNSName: fmt.Sprintf("%s.%s.svc.cluster.local", svc.Metadata.Name, svc.Metadata.Namespace),
+		}
+		for _, p := range svc.Spec.Ports {
+			access.Ports = append(access.Ports, servicePortAccess{Name: p.Name, Port: p.Port, NodePort: p.NodePort})
+		}
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				access.LoadBalancer = append(access.LoadBalancer, ingress.IP)
+			} else if ingress.Hostname != "" {
+				access.LoadBalancer = append(access.LoadBalancer, ingress.Hostname)
+			}
+		}
+		byName[svc.Metadata.Name] = access
+		if access.Type == "NodePort" || access.Type == "LoadBalancer" || named[svc.Metadata.Name] {
+			summary.Services = append(summary.Services, access)
+		}
+	}
+	sort.Slice(summary.Services, func(i, j int) bool { return summary.Services[i].Service < summary.Services[j].Service })
+
+	for _, svc := range summary.Services {
+		if svc.Type == "NodePort" || svc.Type == "LoadBalancer" {
+			if summary.NodeAddresses, err = nodeAddresses(config); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	for _, e := range endpoints {
+		svc, ok := byName[e.service]
+		if !ok || len(svc.Ports) == 0 {
+			continue
+		}
+		port := svc.Ports[0]
+		endpoint := accessEndpoint{
+			Name:       e.name,
+			ClusterURL: fmt.Sprintf("http://%s:%d%s", svc.DNSName, port.Port, e.path),
+		}
+		switch {
+		case len(svc.LoadBalancer) > 0:
+			endpoint.URL = fmt.Sprintf("http://%s:%d%s", svc.LoadBalancer[0], port.Port, e.path)
+		case port.NodePort != 0 && len(summary.NodeAddresses) > 0:
+			endpoint.URL = fmt.Sprintf("http://%s:%d%s", summary.NodeAddresses[0], port.NodePort, e.path)
+		}
+		summary.Endpoints = append(summary.Endpoints, endpoint)
+	}
+	return summary, nil
+}
+
+type accessAnnotationEntry struct {
+	name, service, path string
+}
+
+// parseAccessAnnotation parses the name=service/path pairs of accessAnnotation.
+func parseAccessAnnotation(value string) ([]accessAnnotationEntry, error) {
+	var entries []accessAnnotationEntry
+	for _, item := range annotationList(value) {
+		name, target, ok := strings.Cut(item, "=")
+		if !ok || name == "" || target == "" {
+			return nil, fmt.Errorf("invalid %s entry %q: expected name=service/path", accessAnnotation, item)
+		}
+		service, path, _ := strings.Cut(target, "/")
+		entries = append(entries, accessAnnotationEntry{name: name, service: service, path: "/" + path})
+	}
+	return entries, nil
+}
+
+// nodeAddresses returns an address per node, preferring external addresses.
+func nodeAddresses(config *Config) ([]string, error) {
+	out, err := exec.Command("kubectl", kubectlArgs(config, "get", "nodes", "-o", "json")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	var nodes struct {
+		Items []struct {
+			Status struct {
+				Addresses []struct {
+					Type    string `json:"type"`
+					Address string `json:"address"`
+				} `json:"addresses"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &nodes); err != nil {
+		return nil, fmt.Errorf("failed to parse nodes: %w", err)
+	}
+
+	var addresses []string
+	for _, node := range nodes.Items {
+		best := ""
+		for _, a := range node.Status.Addresses {
+			if a.Type == "ExternalIP" {
+				best = a.Address
+				break
+			}
+			if a.Type == "InternalIP" && best == "" {
+				best = a.Address
+			}
+		}
+		if best != "" {
+			addresses = append(addresses, best)
+		}
+	}
+	return addresses, nil
+}
+
+// printAccess writes the access summary as two tables: the exposed Services and the
+// endpoint URLs.
+func printAccess(out io.Writer, summary *accessSummary) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tTYPE\tCLUSTER ADDRESS\tEXTERNAL")
+	for _, svc := range summary.Services {
+		var cluster, external []string
+		for _, p := range svc.Ports {
+			cluster = append(cluster, svc.DNSName+":"+strconv.FormatInt(p.Port, 10))
+			for _, lb := range svc.LoadBalancer {
+				external = append(external, lb+":"+strconv.FormatInt(p.Port, 10))
+			}
+			if p.NodePort != 0 {
+				for _, node := range summary.NodeAddresses {
+					external = append(external, node+":"+strconv.FormatInt(p.NodePort, 10))
+				}
+			}
+		}
+		if svc.Type == "LoadBalancer" && len(svc.LoadBalancer) == 0 {
+			external = append([]string{"<pending>"}, external...)
+		}
+		if len(external) == 0 {
+			external = []string{"-"}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", svc.Service, svc.Type, strings.Join(cluster, ", "), strings.Join(external, ", "))
+	}
+	w.Flush()
+
+	if len(summary.Endpoints) == 0 {
+		return
+	}
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tURL\tIN-CLUSTER URL")
+	for _, e := range summary.Endpoints {
+		url := e.URL
+		if url == "" {
+			url = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", e.Name, url, e.ClusterURL)
+	}
+	w.Flush()
+}
@@ -13,9 +13,7 @@ TAG_LATEST="${TAG_LATEST:-true}"
 NO_CACHE="${NO_CACHE:-false}"
 AGENTCERT_ENV_FILE="${AGENTCERT_ENV_FILE:-$BUILD_CONTEXT/../AgentCert/local-custom/config/.env}"
 LOCAL_MODE=false
-
-SOCKSHOP_VALUES_FILE="$BUILD_CONTEXT/charts/sock-shop/values.yaml"
-SOCKSHOP_VALUES_BACKUP=""
+INSTALL_PROFILE="${INSTALL_PROFILE:-}"
 
 IMAGE_REPO="${IMAGE_REGISTRY}/${IMAGE_NAME}"
 PRIMARY_IMAGE="${IMAGE_REPO}:${IMAGE_TAG}"
@@ -28,9 +26,11 @@ Usage: $(basename "$0") [OPTIONS]
 Build and load install-app image into minikube, then update AgentCert .env.
 
 Options:
-  --local-mode   Build with local-friendly sock-shop tracing settings
-                 (temporary override: tracing.disableSleuth=true, tracing.zipkinHost="")
-  --help         Show this help
+  --local-mode        Build an image that installs with the "local" values profile
+                      (tracing.disableSleuth=true, tracing.zipkinHost="")
+  --profile <name>    Build an image that installs with the given values profile
+                      (local, kind, minikube, large or auto; see charts/<chart>/profiles)
+  --help              Show this help
 EOF
 }
 
@@ -40,6 +40,11 @@ while [[ $# -gt 0 ]]; do
             LOCAL_MODE=true
             shift
             ;;
+        --profile)
+            [[ $# -ge 2 ]] || { printf '[ERROR] --profile requires a value\n' >&2; usage; exit 1; }
+            INSTALL_PROFILE="$2"
+            shift 2
+            ;;
         --help|-h)
             usage
             exit 0
@@ -71,32 +76,18 @@ require_cmd() {
     }
 }
 
-restore_sockshop_values() {
-    if [[ -n "$SOCKSHOP_VALUES_BACKUP" && -f "$SOCKSHOP_VALUES_BACKUP" ]]; then
-        mv "$SOCKSHOP_VALUES_BACKUP" "$SOCKSHOP_VALUES_FILE"
-        success "Restored sock-shop values.yaml defaults"
-    fi
-}
-
-prepare_local_mode_overrides() {
-    if [[ "$LOCAL_MODE" != "true" ]]; then
-        return 0
+resolve_install_profile() {
+    if [[ "$LOCAL_MODE" == "true" ]]; then
+        if [[ -n "$INSTALL_PROFILE" && "$INSTALL_PROFILE" != "local" ]]; then
+            printf '[ERROR] --local-mode conflicts with --profile %s\n' "$INSTALL_PROFILE" >&2
+            exit 1
+        fi
+        INSTALL_PROFILE=local
     fi
 
-    if [[ ! -f "$SOCKSHOP_VALUES_FILE" ]]; then
-        warn "sock-shop values not found at $SOCKSHOP_VALUES_FILE; skipping local-mode chart overrides"
-        return 0
+    if [[ -n "$INSTALL_PROFILE" ]]; then
+        info "Image will install with the '${INSTALL_PROFILE}' values profile"
     fi
-
-    info "Applying local-mode tracing overrides to sock-shop chart (temporary)"
-    SOCKSHOP_VALUES_BACKUP="${SOCKSHOP_VALUES_FILE}.bak.$(date +%Y%m%d%H%M%S)"
-    cp "$SOCKSHOP_VALUES_FILE" "$SOCKSHOP_VALUES_BACKUP"
-
-    sed -i 's|^\([[:space:]]*zipkinHost:[[:space:]]*\).*|\1""|' "$SOCKSHOP_VALUES_FILE"
-    sed -i 's|^\([[:space:]]*disableSleuth:[[:space:]]*\).*|\1true|' "$SOCKSHOP_VALUES_FILE"
-
-    trap restore_sockshop_values EXIT
-    success "Local-mode overrides applied: tracing.disableSleuth=true, tracing.zipkinHost=\"\""
 }
 
 upsert_env_value() {
@@ -114,6 +105,7 @@ upsert_env_value() {
 
 build_image() {
     local build_args=(docker build -t "$PRIMARY_IMAGE" -f "$SCRIPT_DIR/Dockerfile")
+    build_args+=(--build-arg "INSTALL_APP_PROFILE=${INSTALL_PROFILE}")
     if [[ "$NO_CACHE" == "true" ]]; then
         build_args+=(--no-cache)
     fi
@@ -215,6 +207,7 @@ show_result() {
         printf 'Alias image: %s\n' "$LATEST_IMAGE"
     fi
     printf 'Minikube profile: %s\n' "$MINIKUBE_PROFILE"
+    printf 'Values profile: %s\n' "${INSTALL_PROFILE:-chart defaults}"
     printf 'Updated .env: %s\n' "$AGENTCERT_ENV_FILE"
 }
 
@@ -222,7 +215,7 @@ main() {
     require_cmd docker
     require_cmd minikube
 
-    prepare_local_mode_overrides
+    resolve_install_profile
 
     build_image
     load_into_minikube
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The chart repository is copied into bundle/charts before building so that it is
+// compiled into the binary, together with bundle/charts.sha256, the content hash
+// manifest used by verifyChart. `go generate` (or `make binary`) refreshes both;
+// the Docker build runs gen-bundle.sh on its own copy of charts/.
+//
+//go:generate sh gen-bundle.sh ../charts
+//go:embed all:bundle
+var bundleFS embed.FS
+
+const (
+	bundleChartsDir          = "bundle/charts"
+	chartServiceVersionFile  = "applications.chartserviceversion.yaml"
+	embeddedChartsPathMarker = "embedded"
+)
+
+// embeddedCharts returns the chart repository compiled into the binary. The second
+// return value is false when the binary was built without running `go generate`.
+func embeddedCharts() (fs.FS, bool) {
+	charts, err := fs.Sub(bundleFS, bundleChartsDir)
+	if err != nil {
+		return nil, false
+	}
+	entries, err := fs.ReadDir(charts, ".")
+	if err != nil || len(entries) == 0 {
+		return nil, false
+	}
+	return charts, true
+}
+
+// resolveChartsPath decides where charts are read from. An explicit -charts-path
+// always wins; otherwise the embedded chart repository is extracted to a temporary
+// directory (helm needs a real path), falling back to /charts for binaries built
+// without embedded charts. The returned cleanup func removes any extracted files.
+func resolveChartsPath(config *Config) (func(), error) {
+	noop := func() {}
+
+	if config.ChartsPath != "" && config.ChartsPath != embeddedChartsPathMarker {
+		return noop, nil
+	}
+
+	charts, ok := embeddedCharts()
+	if !ok {
+		if config.ChartsPath == embeddedChartsPathMarker {
+			return noop, fmt.Errorf("this binary was built without embedded charts (run go generate before go build)")
+		}
+		config.ChartsPath = defaultChartsPath
+		return noop, nil
+	}
+
+	dir, err := os.MkdirTemp("", "install-app-charts-")
+	if err != nil {
+		return noop, fmt.Errorf("failed to create directory for embedded charts: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	if err := extractFS(charts, dir); err != nil {
+		cleanup()
+		return noop, fmt.Errorf("failed to extract embedded charts: %w", err)
+	}
+
+	config.ChartsPath = dir
+	log.Printf("Using embedded chart repository (%s)", describeChartServiceVersion(charts))
+	return cleanup, nil
+}
+
+// extractFS writes every file of src below dest, preserving the directory layout.
+func extractFS(src fs.FS, dest string) error {
+	return fs.WalkDir(src, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, filepath.FromSlash(path))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		data, err := fs.ReadFile(src, path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, data, 0o644)
+	})
+}
+
+// describeChartServiceVersion returns "name version" from the ChartServiceVersion
+// shipped alongside the charts, for logging which chart repository is in use.
+func describeChartServiceVersion(charts fs.FS) string {
+	data, err := fs.ReadFile(charts, chartServiceVersionFile)
+	if err != nil {
+		return "no ChartServiceVersion"
+	}
+
+	var name, version string
+	inMetadata := false
+	for _, line := range strings.Split(string(data), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "metadata:" {
+			inMetadata = true
+			continue
+		}
+		if inMetadata && trimmed != "" && !strings.HasPrefix(line, " ") {
+			break
+		}
+		if !inMetadata || !strings.HasPrefix(line, "  ") || strings.HasPrefix(line, "   ") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "name:") {
+			name = strings.Trim(strings.TrimSpace(strings.TrimPrefix(trimmed, "name:")), "\"'")
+		}
+		if strings.HasPrefix(trimmed, "version:") {
+			version = strings.Trim(strings.TrimSpace(strings.TrimPrefix(trimmed, "version:")), "\"'")
+		}
+	}
+	return strings.TrimSpace(fmt.Sprintf("ChartServiceVersion %s %s", name, version))
+}
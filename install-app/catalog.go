@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// catalogEntry describes one chart folder and the versions available in it.
+type catalogEntry struct {
+	Chart       string   `json:"chart"`
+	Description string   `json:"description,omitempty"`
+	Versions    []string `json:"versions"`
+	Latest      string   `json:"latest"`
+	Profiles    []string `json:"profiles,omitempty"`
+}
+
+// runCatalog implements `install-app catalog`, listing the charts and chart versions
+// that can be installed from the charts path.
+func runCatalog(args []string) error {
+	var chartsPath, output string
+
+	flags := flag.NewFlagSet("catalog", flag.ExitOnError)
+	flags.StringVar(&chartsPath, "charts-path", "", "Base path where charts are located (defaults to the embedded charts, or "+defaultChartsPath+")")
+	flags.StringVar(&output, "output", "text", "Output format: text or json")
+	flags.Parse(args)
+
+	source := &Config{ChartsPath: chartsPath}
+	cleanup, err := resolveChartsPath(source)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	entries, err := buildCatalog(source.ChartsPath)
+	if err != nil {
+		return err
+	}
+
+	if output == "json" {
+		return printJSON(entries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHART\tLATEST\tVERSIONS\tPROFILES\tDESCRIPTION")
+	for _, e := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.Chart, e.Latest, strings.Join(e.Versions, ", "), strings.Join(e.Profiles, ", "), e.Description)
+	}
+	return w.Flush()
+}
+
+func buildCatalog(chartsPath string) ([]catalogEntry, error) {
+	charts, err := ListAvailableCharts(chartsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []catalogEntry
+	for _, chart := range charts {
+		versions, err := listChartVersions(chartsPath, chart)
+		if err != nil {
+			return nil, err
+		}
+		entry := catalogEntry{Chart: chart}
+		for _, v := range versions {
+			entry.Versions = append(entry.Versions, v.Version)
+		}
+		latest := versions[len(versions)-1]
+		entry.Latest = latest.Version
+		entry.Description, _ = readChartField(latest.Path, "description")
+		entry.Profiles, _ = listProfiles(latest.Path)
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// releaseStatus is the installed state of a release as reported by `helm list`.
+type releaseStatus struct {
+	Release    string   `json:"release"`
+	Namespace  string   `json:"namespace"`
+	Chart      string   `json:"chart"`
+	Version    string   `json:"version"`
+	AppVersion string   `json:"appVersion"`
+	Revision   string   `json:"revision"`
+	Status     string   `json:"status"`
+	Updated    string   `json:"updated"`
+	Available  []string `json:"availableVersions,omitempty"`
+}
+
+var chartVersionSuffix = regexp.MustCompile(`^(.+)-(v?[0-9]+\.[0-9]+\.[0-9]+\S*)$`)
+
+// getReleaseStatus looks up a release with `helm list` and splits its chart field
+// ("sock-shop-0.1.0") into chart name and installed version. An empty namespace
+// searches all namespaces.
+func getReleaseStatus(releaseName, namespace, kubeConfig, kubeContext string) (*releaseStatus, error) {
+	releases, err := listReleases(releaseName, namespace, kubeConfig, kubeContext)
+	if err != nil {
+		return nil, err
+	}
+	if len(releases) == 0 {
+		if namespace == "" {
+			return nil, fmt.Errorf("release %s not found", releaseName)
+		}
+		return nil, fmt.Errorf("release %s not found in namespace %s", releaseName, namespace)
+	}
+	if len(releases) > 1 {
+		return nil, fmt.Errorf("release %s exists in several namespaces, use -namespace to pick one", releaseName)
+	}
+	return &releases[0], nil
+}
+
+// listReleases returns the releases named releaseName in namespace, or in every
+// namespace when it is empty.
+func listReleases(releaseName, namespace, kubeConfig, kubeContext string) ([]releaseStatus, error) {
+	args := []string{"list", "--all", "--filter", "^" + regexp.QuoteMeta(releaseName) + "$", "-o", "json"}
+	if namespace != "" {
+		args = append(args, "-n", namespace)
+	} else {
+		args = append(args, "-A")
+	}
+	if kubeConfig != "" {
+		args = append(args, "--kubeconfig", kubeConfig)
+	}
+	if kubeContext != "" {
+		args = append(args, "--kube-context", kubeContext)
+	}
+
+	out, err := exec.Command("helm", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("helm list failed: %w", err)
+	}
+
+	var releases []struct {
+		Name       string `json:"name"`
+		Namespace  string `json:"namespace"`
+		Revision   string `json:"revision"`
+		Updated    string `json:"updated"`
+		Status     string `json:"status"`
+		Chart      string `json:"chart"`
+		AppVersion string `json:"app_version"`
+	}
+	if err := json.Unmarshal(out, &releases); err != nil {
+		return nil, fmt.Errorf("failed to parse helm list output: %w", err)
+	}
+
+	statuses := make([]releaseStatus, len(releases))
+	for i, r := range releases {
+		statuses[i] = releaseStatus{
+			Release:    r.Name,
+			Namespace:  r.Namespace,
+			Chart:      r.Chart,
+			AppVersion: r.AppVersion,
+			Revision:   r.Revision,
+			Status:     r.Status,
+			Updated:    r.Updated,
+		}
+		if m := chartVersionSuffix.FindStringSubmatch(r.Chart); m != nil {
+			statuses[i].Chart, statuses[i].Version = m[1], m[2]
+		}
+	}
+	return statuses, nil
+}
+
+// runStatus implements `install-app status <release>`, showing which chart version
+// is installed alongside the versions available in the catalog.
+func runStatus(args []string) error {
+	var namespace, chartsPath, output, kubeConfig, kubeContext string
+
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.StringVar(&namespace, "namespace", "", "Namespace of the release (defaults to searching all namespaces)")
+	flags.StringVar(&chartsPath, "charts-path", "", "Base path where charts are located (defaults to the embedded charts, or "+defaultChartsPath+")")
+	flags.StringVar(&output, "output", "text", "Output format: text or json")
+	flags.StringVar(&kubeConfig, "kubeconfig", "", "Path to kubeconfig file")
+	flags.StringVar(&kubeContext, "context", "", "Kubernetes context to use")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: install-app status <release> [options]\n\n")
+		flags.PrintDefaults()
+	}
+
+	// Accept the release name before or after the flags.
+	var release string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		release, args = args[0], args[1:]
+	}
+	flags.Parse(args)
+	if release == "" {
+		release = flags.Arg(0)
+	}
+	if release == "" {
+		flags.Usage()
+		return fmt.Errorf("release name is required")
+	}
+
+	status, err := getReleaseStatus(release, namespace, kubeConfig, kubeContext)
+	if err != nil {
+		return err
+	}
+
+	source := &Config{ChartsPath: chartsPath}
+	cleanup, err := resolveChartsPath(source)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if versions, err := listChartVersions(source.ChartsPath, status.Chart); err == nil {
+		for _, v := range versions {
+			status.Available = append(status.Available, v.Version)
+		}
+	}
+
+	if output == "json" {
+		return printJSON(status)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Release:\t%s\n", status.Release)
+	fmt.Fprintf(w, "Namespace:\t%s\n", status.Namespace)
+	fmt.Fprintf(w, "Chart:\t%s\n", status.Chart)
+	fmt.Fprintf(w, "Installed version:\t%s\n", status.Version)
+	fmt.Fprintf(w, "App version:\t%s\n", status.AppVersion)
+	fmt.Fprintf(w, "Revision:\t%s\n", status.Revision)
+	fmt.Fprintf(w, "Status:\t%s\n", status.Status)
+	fmt.Fprintf(w, "Updated:\t%s\n", status.Updated)
+	if len(status.Available) > 0 {
+		fmt.Fprintf(w, "Available versions:\t%s\n", strings.Join(status.Available, ", "))
+	}
+	return w.Flush()
+}
+
+// upgradeStep records the outcome of installing one version in an upgrade path.
+type upgradeStep struct {
+	Version  string
+	Duration time.Duration
+	Err      error
+}
+
+// runUpgradePath implements `install-app upgrade-path`: it installs every version
+// of a chart between -from and -to in ascending order as upgrades of one release,
+// waiting for the workloads after each step, so upgrades between chart versions are
+// exercised the same way a benchmark campaign would roll them out.
+func runUpgradePath(args []string) error {
+	// Start from the install defaults, environment and -config file, so that every
+	// step is configured like a plain install (image pull secrets included).
+	config, err := loadConfig(nil, flag.ExitOnError)
+	if err != nil {
+		return err
+	}
+	var from, to string
+	var setValues setFlags
+
+	flags := flag.NewFlagSet("upgrade-path", flag.ExitOnError)
+	flags.StringVar(&config.FolderName, "folder", config.FolderName, "Name of the folder containing the chart versions (required)")
+	flags.StringVar(&config.ReleaseName, "release", config.ReleaseName, "Helm release name (defaults to folder name)")
+	flags.StringVar(&config.Namespace, "namespace", config.Namespace, "Kubernetes namespace to install into (defaults to the chart's namespace value, or "+defaultNamespace+")")
+	flags.StringVar(&config.ChartsPath, "charts-path", config.ChartsPath, "Base path where charts are located (defaults to the embedded charts, or "+defaultChartsPath+")")
+	flags.StringVar(&from, "from", "", "First version of the path (defaults to the oldest)")
+	flags.StringVar(&to, "to", "", "Last version of the path (defaults to the latest)")
+	flags.StringVar(&config.Timeout, "timeout", config.Timeout, "Timeout for each step")
+	flags.Var(&setValues, "set", "Set values on command line (can be repeated)")
+	flags.StringVar(&config.KubeConfig, "kubeconfig", config.KubeConfig, "Path to kubeconfig file")
+	flags.StringVar(&config.KubeContext, "context", config.KubeContext, "Kubernetes context to use")
+	flags.BoolVar(&config.AllowUnverified, "allow-unverified", config.AllowUnverified, "Install even if chart verification fails")
+	flags.Parse(args)
+
+	// Every step upgrades the release and waits for it before the next one.
+	config.Upgrade, config.Wait = true, true
+	if len(setValues) > 0 {
+		config.SetValues = setValues
+	}
+
+	if config.FolderName == "" {
+		return fmt.Errorf("folder name is required. Use -folder flag")
+	}
+	if config.ReleaseName == "" {
+		config.ReleaseName = config.FolderName
+	}
+
+	cleanup, err := resolveChartsPath(config)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	versions, err := listChartVersions(config.ChartsPath, config.FolderName)
+	if err != nil {
+		return err
+	}
+	var path []string
+	for _, v := range versions {
+		if from != "" && compareVersions(v.Version, from) < 0 {
+			continue
+		}
+		if to != "" && compareVersions(v.Version, to) > 0 {
+			continue
+		}
+		path = append(path, v.Version)
+	}
+	if len(path) < 2 {
+		return fmt.Errorf("upgrade path needs at least two versions, found %d (%s)", len(path), strings.Join(path, ", "))
+	}
+
+	log.Printf("Upgrade path for %s: %s", config.FolderName, strings.Join(path, " -> "))
+
+	var steps []upgradeStep
+	for _, version := range path {
+		step := *config
+		step.Version = version
+		step.resolvedChart = ""
+
+		started := time.Now()
+		err := run(&step)
+		if err == nil {
+			err = checkInstalledVersion(&step, version)
+		}
+		steps = append(steps, upgradeStep{Version: version, Duration: time.Since(started), Err: err})
+		if err != nil {
+			break
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tRESULT\tDURATION")
+	for _, s := range steps {
+		result := "ok"
+		if s.Err != nil {
+			result = "failed: " + s.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", s.Version, result, s.Duration.Round(time.Second))
+	}
+	w.Flush()
+
+	if last := steps[len(steps)-1]; last.Err != nil {
+		return fmt.Errorf("upgrade to %s failed: %w", last.Version, last.Err)
+	}
+	return nil
+}
+
+// checkInstalledVersion confirms that helm reports the release as deployed at the
+// expected chart version after a step of the upgrade path.
+func checkInstalledVersion(config *Config, version string) error {
+	status, err := getReleaseStatus(config.ReleaseName, config.Namespace, config.KubeConfig, config.KubeContext)
+	if err != nil {
+		return err
+	}
+	if status.Status != "deployed" || status.Version != version {
+		return fmt.Errorf("release %s is %s at version %s, expected deployed at %s",
+			config.ReleaseName, status.Status, status.Version, version)
+	}
+	return nil
+}
+
+// printJSON writes v to stdout as indented JSON.
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
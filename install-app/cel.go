@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+)
+
+// Custom policy rules are CEL expressions evaluated with cel-go. The environment is
+// close to the base environment of Kubernetes validation rules: the standard
+// library, optional field selection (a.?b), cross-type numeric comparisons
+// (1 == 1.0) and the strings and sets extensions. Kubernetes' own libraries, such as
+// quantity() and url(), are not available.
+
+// celEnv declares the variables a rule sees: the rendered manifest as object and the
+// selected profile as profile.
+var celEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("object", cel.DynType),
+		cel.Variable("profile", cel.StringType),
+		cel.OptionalTypes(),
+		cel.CrossTypeNumericComparisons(true),
+		cel.DefaultUTCTimeZone(true),
+		ext.Strings(ext.StringsVersion(2)),
+		ext.Sets(),
+	)
+})
+
+// compileCEL compiles a rule's expression, which must yield a bool.
+func compileCEL(source string) (cel.Program, error) {
+	env, err := celEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(source)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if t := ast.OutputType(); !t.IsExactType(cel.BoolType) && !t.IsExactType(cel.DynType) {
+		return nil, fmt.Errorf("expression returns %s, not a bool", t)
+	}
+	return env.Program(ast)
+}
+
+// evalCELBool evaluates a compiled expression that must yield a boolean.
+func evalCELBool(prg cel.Program, vars map[string]interface{}) (bool, error) {
+	v, _, err := prg.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.Value().(bool)
+	if !ok {
+		return false, fmt.Errorf("expression returned %s, not a bool", v.Type())
+	}
+	return b, nil
+}
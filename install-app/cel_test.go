@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+var celTestVars = map[string]interface{}{
+	"object": map[string]interface{}{
+		"kind": "Deployment",
+		"metadata": map[string]interface{}{
+			"name":   "web",
+			"labels": map[string]interface{}{"app": "web"},
+		},
+		"spec": map[string]interface{}{
+			"replicas": int64(3),
+			"ratio":    0.5,
+			"ports":    []interface{}{int64(80), int64(443)},
+			"empty":    nil,
+		},
+	},
+	"profile": "kind",
+}
+
+// TestCEL checks the rule environment against manifests as parseYAML decodes them.
+func TestCEL(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"object.spec.replicas >= 2", true},
+		{"object.spec.replicas / 2 == 1", true},
+		{"object.spec.ratio * 2.0 == 1.0", true},
+		{"object.spec.replicas == 3.0", true},
+		{"object.spec.replicas > object.spec.ratio", true},
+		{"type(object.spec.replicas) == int", true},
+		{"type(object.spec.ratio) == double", true},
+		{"object.spec.empty == null", true},
+		{"has(object.spec.replicas) && !has(object.spec.missing)", true},
+		{"'app' in object.metadata.labels", true},
+		{"object.spec.ports.exists(p, p == 443)", true},
+		{"object.spec.ports.all(p, p > 0)", true},
+		{"object.spec.ports.map(p, p * 2) == [160, 886]", true},
+		{"object.?spec.?missing.orValue(1) == 1", true},
+		{"object.metadata.name.upperAscii() == 'WEB'", true},
+		{"sets.contains(object.spec.ports, [443])", true},
+		{"object.x.missing == 1 || true", true},
+		{"object.kind.startsWith('Stateful')", false},
+		{"profile == 'kind'", true},
+	}
+	for _, tt := range tests {
+		prg, err := compileCEL(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		got, err := evalCELBool(prg, celTestVars)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCELErrors(t *testing.T) {
+	compile := []struct{ expr, err string }{
+		{"undefined == 1", "undeclared reference to 'undefined'"},
+		{"object.spec.replicas +", "Syntax error"},
+		{"size(profile)", "not a bool"},
+		{"profile.quantity() > 1", "undeclared reference to 'quantity'"},
+	}
+	for _, tt := range compile {
+		_, err := compileCEL(tt.expr)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.expr, err, tt.err)
+		}
+	}
+
+	eval := []struct{ expr, err string }{
+		{"object.missing == 1", "no such key: missing"},
+		{"object.spec.replicas", "not a bool"},
+		{"object.spec.replicas / 0 == 1", "division by zero"},
+		{"object.spec.replicas + object.spec.ratio > 1.0", "no such overload"},
+	}
+	for _, tt := range eval {
+		prg, err := compileCEL(tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+			continue
+		}
+		_, err = evalCELBool(prg, celTestVars)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.expr, err, tt.err)
+		}
+	}
+}
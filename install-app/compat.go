@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// compatibilityLookahead is how many minor releases ahead of the cluster a removed
+// API is reported for, so a planned cluster upgrade doesn't break the release.
+const compatibilityLookahead = 2
+
+// apiDeprecation is the Kubernetes release that deprecated and removed an API.
+type apiDeprecation struct {
+	Deprecated  string
+	Removed     string
+	Replacement string
+}
+
+// apiDeprecations lists removed and deprecated built-in APIs, keyed by apiVersion
+// and kind, or by apiVersion alone for every kind of it. Source: the Kubernetes
+// deprecated API migration guide.
+var apiDeprecations = map[string]apiDeprecation{
+	"extensions/v1beta1":                        {"1.8", "1.16", "apps/v1"},
+	"extensions/v1beta1/Ingress":                {"1.14", "1.22", "networking.k8s.io/v1"},
+	"extensions/v1beta1/NetworkPolicy":          {"1.9", "1.16", "networking.k8s.io/v1"},
+	"extensions/v1beta1/PodSecurityPolicy":      {"1.10", "1.16", "policy/v1beta1"},
+	"apps/v1beta1":                              {"1.9", "1.16", "apps/v1"},
+	"apps/v1beta2":                              {"1.9", "1.16", "apps/v1"},
+	"networking.k8s.io/v1beta1":                 {"1.19", "1.22", "networking.k8s.io/v1"},
+	"rbac.authorization.k8s.io/v1beta1":         {"1.17", "1.22", "rbac.authorization.k8s.io/v1"},
+	"rbac.authorization.k8s.io/v1alpha1":        {"1.17", "1.22", "rbac.authorization.k8s.io/v1"},
+	"apiregistration.k8s.io/v1beta1":            {"1.19", "1.22", "apiregistration.k8s.io/v1"},
+	"apiextensions.k8s.io/v1beta1":              {"1.16", "1.22", "apiextensions.k8s.io/v1"},
+	"admissionregistration.k8s.io/v1beta1":      {"1.16", "1.22", "admissionregistration.k8s.io/v1"},
+	"scheduling.k8s.io/v1beta1":                 {"1.14", "1.22", "scheduling.k8s.io/v1"},
+	"scheduling.k8s.io/v1alpha1":                {"1.14", "1.17", "scheduling.k8s.io/v1"},
+	"storage.k8s.io/v1beta1":                    {"1.19", "1.22", "storage.k8s.io/v1"},
+	"storage.k8s.io/v1beta1/CSIStorageCapacity": {"1.24", "1.27", "storage.k8s.io/v1"},
+	"certificates.k8s.io/v1beta1":               {"1.19", "1.22", "certificates.k8s.io/v1"},
+	"coordination.k8s.io/v1beta1":               {"1.19", "1.22", "coordination.k8s.io/v1"},
+	"batch/v1beta1":                             {"1.21", "1.25", "batch/v1"},
+	"discovery.k8s.io/v1beta1":                  {"1.21", "1.25", "discovery.k8s.io/v1"},
+	"events.k8s.io/v1beta1":                     {"1.19", "1.25", "events.k8s.io/v1"},
+	"autoscaling/v2beta1":                       {"1.22", "1.25", "autoscaling/v2"},
+	"autoscaling/v2beta2":                       {"1.23", "1.26", "autoscaling/v2"},
+	"policy/v1beta1":                            {"1.21", "1.25", "policy/v1"},
+	"policy/v1beta1/PodSecurityPolicy":          {"1.21", "1.25", "Pod Security Admission"},
+	"node.k8s.io/v1beta1":                       {"1.20", "1.25", "node.k8s.io/v1"},
+	"flowcontrol.apiserver.k8s.io/v1beta1":      {"1.23", "1.26", "flowcontrol.apiserver.k8s.io/v1"},
+	"flowcontrol.apiserver.k8s.io/v1beta2":      {"1.26", "1.29", "flowcontrol.apiserver.k8s.io/v1"},
+	"flowcontrol.apiserver.k8s.io/v1beta3":      {"1.29", "1.32", "flowcontrol.apiserver.k8s.io/v1"},
+}
+
+// compatibilityReport is the result of checking the rendered chart against the
+// cluster's Kubernetes version and served APIs.
+type compatibilityReport struct {
+	ServerVersion string `json:"serverVersion"`
+	// KubeVersion is the chart's kubeVersion constraint.
+	KubeVersion string                 `json:"kubeVersion,omitempty"`
+	Findings    []compatibilityFinding `json:"findings,omitempty"`
+}
+
+// compatibilityFinding is an incompatibility ("error") or an API that a coming
+// Kubernetes release removes ("warning").
+type compatibilityFinding struct {
+	Severity   string `json:"severity"`
+	Object     string `json:"object,omitempty"`
+	APIVersion string `json:"apiVersion,omitempty"`
+	Message    string `json:"message"`
+}
+
+// preflightCompatibility checks the chart's kubeVersion constraint against the
+// cluster's version and scans the rendered objects for APIs the cluster doesn't serve
+// or that are deprecated. Like the capacity preflight, errors abort the install with
+// -preflight-mode fail and are only logged with warn.
+func preflightCompatibility(config *Config, resources []k8sResource) error {
+	if config.PreflightMode == preflightOff {
+		return nil
+	}
+	server, err := serverVersion(config)
+	if err != nil {
+		log.Printf("Warning: skipping the compatibility check: %v", err)
+		return nil
+	}
+	report := &compatibilityReport{ServerVersion: server}
+
+	constraint, err := chartKubeVersion(config.chartPath())
+	if err != nil {
+		return err
+	}
+	if constraint != "" {
+		report.KubeVersion = constraint
+		ok, err := kubeVersionSatisfies(server, constraint)
+		switch {
+		case err != nil:
+			report.Findings = append(report.Findings, compatibilityFinding{Severity: "warning",
+				Message: fmt.Sprintf("can't check the chart's kubeVersion %q: %v", constraint, err)})
+		case !ok:
+			report.Findings = append(report.Findings, compatibilityFinding{Severity: "error",
+				Message: fmt.Sprintf("the chart requires Kubernetes %s, the cluster runs %s", constraint, server)})
+		}
+	}
+
+	served, err := servedAPIs(config, resources)
+	if err != nil {
+		log.Printf("Warning: not checking the rendered APIs against the cluster: %v", err)
+	}
+	report.Findings = append(report.Findings, checkRenderedAPIs(resources, server, served)...)
+	config.result.Compatibility = report
+
+	var errs []string
+	for _, f := range report.Findings {
+		message := f.Message
+		if f.Object != "" {
+			message = fmt.Sprintf("%s (%s): %s", f.Object, f.APIVersion, f.Message)
+		}
+		if f.Severity == "error" && config.PreflightMode == preflightFail {
+			errs = append(errs, message)
+			continue
+		}
+		log.Printf("Warning: %s", message)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("the chart is not compatible with the cluster (Kubernetes %s; use -preflight-mode warn "+
+			"to install anyway):\n  %s", server, strings.Join(errs, "\n  "))
+	}
+	if len(report.Findings) == 0 {
+		log.Printf("Compatibility: the rendered APIs are served by Kubernetes %s", server)
+	}
+	return nil
+}
+
+// serverVersion returns the cluster's Kubernetes version, e.g. "1.29.2".
+func serverVersion(config *Config) (string, error) {
+	out, err := exec.Command("kubectl", kubectlArgs(config, "version", "-o", "json")...).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read the server version: %w", err)
+	}
+	var version struct {
+		ServerVersion struct {
+			GitVersion string `json:"gitVersion"`
+		} `json:"serverVersion"`
+	}
+	if err := json.Unmarshal(out, &version); err != nil || version.ServerVersion.GitVersion == "" {
+		return "", fmt.Errorf("failed to parse the server version: %v", err)
+	}
+	// Drop vendor suffixes like "-eks-508b6b3" or "+k3s1".
+	v, _, _ := strings.Cut(strings.TrimPrefix(version.ServerVersion.GitVersion, "v"), "-")
+	v, _, _ = strings.Cut(v, "+")
+	return v, nil
+}
+
+// chartKubeVersion returns the kubeVersion constraint of a chart's Chart.yaml.
+func chartKubeVersion(chartPath string) (string, error) {
+	data, err := readChartFile(chartPath, "Chart.yaml")
+	if err != nil {
+		return "", err
+	}
+	doc, err := parseYAML(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse Chart.yaml: %w", err)
+	}
+	chart, _ := doc.(map[string]interface{})
+	constraint, _ := chart["kubeVersion"].(string)
+	return constraint, nil
+}
+
+// servedAPIs returns the "apiVersion/Kind" pairs the cluster serves for the API
+// versions the rendered objects use. It reads API discovery for each of them, since
+// `kubectl api-resources` only lists the preferred version of a resource and misses
+// valid ones such as autoscaling/v1 HorizontalPodAutoscalers.
+func servedAPIs(config *Config, resources []k8sResource) (map[string]bool, error) {
+	out, err := exec.Command("kubectl", kubectlArgs(config, "get", "--raw", "/apis")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the served API groups: %w", err)
+	}
+	var groups struct {
+		Groups []struct {
+			Versions []struct {
+				GroupVersion string `json:"groupVersion"`
+			} `json:"versions"`
+		} `json:"groups"`
+	}
+	if err := json.Unmarshal(out, &groups); err != nil {
+		return nil, fmt.Errorf("failed to parse the served API groups: %w", err)
+	}
+	versions := map[string]bool{"v1": true}
+	for _, g := range groups.Groups {
+		for _, v := range g.Versions {
+			versions[v.GroupVersion] = true
+		}
+	}
+
+	served := map[string]bool{}
+	read := map[string]bool{}
+	for _, res := range resources {
+		apiVersion, _ := res.Object["apiVersion"].(string)
+		if !versions[apiVersion] || read[apiVersion] {
+			continue
+		}
+		read[apiVersion] = true
+		path := "/apis/" + apiVersion
+		if apiVersion == "v1" {
+			path = "/api/v1"
+		}
+		out, err := exec.Command("kubectl", kubectlArgs(config, "get", "--raw", path)...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the resources of %s: %w", apiVersion, err)
+		}
+		var list struct {
+			Resources []struct {
+				Name string `json:"name"`
+				Kind string `json:"kind"`
+			} `json:"resources"`
+		}
+		if err := json.Unmarshal(out, &list); err != nil {
+			return nil, fmt.Errorf("failed to parse the resources of %s: %w", apiVersion, err)
+		}
+		for _, r := range list.Resources {
+			// Subresources such as deployments/scale have kinds of their own.
+			if !strings.Contains(r.Name, "/") {
+				served[apiVersion+"/"+r.Kind] = true
+			}
+		}
+	}
+	return served, nil
+}
+
+// checkRenderedAPIs reports rendered objects whose API the cluster doesn't serve or
+// that Kubernetes has removed, and APIs deprecated or removed within
+// compatibilityLookahead releases of server. Kinds defined by a rendered
+// CustomResourceDefinition are served once it is installed.
+func checkRenderedAPIs(resources []k8sResource, server string, served map[string]bool) []compatibilityFinding {
+	defined := map[string]bool{}
+	for _, res := range resources {
+		if res.Kind == "CustomResourceDefinition" {
+			spec, _ := res.Object["spec"].(map[string]interface{})
+			names, _ := spec["names"].(map[string]interface{})
+			group, _ := spec["group"].(string)
+			kind, _ := names["kind"].(string)
+			defined[group+"/"+kind] = true
+		}
+	}
+
+	lookahead := minorVersion(server, compatibilityLookahead)
+	var findings []compatibilityFinding
+	seen := map[string]bool{}
+	for _, res := range resources {
+		apiVersion, _ := res.Object["apiVersion"].(string)
+		if apiVersion == "" {
+			continue
+		}
+		object := res.Kind + " " + res.Name
+		if res.Namespace != "" {
+			object = res.Kind + " " + res.Namespace + "/" + res.Name
+		}
+		key := apiVersion + "/" + res.Kind
+
+		dep, deprecated := apiDeprecations[key]
+		if !deprecated {
+			dep, deprecated = apiDeprecations[apiVersion]
+		}
+		switch {
+		case deprecated && compareVersions(server, dep.Removed) >= 0:
+			findings = append(findings, compatibilityFinding{Severity: "error", Object: object, APIVersion: apiVersion,
+				Message: fmt.Sprintf("removed in Kubernetes %s, use %s", dep.Removed, dep.Replacement)})
+			continue
+		case deprecated && compareVersions(lookahead, dep.Removed) >= 0:
+			findings = append(findings, compatibilityFinding{Severity: "warning", Object: object, APIVersion: apiVersion,
+				Message: fmt.Sprintf("deprecated since Kubernetes %s and removed in %s, use %s", dep.Deprecated, dep.Removed, dep.Replacement)})
+		case deprecated && compareVersions(server, dep.Deprecated) >= 0:
+			findings = append(findings, compatibilityFinding{Severity: "warning", Object: object, APIVersion: apiVersion,
+				Message: fmt.Sprintf("deprecated since Kubernetes %s, use %s", dep.Deprecated, dep.Replacement)})
+		}
+
+		if served == nil || served[key] || seen[key] {
+			continue
+		}
+		group, _, _ := strings.Cut(apiVersion, "/")
+		if !strings.Contains(apiVersion, "/") {
+			group = ""
+		}
+		switch {
+		case defined[group+"/"+res.Kind]:
+		case group == "" || !strings.Contains(group, ".") || strings.HasSuffix(group, ".k8s.io"):
+			findings = append(findings, compatibilityFinding{Severity: "error", Object: object, APIVersion: apiVersion,
+				Message: fmt.Sprintf("Kubernetes %s does not serve %s %s", server, apiVersion, res.Kind)})
+		default:
+			findings = append(findings, compatibilityFinding{Severity: "warning", Object: object, APIVersion: apiVersion,
+				Message: fmt.Sprintf("the cluster does not serve %s %s; its CRD must be installed first", apiVersion, res.Kind)})
+		}
+		seen[key] = true
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Severity < findings[j].Severity })
+	return findings
+}
+
+// minorVersion returns the version ahead minor releases after version, e.g. 1.31
+// for 1.29.2 and 2.
+func minorVersion(version string, ahead int) string {
+	var major, minor int
+	fmt.Sscanf(version, "%d.%d", &major, &minor)
+	return fmt.Sprintf("%d.%d", major, minor+ahead)
+}
+
+// kubeVersionSatisfies evaluates a Chart.yaml kubeVersion constraint, the subset of
+// semver ranges charts use: comparisons (">=1.21.0-0", "<1.30"), "~" and "^" ranges,
+// separated by spaces or commas to require all, and "||" for alternatives.
+// Pre-release suffixes are ignored on both sides.
+func kubeVersionSatisfies(version, constraint string) (bool, error) {
+	for _, alternative := range strings.Split(constraint, "||") {
+		ok := true
+		terms := strings.Fields(strings.ReplaceAll(alternative, ",", " "))
+		if len(terms) == 0 {
+			return false, fmt.Errorf("empty constraint")
+		}
+		for i := 0; i < len(terms); i++ {
+			term := terms[i]
+			// Allow a space between the operator and the version (">= 1.21").
+			if strings.TrimLeft(term, "<>=!~^") == "" && i+1 < len(terms) {
+				term += terms[i+1]
+				i++
+			}
+			satisfied, err := versionSatisfies(version, term)
+			if err != nil {
+				return false, err
+			}
+			ok = ok && satisfied
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// versionSatisfies evaluates a single comparison of kubeVersionSatisfies.
+func versionSatisfies(version, term string) (bool, error) {
+	op := term[:len(term)-len(strings.TrimLeft(term, "<>=!~^"))]
+	target, _, _ := strings.Cut(strings.TrimPrefix(term[len(op):], "v"), "-")
+	if target == "" || strings.TrimLeft(target, "0123456789.") != "" {
+		return false, fmt.Errorf("unsupported version %q", term)
+	}
+	cmp := compareVersions(version, target)
+	switch op {
+	case "", "=", "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=", "=>":
+		return cmp >= 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=", "=<":
+		return cmp <= 0, nil
+	case "~", "~>":
+		// ~1.21.3 allows 1.21.x from 1.21.3.
+		var major, minor int
+		fmt.Sscanf(target, "%d.%d", &major, &minor)
+		return cmp >= 0 && compareVersions(version, fmt.Sprintf("%d.%d", major, minor+1)) < 0, nil
+	case "^":
+		var major int
+		fmt.Sscanf(target, "%d", &major)
+		return cmp >= 0 && compareVersions(version, fmt.Sprintf("%d", major+1)) < 0, nil
+	}
+	return false, fmt.Errorf("unsupported operator in %q", term)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckRenderedAPIs(t *testing.T) {
+	object := func(apiVersion, kind, name string) k8sResource {
+		return k8sResource{Kind: kind, Name: name, Namespace: "sock-shop",
+			Object: map[string]interface{}{"apiVersion": apiVersion, "kind": kind}}
+	}
+	crd := k8sResource{Kind: "CustomResourceDefinition", Name: "widgets.example.com", Object: map[string]interface{}{
+		"apiVersion": "apiextensions.k8s.io/v1",
+		"spec":       map[string]interface{}{"group": "example.com", "names": map[string]interface{}{"kind": "Widget"}},
+	}}
+	// Discovery on 1.29 serves autoscaling/v1 and v2 and flowcontrol v1 and v1beta3,
+	// whatever the preferred versions are.
+	served := map[string]bool{
+		"v1/Service": true, "apps/v1/Deployment": true,
+		"autoscaling/v1/HorizontalPodAutoscaler": true, "autoscaling/v2/HorizontalPodAutoscaler": true,
+		"flowcontrol.apiserver.k8s.io/v1/FlowSchema": true, "flowcontrol.apiserver.k8s.io/v1beta3/FlowSchema": true,
+		"apiextensions.k8s.io/v1/CustomResourceDefinition": true,
+	}
+
+	tests := []struct {
+		name      string
+		resources []k8sResource
+		served    map[string]bool
+		want      []compatibilityFinding
+	}{
+		{
+			name: "served",
+			resources: []k8sResource{object("v1", "Service", "web"), object("apps/v1", "Deployment", "web"),
+				object("autoscaling/v1", "HorizontalPodAutoscaler", "web")},
+			served: served,
+		},
+		{
+			name:      "deprecated and served",
+			resources: []k8sResource{object("flowcontrol.apiserver.k8s.io/v1beta3", "FlowSchema", "web")},
+			served:    served,
+			want: []compatibilityFinding{{Severity: "warning", Object: "FlowSchema sock-shop/web",
+				APIVersion: "flowcontrol.apiserver.k8s.io/v1beta3",
+				Message:    "deprecated since Kubernetes 1.29, use flowcontrol.apiserver.k8s.io/v1"}},
+		},
+		{
+			name:      "removed",
+			resources: []k8sResource{object("policy/v1beta1", "PodDisruptionBudget", "web")},
+			served:    served,
+			want: []compatibilityFinding{
+				{Severity: "error", Object: "PodDisruptionBudget sock-shop/web", APIVersion: "policy/v1beta1",
+					Message: "removed in Kubernetes 1.25, use policy/v1"},
+			},
+		},
+		{
+			name:      "not served",
+			resources: []k8sResource{object("autoscaling/v2", "Scale", "web"), object("autoscaling/v2", "Scale", "api")},
+			served:    served,
+			want: []compatibilityFinding{{Severity: "error", Object: "Scale sock-shop/web", APIVersion: "autoscaling/v2",
+				Message: "Kubernetes 1.29.2 does not serve autoscaling/v2 Scale"}},
+		},
+		{
+			name:      "custom resources",
+			resources: []k8sResource{crd, object("example.com/v1", "Widget", "w"), object("litmuschaos.io/v1alpha1", "ChaosEngine", "e")},
+			served:    served,
+			want: []compatibilityFinding{{Severity: "warning", Object: "ChaosEngine sock-shop/e", APIVersion: "litmuschaos.io/v1alpha1",
+				Message: "the cluster does not serve litmuschaos.io/v1alpha1 ChaosEngine; its CRD must be installed first"}},
+		},
+		{
+			name:      "discovery unavailable",
+			resources: []k8sResource{object("autoscaling/v2", "Scale", "web")},
+		},
+	}
+	for _, tt := range tests {
+		if got := checkRenderedAPIs(tt.resources, "1.29.2", tt.served); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
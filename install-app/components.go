@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// componentsFile is the file inside a chart defining its component groups and the
+// dependencies between them.
+const componentsFile = "components.yaml"
+
+// chartComponents is the content of a chart's components.yaml.
+type chartComponents struct {
+	Components   map[string]componentGroup `json:"components"`
+	Dependencies []componentDependency     `json:"dependencies"`
+}
+
+// componentGroup is a group selectable with -components and -skip.
+type componentGroup struct {
+	Description string   `json:"description"`
+	Toggles     []string `json:"toggles"`
+}
+
+// componentDependency requires one of Requires to be set whenever When is enabled.
+type componentDependency struct {
+	When     string   `json:"when"`
+	Requires []string `json:"requires"`
+	Message  string   `json:"message"`
+}
+
+// loadComponents reads a chart's components.yaml; it returns nil if the chart has none.
+func loadComponents(chartPath string) (*chartComponents, error) {
+	data, err := readChartFile(chartPath, componentsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var components chartComponents
+	if err := decodeYAMLInto(data, &components); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", componentsFile, err)
+	}
+	return &components, nil
+}
+
+// resolveComponents turns -components and -skip into value toggles. -components
+// enables the listed groups and disables the others; -skip disables groups and leaves
+// the rest at their defaults. The toggles are layered over the profile and under the
+// values files and -set flags, which can still override single toggles.
+func resolveComponents(config *Config) (func(), error) {
+	selected := annotationList(strings.Join(config.Components, ","))
+	skipped := annotationList(strings.Join(config.Skip, ","))
+	if len(selected) == 0 && len(skipped) == 0 {
+		return func() {}, nil
+	}
+
+	components, err := loadComponents(config.chartPath())
+	if err != nil {
+		return nil, err
+	}
+	if components == nil || len(components.Components) == 0 {
+		return nil, fmt.Errorf("-components and -skip need the chart to define component groups in %s", componentsFile)
+	}
+	names := make([]string, 0, len(components.Components))
+	for name := range components.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range append(append([]string{}, selected...), skipped...) {
+		if _, ok := components.Components[name]; !ok {
+			return nil, fmt.Errorf("unknown component %s (available: %s)", name, strings.Join(names, ", "))
+		}
+	}
+
+	enabled := map[string]bool{}
+	for _, name := range names {
+		enabled[name] = len(selected) == 0
+	}
+	for _, name := range selected {
+		enabled[name] = true
+	}
+	for _, name := range skipped {
+		if enabled[name] && len(selected) > 0 {
+			return nil, fmt.Errorf("component %s is both selected with -components and skipped with -skip", name)
+		}
+		enabled[name] = false
+	}
+
+	overrides := map[string]interface{}{}
+	var installed, left []string
+	for _, name := range names {
+		// With only -skip, groups that aren't skipped keep the chart's defaults.
+		if len(selected) == 0 && enabled[name] {
+			continue
+		}
+		for _, toggle := range components.Components[name].Toggles {
+			if err := parseSetValues(overrides, fmt.Sprintf("%s=%t", toggle, enabled[name]), setTyped); err != nil {
+				return nil, fmt.Errorf("invalid toggle %s of component %s: %w", toggle, name, err)
+			}
+		}
+		if enabled[name] {
+			installed = append(installed, name)
+		} else {
+			left = append(left, name)
+		}
+	}
+	if len(installed) > 0 {
+		log.Printf("Installing components: %s", strings.Join(installed, ", "))
+	}
+	log.Printf("Skipping components: %s", strings.Join(left, ", "))
+
+	path, err := writeTempValues("install-app-components-*.yaml", overrides)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write component values: %w", err)
+	}
+	config.componentsValuesFile = path
+	return func() { os.Remove(path) }, nil
+}
+
+// checkComponentDependencies reports the dependencies of the chart's components.yaml
+// that the values don't satisfy.
+func checkComponentDependencies(chartPath string, values map[string]interface{}) ([]schemaProblem, error) {
+	components, err := loadComponents(chartPath)
+	if err != nil || components == nil {
+		return nil, err
+	}
+
+	var problems []schemaProblem
+	for _, dep := range components.Dependencies {
+		if when, _ := lookupValue(values, dep.When); !truthy(when) {
+			continue
+		}
+		satisfied := false
+		for _, path := range dep.Requires {
+			if v, _ := lookupValue(values, path); truthy(v) {
+				satisfied = true
+				break
+			}
+		}
+		if !satisfied {
+			message := dep.Message
+			if message == "" {
+				message = "requires one of " + strings.Join(dep.Requires, ", ")
+			}
+			problems = append(problems, schemaProblem{Path: "$." + dep.When, Message: message})
+		}
+	}
+	return problems, nil
+}
+
+// truthy reports whether a value counts as set the way Helm templates' `if` does.
+func truthy(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	}
+	n, ok := jsonNumber(v)
+	return !ok || n != 0
+}
+
+// writeTempValues writes values to a temporary values file for helm -f.
+func writeTempValues(pattern string, values map[string]interface{}) (string, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(marshalYAML(values)); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
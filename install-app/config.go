@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is prepended to the upper-cased flag name (dashes become underscores)
+// to form the environment variable equivalent of every install flag, e.g.
+// -charts-path -> INSTALL_APP_CHARTS_PATH.
+const envPrefix = "INSTALL_APP_"
+
+// listFlags implements flag.Value for repeatable flags that collect a list.
+type listFlags []string
+
+func (l *listFlags) String() string { return strings.Join(*l, ",") }
+func (l *listFlags) Set(val string) error {
+	*l = append(*l, val)
+	return nil
+}
+
+// envName returns the environment variable equivalent of a flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// loadConfig resolves the install configuration. Every field can come from a flag,
+// an INSTALL_APP_* environment variable or the YAML file named by -config, with
+// flags taking precedence over the environment, the environment over the file, and
+// the file over the flag defaults.
+func loadConfig(args []string, errorHandling flag.ErrorHandling) (*Config, error) {
+	config := &Config{}
+	flags := newInstallFlagSet(config, errorHandling)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	explicit := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	fromFlags := *config
+
+	if config.ConfigFile == "" {
+		config.ConfigFile = os.Getenv(envName("config"))
+	}
+	if config.ConfigFile != "" {
+		if err := applyConfigFile(config, config.ConfigFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(config); err != nil {
+		return nil, err
+	}
+
+	// Flags given on the command line win over everything else.
+	current, saved := reflect.ValueOf(config).Elem(), reflect.ValueOf(&fromFlags).Elem()
+	for i := 0; i < current.NumField(); i++ {
+		if name := current.Type().Field(i).Tag.Get("flag"); explicit[name] {
+			current.Field(i).Set(saved.Field(i))
+		}
+	}
+
+	if len(config.ImagePullSecrets) == 0 {
+		config.ImagePullSecrets = listFlags{defaultImagePullSecret}
+	}
+
+	// Default release name to folder (or remote chart) name if not specified, with
+	// the instance id appended so instances are separate releases
+	if config.ReleaseName == "" {
+		config.ReleaseName = config.FolderName
+		if config.isRemoteChart() {
+			config.ReleaseName = remoteChartName(config.Chart)
+		}
+		if config.Instance != "" {
+			config.ReleaseName += "-" + config.Instance
+		}
+	}
+
+	return config, nil
+}
+
+// applyConfigFile overlays the YAML config file onto config. Keys are the json tags
+// of the Config fields; unknown keys are rejected so typos don't go unnoticed.
+func applyConfigFile(config *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	doc, err := parseYAML(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if doc == nil {
+		return nil
+	}
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return fmt.Errorf("config file %s must contain a mapping", path)
+	}
+
+	encoded, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(config); err != nil {
+		return fmt.Errorf("invalid config file %s: %w (quote values such as versions that look like numbers)", path, err)
+	}
+	return nil
+}
+
+// applyEnv overlays the INSTALL_APP_* environment variables onto config.
+func applyEnv(config *Config) error {
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Tag.Get("flag")
+		if name == "" || name == "config" {
+			continue
+		}
+		raw, ok := os.LookupEnv(envName(name))
+		if !ok {
+			continue
+		}
+		if err := setFieldFromString(v.Field(i), raw); err != nil {
+			return fmt.Errorf("invalid %s: %w", envName(name), err)
+		}
+	}
+	return nil
+}
+
+// setFieldFromString parses an environment variable into a Config field. Lists are
+// either a JSON array or a comma-separated string, except the --set style lists: a
+// plain string is one expression, since helm splits it on commas itself and a comma
+// can be part of a value ("list={a,b}").
+func setFieldFromString(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Slice:
+		var items []string
+		if strings.HasPrefix(strings.TrimSpace(raw), "[") {
+			if err := json.Unmarshal([]byte(raw), &items); err != nil {
+				return err
+			}
+		} else if field.Type() == reflect.TypeOf(setFlags(nil)) {
+			if raw != "" {
+				items = []string{raw}
+			}
+		} else if raw != "" {
+			for _, item := range strings.Split(raw, ",") {
+				items = append(items, strings.TrimSpace(item))
+			}
+		}
+		list := reflect.MakeSlice(field.Type(), len(items), len(items))
+		for i, item := range items {
+			list.Index(i).SetString(item)
+		}
+		field.Set(list)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// runConfigCommand implements `install-app config print [install flags]`, which
+// prints the configuration an install with the same flags, environment and config
+// file would use.
+func runConfigCommand(args []string) error {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintf(os.Stderr, "Usage: install-app config print [install options]\n")
+		return fmt.Errorf("unknown config command")
+	}
+
+	config, err := loadConfig(args[1:], flag.ContinueOnError)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	resolved, err := decodeJSONValue(encoded)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(marshalYAML(resolved))
+	return err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	t.Setenv(envName("set"), "a=1,list={x,y}")
+	t.Setenv(envName("set-string"), `["b=x\\,y","c=z"]`)
+	t.Setenv(envName("services"), "catalogue, front-end")
+	t.Setenv(envName("values"), `["a.yaml","b.yaml"]`)
+	t.Setenv(envName("dry-run"), "true")
+
+	config := &Config{}
+	if err := applyEnv(config); err != nil {
+		t.Fatal(err)
+	}
+	if want := (setFlags{"a=1,list={x,y}"}); !reflect.DeepEqual(config.SetValues, want) {
+		t.Errorf("set: got %q, want %q", config.SetValues, want)
+	}
+	if want := (setFlags{`b=x\,y`, "c=z"}); !reflect.DeepEqual(config.SetStringValues, want) {
+		t.Errorf("set-string: got %q, want %q", config.SetStringValues, want)
+	}
+	if want := (listFlags{"catalogue", "front-end"}); !reflect.DeepEqual(config.Services, want) {
+		t.Errorf("services: got %q, want %q", config.Services, want)
+	}
+	if want := (listFlags{"a.yaml", "b.yaml"}); !reflect.DeepEqual(config.ValuesFiles, want) {
+		t.Errorf("values: got %q, want %q", config.ValuesFiles, want)
+	}
+	if !config.DryRun {
+		t.Error("dry-run: not set")
+	}
+
+	config.ValuesFiles = nil
+	values, err := userValues(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"a": int64(1), "list": []interface{}{"x", "y"}, "b": "x,y", "c": "z"}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("values: got %#v, want %#v", values, want)
+	}
+}
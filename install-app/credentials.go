@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"os/exec"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	// credentialsFile is the file inside a chart listing the credentials install-app
+	// generates for it instead of the chart's defaults.
+	credentialsFile = "credentials.yaml"
+
+	// credentialsAnnotation on the credentials Secret describes its keys, as JSON.
+	credentialsAnnotation = "install-app/credentials"
+
+	// credentialLength is the length of generated passwords.
+	credentialLength = 24
+
+	// credentialAlphabet keeps generated passwords safe in environment variables,
+	// connection strings and --set expressions.
+	credentialAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// credential is an entry of a chart's credentials.yaml.
+type credential struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Username is the fixed user of the credential, or UsernameValue the value
+	// holding it.
+	Username      string `json:"username"`
+	UsernameValue string `json:"usernameValue"`
+	// Value is the value the password is passed to the chart in.
+	Value string `json:"value"`
+	// When names the value that makes the chart use the credential.
+	When   string `json:"when"`
+	Length int    `json:"length"`
+}
+
+// credentialResult reports a credential of the install, without its password.
+type credentialResult struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Value       string `json:"value"`
+	// Source is "generated", "reused" from the credentials Secret, or "values" when
+	// the user set the password.
+	Source string `json:"source,omitempty"`
+}
+
+// storedCredential is a credential with its password, as the credentials command
+// prints it.
+type storedCredential struct {
+	credentialResult
+	Password string `json:"password"`
+}
+
+// credentialsSecretName returns the Secret the credentials of a release are kept in.
+// It isn't part of the release, so it survives helm uninstall and a reinstall finds
+// the passwords the data was initialized with.
+func credentialsSecretName(release string) string {
+	return release + "-credentials"
+}
+
+// loadCredentials reads a chart's credentials.yaml; it returns nil if the chart has
+// none.
+func loadCredentials(chartPath string) ([]credential, error) {
+	data, err := readChartFile(chartPath, credentialsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Credentials []credential `json:"credentials"`
+	}
+	if err := decodeYAMLInto(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", credentialsFile, err)
+	}
+	for _, c := range file.Credentials {
+		if c.Name == "" || c.Value == "" {
+			return nil, fmt.Errorf("invalid %s: credentials need a name and a value", credentialsFile)
+		}
+	}
+	return file.Credentials, nil
+}
+
+// resolveCredentials sets the passwords of the chart's credentials.yaml: the one the
+// user passed in the values, else the one kept in the release's credentials Secret by
+// an earlier install, else a new random one. They are passed to the chart as values
+// layered under the user's values, and stored by storeCredentials once the namespace
+// exists. The values stay in memory: helmCommand hands them to helm on a pipe, so the
+// passwords are never written to disk.
+func resolveCredentials(config *Config) error {
+	credentials, err := loadCredentials(config.chartPath())
+	if err != nil || len(credentials) == 0 {
+		return err
+	}
+	values, err := computeValues(config)
+	if err != nil {
+		return err
+	}
+	user, err := userValues(config)
+	if err != nil {
+		return err
+	}
+
+	existing, _, err := readCredentialsSecret(config, config.ReleaseName, config.Namespace)
+	if err != nil {
+		if !config.DryRun {
+			return fmt.Errorf("failed to read the stored credentials: %w", err)
+		}
+		log.Printf("Warning: can't read the stored credentials, generating new ones for the dry run: %v", err)
+	}
+
+	overrides := map[string]interface{}{}
+	for _, c := range credentials {
+		if c.When != "" {
+			if when, _ := lookupValue(values, c.When); !truthy(when) {
+				continue
+			}
+		}
+		stored := storedCredential{credentialResult: credentialResult{Name: c.Name, Description: c.Description,
+			Username: c.Username, Value: c.Value}}
+		if c.UsernameValue != "" {
+			if username, _ := lookupValue(values, c.UsernameValue); username != nil {
+				stored.Username = scalarString(username)
+			}
+		}
+
+		if v, _ := lookupValue(user, c.Value); v != nil && scalarString(v) != "" {
+			stored.Password, stored.Source = scalarString(v), "values"
+		} else if password, ok := existing[c.Name]; ok {
+			stored.Password, stored.Source = password, "reused"
+		} else {
+			length := c.Length
+			if length <= 0 {
+				length = credentialLength
+			}
+			if stored.Password, err = generatePassword(length); err != nil {
+				return err
+			}
+			stored.Source = "generated"
+		}
+		if stored.Source != "values" {
+			path := []interface{}{}
+			for _, key := range strings.Split(c.Value, ".") {
+				path = append(path, key)
+			}
+			if err := setValuePath(overrides, path, stored.Password); err != nil {
+				return fmt.Errorf("invalid value %s of credential %s: %w", c.Value, c.Name, err)
+			}
+		}
+		log.Printf("Credential %s: %s", c.Name, stored.Source)
+		config.credentials = append(config.credentials, stored)
+		config.result.Credentials = append(config.result.Credentials, stored.credentialResult)
+	}
+	if len(overrides) > 0 {
+		config.credentialValues = marshalYAML(overrides)
+	}
+	return nil
+}
+
+// generatePassword returns a random password of length characters.
+func generatePassword(length int) (string, error) {
+	size := big.NewInt(int64(len(credentialAlphabet)))
+	password := make([]byte, length)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate a password: %w", err)
+		}
+		password[i] = credentialAlphabet[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// readCredentialsSecret returns the passwords of a release's credentials Secret by
+// name, and the credentials its annotation describes. A missing Secret is no error.
+func readCredentialsSecret(config *Config, release, namespace string) (map[string]string, []credentialResult, error) {
+	out, err := exec.Command("kubectl", kubectlArgs(config, "get", "secret", credentialsSecretName(release),
+		"-n", namespace, "-o", "json")...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && bytes.Contains(exitErr.Stderr, []byte("NotFound")) {
+			return map[string]string{}, nil, nil
+		}
+		return nil, nil, fmt.Errorf("kubectl get secret %s: %w", credentialsSecretName(release), err)
+	}
+	var secret struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Data map[string]string `json:"data"`
+	}
+	if err := json.Unmarshal(out, &secret); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse secret %s: %w", credentialsSecretName(release), err)
+	}
+	passwords := map[string]string{}
+	for name, encoded := range secret.Data {
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid key %s of secret %s: %w", name, credentialsSecretName(release), err)
+		}
+		passwords[name] = string(decoded)
+	}
+	var described []credentialResult
+	if annotation := secret.Metadata.Annotations[credentialsAnnotation]; annotation != "" {
+		if err := json.Unmarshal([]byte(annotation), &described); err != nil {
+			return nil, nil, fmt.Errorf("invalid %s annotation of secret %s: %w", credentialsAnnotation,
+				credentialsSecretName(release), err)
+		}
+	}
+	return passwords, described, nil
+}
+
+// storeCredentials writes the resolved credentials to the release's credentials
+// Secret before helm runs, so a failed install doesn't lose passwords the data may
+// already have been initialized with.
+func storeCredentials(config *Config) error {
+	if len(config.credentials) == 0 {
+		return nil
+	}
+	name := credentialsSecretName(config.ReleaseName)
+	if config.DryRun {
+		log.Printf("Dry run: not storing credentials in secret %s/%s", config.Namespace, name)
+		return nil
+	}
+
+	described := make([]credentialResult, 0, len(config.credentials))
+	stringData := map[string]string{}
+	for _, c := range config.credentials {
+		described = append(described, credentialResult{Name: c.Name, Description: c.Description,
+			Username: c.Username, Value: c.Value})
+		stringData[c.Name] = c.Password
+	}
+	annotation, err := json.Marshal(described)
+	if err != nil {
+		return err
+	}
+	secret := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Secret",
+		"metadata": map[string]interface{}{
+			"name":      name,
+			"namespace": config.Namespace,
+			"labels": map[string]string{
+				"app.kubernetes.io/managed-by": "install-app",
+				"app.kubernetes.io/instance":   config.ReleaseName,
+			},
+			"annotations": map[string]string{credentialsAnnotation: string(annotation)},
+		},
+		"type":       "Opaque",
+		"stringData": stringData,
+	}
+	manifest, err := json.Marshal(secret)
+	if err != nil {
+		return err
+	}
+
+	// The manifest goes through stdin so the passwords don't show up in process lists.
+	cmd := exec.Command("kubectl", kubectlArgs(config, "apply", "-f", "-")...)
+	cmd.Stdin = bytes.NewReader(manifest)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to store credentials in secret %s/%s: %w: %s", config.Namespace, name, err,
+			strings.TrimSpace(string(out)))
+	}
+	log.Printf("Stored credentials in secret %s/%s; print them with: install-app credentials %s -namespace %s",
+		config.Namespace, name, config.ReleaseName, config.Namespace)
+	return nil
+}
+
+// runCredentials prints the credentials of an installed release.
+func runCredentials(args []string) error {
+	var namespace, output, kubeConfig, kubeContext string
+
+	flags := flag.NewFlagSet("credentials", flag.ExitOnError)
+	flags.StringVar(&namespace, "namespace", "", "Namespace of the release (defaults to the namespace helm reports)")
+	flags.StringVar(&output, "output", "text", "Output format: text, env for shell export statements, or json")
+	flags.StringVar(&kubeConfig, "kubeconfig", "", "Path to kubeconfig file")
+	flags.StringVar(&kubeContext, "context", "", "Kubernetes context to use")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: install-app credentials <release> [options]\n\n")
+		flags.PrintDefaults()
+	}
+
+	// Accept the release name before or after the flags.
+	var release string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		release, args = args[0], args[1:]
+	}
+	flags.Parse(args)
+	if release == "" {
+		release = flags.Arg(0)
+	}
+	if release == "" {
+		flags.Usage()
+		return fmt.Errorf("release name is required")
+	}
+	if output != "text" && output != "env" && output != "json" {
+		return fmt.Errorf("invalid -output %q: must be text, env or json", output)
+	}
+
+	if namespace == "" {
+		status, err := getReleaseStatus(release, "", kubeConfig, kubeContext)
+		if err != nil {
+			return fmt.Errorf("%w; pass -namespace to read the credentials of an uninstalled release", err)
+		}
+		namespace = status.Namespace
+	}
+	config := &Config{KubeConfig: kubeConfig, KubeContext: kubeContext}
+	passwords, described, err := readCredentialsSecret(config, release, namespace)
+	if err != nil {
+		return err
+	}
+	if len(passwords) == 0 {
+		return fmt.Errorf("release %s has no stored credentials in namespace %s", release, namespace)
+	}
+
+	// Keys without a description are credentials the chart no longer uses.
+	var credentials []storedCredential
+	for _, d := range described {
+		if password, ok := passwords[d.Name]; ok {
+			credentials = append(credentials, storedCredential{credentialResult: d, Password: password})
+		}
+	}
+
+	switch output {
+	case "json":
+		return printJSON(credentials)
+	case "env":
+		for _, c := range credentials {
+			name := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(c.Name))
+			if c.Username != "" {
+				fmt.Printf("export %s_USERNAME=%s\n", strings.TrimSuffix(name, "_PASSWORD"), shellQuote(c.Username))
+			}
+			fmt.Printf("export %s=%s\n", name, shellQuote(c.Password))
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tUSERNAME\tPASSWORD\tDESCRIPTION")
+	for _, c := range credentials {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Name, c.Username, c.Password, c.Description)
+	}
+	return w.Flush()
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
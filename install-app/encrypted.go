@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// ageArmorHeader and ageBinaryHeader start age-encrypted files, armored with
+	// age -a or binary.
+	ageArmorHeader  = "-----BEGIN AGE ENCRYPTED FILE-----"
+	ageBinaryHeader = "age-encryption.org/v1"
+
+	// helmFirstValuesFD is the descriptor of the first values document piped to the
+	// helm process, after stdin, stdout and stderr: the credentials, then the
+	// decrypted values files.
+	helmFirstValuesFD = 3
+)
+
+// valuesEncryption returns how a values file is encrypted: "age", "sops" for SOPS
+// YAML with age recipients, or "" for a plain file.
+func valuesEncryption(data []byte) string {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte(ageArmorHeader)) || bytes.HasPrefix(trimmed, []byte(ageBinaryHeader)) {
+		return "age"
+	}
+	// SOPS keeps its metadata under a top-level sops key next to the encrypted values.
+	doc, err := parseYAML(data)
+	if err != nil {
+		return ""
+	}
+	if m, ok := doc.(map[string]interface{}); ok {
+		if metadata, ok := m["sops"].(map[string]interface{}); ok && metadata["mac"] != nil {
+			return "sops"
+		}
+	}
+	return ""
+}
+
+// decryptValuesFiles decrypts the encrypted -values files with the age and sops
+// commands. The plaintext stays in memory: userValues reads it from config, and
+// helmCommand hands it to helm through pipes.
+func decryptValuesFiles(config *Config) error {
+	var identity []byte
+	for _, path := range config.ValuesFiles {
+		if _, done := config.decryptedValues[path]; done {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read values file: %w", err)
+		}
+		format := valuesEncryption(data)
+		if format == "" {
+			continue
+		}
+		if identity == nil {
+			if identity, err = ageIdentity(config); err != nil {
+				return fmt.Errorf("values file %s is %s-encrypted: %w", path, format, err)
+			}
+		}
+
+		var cmd *exec.Cmd
+		if format == "age" {
+			// The identity goes through stdin, so it is never written to disk or
+			// visible in the process list.
+			cmd = exec.Command("age", "--decrypt", "-i", "-", path)
+			cmd.Stdin = bytes.NewReader(identity)
+		} else {
+			cmd = exec.Command("sops", "--decrypt", "--input-type", "yaml", "--output-type", "yaml", path)
+			cmd.Env = append(os.Environ(), "SOPS_AGE_KEY="+string(identity))
+		}
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		plaintext, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("failed to decrypt values file %s with %s: %w: %s", path, cmd.Path, err,
+				strings.TrimSpace(stderr.String()))
+		}
+		if _, err := readValuesFile(path, plaintext); err != nil {
+			return fmt.Errorf("decrypted values file %s: %w", path, err)
+		}
+		if config.decryptedValues == nil {
+			config.decryptedValues = map[string][]byte{}
+		}
+		config.decryptedValues[path] = plaintext
+		log.Printf("Decrypted %s values file %s", format, path)
+	}
+
+	if len(config.decryptedValues) > 0 && config.ValuesOutput != "" {
+		log.Printf("Warning: -values-output writes the decrypted values in plain text to %s", config.ValuesOutput)
+	}
+	return nil
+}
+
+// ageIdentity returns the age identity to decrypt with: the -age-key-file, the key in
+// INSTALL_APP_AGE_KEY or SOPS_AGE_KEY, the file in SOPS_AGE_KEY_FILE, or sops' default
+// keys file, in that order.
+func ageIdentity(config *Config) ([]byte, error) {
+	if config.AgeKeyFile != "" {
+		return readAgeKeyFile(config.AgeKeyFile)
+	}
+	for _, name := range []string{envName("age-key"), "SOPS_AGE_KEY"} {
+		if key := os.Getenv(name); strings.TrimSpace(key) != "" {
+			return []byte(key), nil
+		}
+	}
+	if path := os.Getenv("SOPS_AGE_KEY_FILE"); path != "" {
+		return readAgeKeyFile(path)
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		path := filepath.Join(dir, "sops", "age", "keys.txt")
+		if _, err := os.Stat(path); err == nil {
+			return readAgeKeyFile(path)
+		}
+	}
+	return nil, fmt.Errorf("no age key: use -age-key-file, or set %s or SOPS_AGE_KEY", envName("age-key"))
+}
+
+func readAgeKeyFile(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read age key: %w", err)
+	}
+	return key, nil
+}
+
+// readUserValuesFile returns the content of a values file, decrypted if it is one of
+// the encrypted -values files, or the credentials for credentialValuesArg.
+func readUserValuesFile(config *Config, path string) ([]byte, error) {
+	if path == credentialValuesArg() && config.credentialValues != nil {
+		return config.credentialValues, nil
+	}
+	if plaintext, ok := config.decryptedValues[path]; ok {
+		return plaintext, nil
+	}
+	return os.ReadFile(path)
+}
+
+// credentialValuesArg returns the helm argument for the credential values, the
+// descriptor helmCommand passes them on.
+func credentialValuesArg() string {
+	return fmt.Sprintf("/dev/fd/%d", helmFirstValuesFD)
+}
+
+// valuesFileArg returns the helm argument for the i-th -values file: its path, or for
+// an encrypted file the descriptor helmCommand passes it on.
+func valuesFileArg(config *Config, i int) string {
+	if _, ok := config.decryptedValues[config.ValuesFiles[i]]; !ok {
+		return config.ValuesFiles[i]
+	}
+	fd := helmFirstValuesFD
+	if config.credentialValues != nil {
+		fd++
+	}
+	for _, path := range config.ValuesFiles[:i] {
+		if _, ok := config.decryptedValues[path]; ok {
+			fd++
+		}
+	}
+	return fmt.Sprintf("/dev/fd/%d", fd)
+}
+
+// helmCommand returns a helm command that gets the credential values and each
+// decrypted values file on a pipe, at the descriptors credentialValuesArg and
+// valuesFileArg name. The returned function closes the pipes once the command has
+// finished.
+func helmCommand(config *Config, args ...string) (*exec.Cmd, func(), error) {
+	cmd := exec.Command("helm", args...)
+	closePipes := func() {
+		for _, r := range cmd.ExtraFiles {
+			r.Close()
+		}
+	}
+	var piped [][]byte
+	if config.credentialValues != nil {
+		piped = append(piped, config.credentialValues)
+	}
+	for _, path := range config.ValuesFiles {
+		if plaintext, ok := config.decryptedValues[path]; ok {
+			piped = append(piped, plaintext)
+		}
+	}
+	for _, plaintext := range piped {
+		plaintext := plaintext
+		r, w, err := os.Pipe()
+		if err != nil {
+			closePipes()
+			return nil, nil, fmt.Errorf("failed to pass values to helm: %w", err)
+		}
+		cmd.ExtraFiles = append(cmd.ExtraFiles, r)
+		// Writing fails once closePipes runs if helm exited without reading.
+		go func() {
+			w.Write(plaintext)
+			w.Close()
+		}()
+	}
+	return cmd, closePipes, nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// fitHeadroom is the share of the free capacity -fit-to-cluster aims for, leaving
+	// room for pods the scheduler can't pack perfectly.
+	fitHeadroom = 0.9
+
+	// fitMinScale is the smallest factor -fit-to-cluster scales requests by; below it
+	// the services would hardly start.
+	fitMinScale = 0.2
+
+	// fitStep is how much the factor shrinks while the pods don't pack onto the nodes.
+	fitStep = 0.9
+
+	// fitMinHeap is the smallest Java heap -fit-to-cluster sets, in bytes.
+	fitMinHeap = 32 << 20
+)
+
+// fitResult records what -fit-to-cluster changed.
+type fitResult struct {
+	CPUScale    float64       `json:"cpuScale"`
+	MemoryScale float64       `json:"memoryScale"`
+	Overrides   []fitOverride `json:"overrides,omitempty"`
+}
+
+// fitOverride is a value -fit-to-cluster scaled down.
+type fitOverride struct {
+	Path string `json:"path"`
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// resolveFitToCluster scales the CPU and memory requests in the values, and the heap
+// sizes of the javaOpts values, so that the rendered workloads fit the free capacity
+// of the cluster. Only a resource the cluster is short of is scaled, in proportion,
+// so the services keep their relative sizes. The scaled values are passed with
+// --set-string after the user's own overrides.
+func resolveFitToCluster(config *Config) error {
+	if !config.FitToCluster {
+		return nil
+	}
+
+	resources, err := renderChart(config)
+	if err != nil {
+		return err
+	}
+	workloads := renderedWorkloadRequests(resources)
+	nodes, err := clusterCapacity(config, workloads)
+	if err != nil {
+		return fmt.Errorf("-fit-to-cluster needs the cluster's capacity: %w", err)
+	}
+
+	report := checkCapacity(cloneWorkloads(workloads), cloneNodes(nodes))
+	if len(report.Problems) == 0 {
+		log.Printf("The release fits the cluster (%s CPU and %s memory of %s and %s free), not scaling requests",
+			formatCPU(report.Required.CPU), formatMemory(report.Required.Memory),
+			formatCPU(report.Free.CPU), formatMemory(report.Free.Memory))
+		config.result.Fit = &fitResult{CPUScale: 1, MemoryScale: 1}
+		return nil
+	}
+
+	values, err := computeValues(config)
+	if err != nil {
+		return err
+	}
+	scalable, err := fitScalableWorkloads(config, values, workloads)
+	if err != nil {
+		return err
+	}
+	cpuScale, memoryScale, err := fitScales(workloads, scalable, nodes)
+	if err != nil {
+		return err
+	}
+
+	overrides := scaleValues(values, "", cpuScale, memoryScale)
+	for _, o := range overrides {
+		config.fitOverrides = append(config.fitOverrides, o.Path+"="+escapeSetValue(o.To))
+	}
+	config.result.Fit = &fitResult{CPUScale: roundScale(cpuScale), MemoryScale: roundScale(memoryScale), Overrides: overrides}
+	log.Printf("Scaling requests to fit the cluster: CPU to %.0f%%, memory to %.0f%% (%d values)",
+		cpuScale*100, memoryScale*100, len(overrides))
+	return nil
+}
+
+// fitScalable tells which requests of a workload come from values -fit-to-cluster
+// scales.
+type fitScalable struct {
+	cpu, memory bool
+}
+
+// fitScalableWorkloads renders the chart with every request in the values halved to
+// find the workloads whose requests follow them. Requests written into the
+// templates, or missing from the values, stay as they are.
+func fitScalableWorkloads(config *Config, values map[string]interface{}, workloads []workloadRequests) (map[string]fitScalable, error) {
+	saved := config.fitOverrides
+	defer func() { config.fitOverrides = saved }()
+	for _, o := range scaleValues(values, "", 0.5, 0.5) {
+		config.fitOverrides = append(config.fitOverrides, o.Path+"="+escapeSetValue(o.To))
+	}
+	resources, err := renderChart(config)
+	if err != nil {
+		return nil, err
+	}
+
+	halved := map[string]resourceAmounts{}
+	for _, w := range renderedWorkloadRequests(resources) {
+		halved[workloadKey(w)] = w.PerPod
+	}
+	scalable := map[string]fitScalable{}
+	for _, w := range workloads {
+		if h, ok := halved[workloadKey(w)]; ok {
+			scalable[workloadKey(w)] = fitScalable{cpu: h.CPU < w.PerPod.CPU, memory: h.Memory < w.PerPod.Memory}
+		}
+	}
+	return scalable, nil
+}
+
+func workloadKey(w workloadRequests) string {
+	return w.Namespace + "/" + w.Kind + "/" + w.Name
+}
+
+// fitScales returns the factors for the scalable CPU and memory requests that let
+// the workloads fit the nodes. A resource whose total exceeds the free capacity
+// starts at the factor that brings it within the headroom; then, while some pods
+// don't pack onto the nodes, the resource that keeps them off shrinks further.
+func fitScales(workloads []workloadRequests, scalable map[string]fitScalable, nodes []nodeCapacity) (cpuScale, memoryScale float64, err error) {
+	report := checkCapacity(cloneWorkloads(workloads), cloneNodes(nodes))
+	var fixed, scaled resourceAmounts
+	for _, w := range report.Workloads {
+		if scalable[workloadKey(w)].cpu {
+			scaled.CPU += w.Total.CPU
+		} else {
+			fixed.CPU += w.Total.CPU
+		}
+		if scalable[workloadKey(w)].memory {
+			scaled.Memory += w.Total.Memory
+		} else {
+			fixed.Memory += w.Total.Memory
+		}
+	}
+
+	cpuScale, memoryScale = 1, 1
+	if report.Required.CPU > report.Free.CPU {
+		cpuScale = scaleFor(fixed.CPU, scaled.CPU, report.Free.CPU)
+	}
+	if report.Required.Memory > report.Free.Memory {
+		memoryScale = scaleFor(fixed.Memory, scaled.Memory, report.Free.Memory)
+	}
+	for {
+		if cpuScale < fitMinScale || memoryScale < fitMinScale {
+			return 0, 0, fmt.Errorf("the release does not fit the cluster even with requests scaled to %.0f%%: it requests "+
+				"%s CPU and %s memory, %d schedulable nodes have %s CPU and %s memory free",
+				fitMinScale*100, formatCPU(report.Required.CPU), formatMemory(report.Required.Memory),
+				report.Nodes, formatCPU(report.Free.CPU), formatMemory(report.Free.Memory))
+		}
+		remaining := cloneNodes(nodes)
+		result := checkCapacity(scaleWorkloads(workloads, scalable, cpuScale, memoryScale), remaining)
+		if len(result.Problems) == 0 {
+			return cpuScale, memoryScale, nil
+		}
+		// Shrinking a resource no value sets doesn't help.
+		cpuShort, memoryShort := shortResources(result, remaining)
+		cpuShort, memoryShort = cpuShort && scaled.CPU > 0, memoryShort && scaled.Memory > 0
+		if !cpuShort && !memoryShort {
+			return 0, 0, fmt.Errorf("scaling requests can't make the release fit the cluster:\n  %s",
+				strings.Join(result.Problems, "\n  "))
+		}
+		if cpuShort {
+			cpuScale *= fitStep
+		}
+		if memoryShort {
+			memoryScale *= fitStep
+		}
+	}
+}
+
+// scaleWorkloads returns the workloads with their scalable requests scaled.
+func scaleWorkloads(workloads []workloadRequests, scalable map[string]fitScalable, cpuScale, memoryScale float64) []workloadRequests {
+	scaled := cloneWorkloads(workloads)
+	for i := range scaled {
+		s := scalable[workloadKey(scaled[i])]
+		if s.cpu {
+			scaled[i].PerPod.CPU = int64(float64(scaled[i].PerPod.CPU) * cpuScale)
+		}
+		if s.memory {
+			scaled[i].PerPod.Memory = int64(float64(scaled[i].PerPod.Memory) * memoryScale)
+		}
+		scaled[i].Total = scaled[i].PerPod.times(scaled[i].Pods)
+	}
+	return scaled
+}
+
+// shortResources tells which resources a failed placement is short of: those whose
+// total exceeds the free capacity, and for each pod left over, the resource that
+// alone kept it off a node it may run on, or both if every such node lacks both.
+// nodes are the nodes as checkCapacity left them.
+func shortResources(report *preflightReport, nodes []nodeCapacity) (cpu, memory bool) {
+	cpu = report.Required.CPU > report.Free.CPU
+	memory = report.Required.Memory > report.Free.Memory
+	for _, w := range report.Workloads {
+		if w.Unschedulable == 0 {
+			continue
+		}
+		var cpuOnly, memoryOnly, both bool
+		for _, node := range nodes {
+			if !podFitsNode(w.podSpec, node.Labels, node.Taints) {
+				continue
+			}
+			cpuBlocks, memoryBlocks := w.PerPod.CPU > node.Free.CPU, w.PerPod.Memory > node.Free.Memory
+			switch {
+			case cpuBlocks && memoryBlocks:
+				both = true
+			case cpuBlocks:
+				cpuOnly = true
+			case memoryBlocks:
+				memoryOnly = true
+			}
+		}
+		cpu = cpu || cpuOnly || both && !memoryOnly
+		memory = memory || memoryOnly || both && !cpuOnly
+	}
+	return cpu, memory
+}
+
+// scaleFor returns the factor for the scalable part of a resource's requests that
+// brings them, with the fixed part, down to the headroom of free.
+func scaleFor(fixed, scalable, free int64) float64 {
+	if scalable <= 0 {
+		return 1
+	}
+	return math.Min(1, (float64(free)*fitHeadroom-float64(fixed))/float64(scalable))
+}
+
+func roundScale(scale float64) float64 {
+	return math.Round(scale*100) / 100
+}
+
+func cloneWorkloads(workloads []workloadRequests) []workloadRequests {
+	return append([]workloadRequests(nil), workloads...)
+}
+
+func cloneNodes(nodes []nodeCapacity) []nodeCapacity {
+	return append([]nodeCapacity(nil), nodes...)
+}
+
+// scaleValues returns the scaled requests.cpu and requests.memory of every resources
+// block in the values, and the scaled heap sizes of every javaOpts value, sorted by
+// path.
+func scaleValues(values map[string]interface{}, path string, cpuScale, memoryScale float64) []fitOverride {
+	var overrides []fitOverride
+	for _, key := range sortedKeys(values) {
+		child := joinValuesPath(path, key)
+		switch v := values[key].(type) {
+		case map[string]interface{}:
+			if key == "resources" {
+				requests, _ := v["requests"].(map[string]interface{})
+				if cpu, ok := parseQuantity(requests["cpu"]); ok && cpuScale < 1 {
+					to := formatCPU(max(1, int64(cpu*1000*cpuScale)))
+					overrides = append(overrides, fitOverride{Path: child + ".requests.cpu", From: scalarString(requests["cpu"]), To: to})
+				}
+				if memory, ok := parseQuantity(requests["memory"]); ok && memoryScale < 1 {
+					to := formatMemory(max(1<<20, int64(memory*memoryScale)))
+					overrides = append(overrides, fitOverride{Path: child + ".requests.memory", From: scalarString(requests["memory"]), To: to})
+				}
+				continue
+			}
+			overrides = append(overrides, scaleValues(v, child, cpuScale, memoryScale)...)
+		case string:
+			if key == "javaOpts" && memoryScale < 1 {
+				if scaled := scaleJavaHeap(v, memoryScale); scaled != v {
+					overrides = append(overrides, fitOverride{Path: child, From: v, To: scaled})
+				}
+			}
+		}
+	}
+	return overrides
+}
+
+// javaHeapOption matches the -Xms and -Xmx options of a JVM command line.
+var javaHeapOption = regexp.MustCompile(`-Xm([sx])(\d+)([kKmMgG]?)\b`)
+
+// scaleJavaHeap scales the -Xms and -Xmx sizes of java options, in megabytes.
+func scaleJavaHeap(opts string, scale float64) string {
+	return javaHeapOption.ReplaceAllStringFunc(opts, func(option string) string {
+		m := javaHeapOption.FindStringSubmatch(option)
+		size, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return option
+		}
+		switch strings.ToLower(m[3]) {
+		case "k":
+			size <<= 10
+		case "m":
+			size <<= 20
+		case "g":
+			size <<= 30
+		}
+		scaled := int64(float64(size) * scale)
+		if scaled < fitMinHeap {
+			scaled = min(size, fitMinHeap)
+		}
+		return fmt.Sprintf("-Xm%s%dm", m[1], max(1, scaled>>20))
+	})
+}
+
+// escapeSetValue escapes the separators of a --set value.
+func escapeSetValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `,`, `\,`).Replace(value)
+}
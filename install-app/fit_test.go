@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestFitScales(t *testing.T) {
+	deployment := func(name string, pods, cpu, memory int64) workloadRequests {
+		w := workloadRequests{Namespace: "sock-shop", Kind: "Deployment", Name: name, Pods: pods,
+			PerPod: resourceAmounts{CPU: cpu, Memory: memory}}
+		w.Total = w.PerPod.times(pods)
+		return w
+	}
+	node := func(name string, cpu, memory int64) nodeCapacity {
+		return nodeCapacity{Name: name, Free: resourceAmounts{CPU: cpu, Memory: memory}}
+	}
+	both := fitScalable{cpu: true, memory: true}
+
+	tests := []struct {
+		name        string
+		workloads   []workloadRequests
+		scalable    map[string]fitScalable
+		nodes       []nodeCapacity
+		cpu, memory float64
+		err         string
+	}{
+		{
+			// Only app follows the values: its requests take all of the cut, and memory,
+			// which fits, isn't touched.
+			name:      "fixed requests count at full size",
+			workloads: []workloadRequests{deployment("app", 2, 600, 512<<20), deployment("fixed", 1, 300, 256<<20)},
+			scalable:  map[string]fitScalable{"sock-shop/Deployment/app": both},
+			nodes:     []nodeCapacity{node("n1", 1000, 4<<30)},
+			cpu:       0.5, memory: 1,
+		},
+		{
+			name:      "memory only",
+			workloads: []workloadRequests{deployment("app", 4, 100, 1<<30)},
+			scalable:  map[string]fitScalable{"sock-shop/Deployment/app": both},
+			nodes:     []nodeCapacity{node("n1", 4000, 2<<30)},
+			cpu:       1, memory: 0.45,
+		},
+		{
+			// The totals fit but the pod is too big for either node; only CPU keeps it off.
+			name:      "packing shrinks the short resource",
+			workloads: []workloadRequests{deployment("app", 1, 1500, 256<<20)},
+			scalable:  map[string]fitScalable{"sock-shop/Deployment/app": both},
+			nodes:     []nodeCapacity{node("n1", 1000, 1<<30), node("n2", 1000, 1<<30)},
+			cpu:       math.Pow(fitStep, 4), memory: 1,
+		},
+		{
+			name:      "nothing to scale",
+			workloads: []workloadRequests{deployment("fixed", 1, 2000, 256<<20)},
+			scalable:  map[string]fitScalable{"sock-shop/Deployment/fixed": {memory: true}},
+			nodes:     []nodeCapacity{node("n1", 1000, 1<<30)},
+			err:       "scaling requests can't make the release fit",
+		},
+		{
+			name:      "below the minimum",
+			workloads: []workloadRequests{deployment("app", 1, 10000, 256<<20)},
+			scalable:  map[string]fitScalable{"sock-shop/Deployment/app": both},
+			nodes:     []nodeCapacity{node("n1", 1000, 1<<30)},
+			err:       "even with requests scaled to 20%",
+		},
+	}
+	for _, tt := range tests {
+		cpu, memory, err := fitScales(tt.workloads, tt.scalable, tt.nodes)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if math.Abs(cpu-tt.cpu) > 1e-9 || math.Abs(memory-tt.memory) > 1e-9 {
+			t.Errorf("%s: got CPU %v, memory %v, want %v, %v", tt.name, cpu, memory, tt.cpu, tt.memory)
+		}
+	}
+}
+
+func TestScaleValues(t *testing.T) {
+	values := mustParseYAML(t, `
+carts:
+  javaOpts: -Xms256m -Xmx1g -XX:+UseG1GC
+  resources:
+    requests:
+      cpu: 300m
+      memory: 1Gi
+    limits:
+      cpu: "1"
+front-end:
+  resources:
+    requests:
+      cpu: "1"
+`).(map[string]interface{})
+
+	var got []string
+	for _, o := range scaleValues(values, "", 0.5, 1) {
+		got = append(got, o.Path+": "+o.From+" -> "+o.To)
+	}
+	if want := "carts.resources.requests.cpu: 300m -> 150m, front-end.resources.requests.cpu: 1 -> 500m"; strings.Join(got, ", ") != want {
+		t.Errorf("CPU only: got %s, want %s", strings.Join(got, ", "), want)
+	}
+
+	got = nil
+	for _, o := range scaleValues(values, "", 1, 0.5) {
+		got = append(got, o.Path+": "+o.From+" -> "+o.To)
+	}
+	if want := "carts.javaOpts: -Xms256m -Xmx1g -XX:+UseG1GC -> -Xms128m -Xmx512m -XX:+UseG1GC, " +
+		"carts.resources.requests.memory: 1Gi -> 512Mi"; strings.Join(got, ", ") != want {
+		t.Errorf("memory only: got %s, want %s", strings.Join(got, ", "), want)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	forwardMinBackoff = time.Second
+	forwardMaxBackoff = 30 * time.Second
+	// forwardStableAfter is how long a port-forward must have run for its backoff to
+	// reset.
+	forwardStableAfter = 30 * time.Second
+)
+
+// portForward is one local port forwarded to a Service of the release.
+type portForward struct {
+	Name      string
+	Namespace string
+	Service   string
+	Port      int64
+	LocalPort int64
+	Path      string
+}
+
+// runForward implements `install-app forward <release>`, port-forwarding the
+// release's endpoints to localhost until interrupted. Each forward is restarted when
+// it drops, e.g. because chaos deleted the pod behind it.
+func runForward(args []string) error {
+	var namespace, chartsPath, address, kubeConfig, kubeContext string
+	var ports, only listFlags
+
+	flags := flag.NewFlagSet("forward", flag.ExitOnError)
+	flags.StringVar(&namespace, "namespace", "", "Namespace of the release (defaults to searching all namespaces)")
+	flags.StringVar(&chartsPath, "charts-path", "", "Base path where charts are located (defaults to the embedded charts, or "+defaultChartsPath+")")
+	flags.StringVar(&address, "address", "127.0.0.1", "Local address to listen on")
+	flags.Var(&ports, "port", "Local port of an endpoint as name=port, e.g. front-end=9000 (can be repeated)")
+	flags.Var(&only, "only", "Only forward these endpoints (comma-separated or repeated)")
+	flags.StringVar(&kubeConfig, "kubeconfig", "", "Path to kubeconfig file")
+	flags.StringVar(&kubeContext, "context", "", "Kubernetes context to use")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: install-app forward <release> [options]\n\n")
+		flags.PrintDefaults()
+	}
+
+	// Accept the release name before or after the flags.
+	var release string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		release, args = args[0], args[1:]
+	}
+	flags.Parse(args)
+	if release == "" {
+		release = flags.Arg(0)
+	}
+	if release == "" {
+		flags.Usage()
+		return fmt.Errorf("release name is required")
+	}
+
+	status, err := getReleaseStatus(release, namespace, kubeConfig, kubeContext)
+	if err != nil {
+		return err
+	}
+	config := &Config{
+		ReleaseName: release,
+		Namespace:   status.Namespace,
+		FolderName:  status.Chart,
+		Version:     status.Version,
+		ChartsPath:  chartsPath,
+		KubeConfig:  kubeConfig,
+		KubeContext: kubeContext,
+	}
+
+	forwards, err := releaseForwards(config)
+	if err != nil {
+		return err
+	}
+	if forwards, err = filterForwards(forwards, only); err != nil {
+		return err
+	}
+	if err := assignLocalPorts(forwards, address, ports); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ENDPOINT\tLOCAL URL\tSERVICE")
+	for _, f := range forwards {
+		fmt.Fprintf(w, "%s\thttp://%s:%d%s\t%s/%s:%d\n", f.Name, address, f.LocalPort, f.Path, f.Namespace, f.Service, f.Port)
+	}
+	w.Flush()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("Forwarding %d endpoints of release %s, press Ctrl+C to stop", len(forwards), release)
+
+	var wg sync.WaitGroup
+	for _, f := range forwards {
+		wg.Add(1)
+		go func(f portForward) {
+			defer wg.Done()
+			keepForwarding(ctx, config, f, address)
+		}(f)
+	}
+	wg.Wait()
+	return nil
+}
+
+// releaseForwards returns the endpoints to forward: those the chart lists in its
+// accessAnnotation or, when the chart isn't available locally, every NodePort and
+// LoadBalancer Service of the release.
+func releaseForwards(config *Config) ([]portForward, error) {
+	args := []string{"get", "manifest", config.ReleaseName, "-n", config.Namespace}
+	if config.KubeConfig != "" {
+		args = append(args, "--kubeconfig", config.KubeConfig)
+	}
+	if config.KubeContext != "" {
+		args = append(args, "--kube-context", config.KubeContext)
+	}
+	out, err := exec.Command("helm", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("helm get manifest failed: %w", err)
+	}
+	docs, err := parseYAMLDocuments(out)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the release manifest: %w", err)
+	}
+
+	services := map[string]portForward{}
+	var exposed []string
+	for _, res := range manifestResources(docs) {
+		if res.Kind != "Service" {
+			continue
+		}
+		if res.Namespace == "" {
+			res.Namespace = config.Namespace
+		}
+		spec, _ := res.Object["spec"].(map[string]interface{})
+		list, _ := spec["ports"].([]interface{})
+		if len(list) == 0 {
+			continue
+		}
+		first, _ := list[0].(map[string]interface{})
+		port, ok := jsonNumber(first["port"])
+		if !ok {
+			continue
+		}
+		services[res.Name] = portForward{Name: res.Name, Namespace: res.Namespace, Service: res.Name, Port: int64(port), Path: "/"}
+		if t := spec["type"]; t == "NodePort" || t == "LoadBalancer" {
+			exposed = append(exposed, res.Name)
+		}
+	}
+
+	var endpoints []accessAnnotationEntry
+	cleanup, err := resolveChartsPath(config)
+	if err == nil {
+		defer cleanup()
+		err = validateChartFolder(config)
+	}
+	if err == nil {
+		var annotations map[string]string
+		if annotations, err = chartAnnotations(config.chartPath()); err == nil {
+			endpoints, err = parseAccessAnnotation(annotations[accessAnnotation])
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: chart %s %s not available locally (%v); forwarding the NodePort and LoadBalancer services",
+			config.FolderName, config.Version, err)
+	}
+
+	var forwards []portForward
+	if len(endpoints) == 0 {
+		sort.Strings(exposed)
+		for _, name := range exposed {
+			forwards = append(forwards, services[name])
+		}
+	}
+	for _, e := range endpoints {
+		f, ok := services[e.service]
+		if !ok {
+			continue
+		}
+		f.Name, f.Path = e.name, e.path
+		forwards = append(forwards, f)
+	}
+	if len(forwards) == 0 {
+		return nil, fmt.Errorf("release %s has no endpoints to forward", config.ReleaseName)
+	}
+	return forwards, nil
+}
+
+// filterForwards keeps the named endpoints, if any are named.
+func filterForwards(forwards []portForward, only []string) ([]portForward, error) {
+	if len(only) == 0 {
+		return forwards, nil
+	}
+	known := map[string]portForward{}
+	var names []string
+	for _, f := range forwards {
+		known[f.Name] = f
+		names = append(names, f.Name)
+	}
+	var kept []portForward
+	for _, name := range annotationList(strings.Join(only, ",")) {
+		f, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown endpoint %s (available: %s)", name, strings.Join(names, ", "))
+		}
+		kept = append(kept, f)
+	}
+	return kept, nil
+}
+
+// assignLocalPorts picks the local port of each forward: the -port mapping, else the
+// Service port, moved up by 8000 when it is privileged (80 becomes 8080). Ports must
+// be free on the local address.
+func assignLocalPorts(forwards []portForward, address string, mappings []string) error {
+	explicit := map[string]int64{}
+	for _, m := range mappings {
+		name, value, ok := strings.Cut(m, "=")
+		port, err := strconv.ParseInt(value, 10, 64)
+		if !ok || err != nil || port < 1 || port > 65535 {
+			return fmt.Errorf("invalid -port %s: expected name=port", m)
+		}
+		explicit[name] = port
+	}
+
+	taken := map[int64]string{}
+	for i := range forwards {
+		f := &forwards[i]
+		port, ok := explicit[f.Name]
+		if !ok {
+			port = f.Port
+			if port < 1024 {
+				port += 8000
+			}
+			for taken[port] != "" {
+				port++
+			}
+		}
+		if other := taken[port]; other != "" {
+			return fmt.Errorf("local port %d is mapped to both %s and %s", port, other, f.Name)
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(address, strconv.FormatInt(port, 10)))
+		if err != nil {
+			return fmt.Errorf("local port %d for %s is not available (use -port %s=<port>): %w", port, f.Name, f.Name, err)
+		}
+		ln.Close()
+		f.LocalPort = port
+		taken[port] = f.Name
+	}
+	return nil
+}
+
+// keepForwarding runs kubectl port-forward for f until ctx is done, restarting it
+// with backoff whenever it exits or loses its pod.
+func keepForwarding(ctx context.Context, config *Config, f portForward, address string) {
+	backoff := forwardMinBackoff
+	for {
+		started := time.Now()
+		err := forwardOnce(ctx, config, f, address)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > forwardStableAfter {
+			backoff = forwardMinBackoff
+		}
+		log.Printf("%s: port-forward stopped (%v), reconnecting in %s", f.Name, err, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, forwardMaxBackoff)
+	}
+}
+
+// forwardOnce runs a single kubectl port-forward. kubectl keeps running when the pod
+// behind the Service is deleted on some versions, so losing the pod stops it too.
+func forwardOnce(ctx context.Context, config *Config, f portForward, address string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	args := kubectlArgs(config, "port-forward", "-n", f.Namespace, "service/"+f.Service,
+		fmt.Sprintf("%d:%d", f.LocalPort, f.Port), "--address", address)
+	cmd := exec.CommandContext(ctx, "kubectl", args...)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	lost := false
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		log.Printf("%s: %s", f.Name, line)
+		if strings.Contains(line, "lost connection to pod") {
+			lost = true
+			cancel()
+		}
+	}
+	err = cmd.Wait()
+	if lost {
+		return fmt.Errorf("lost connection to pod")
+	}
+	if err == nil {
+		return fmt.Errorf("kubectl exited")
+	}
+	return err
+}
@@ -0,0 +1,28 @@
+#!/bin/sh
+# Prepares bundle/ for embedding into the install-app binary (see bundle.go).
+#
+# Usage: gen-bundle.sh [charts-source]
+#
+# When a charts source is given it is copied to bundle/charts first. The content
+# hash manifest bundle/charts.sha256 is always regenerated from bundle/charts so
+# that install-app can verify chart folders on disk before rendering them.
+set -eu
+
+src=""
+if [ "$#" -gt 0 ]; then
+	src="$(cd "$1" && pwd)"
+fi
+
+cd "$(dirname "$0")/bundle"
+
+if [ -n "$src" ]; then
+	rm -rf charts
+	cp -R "$src" charts
+fi
+
+if [ ! -d charts ]; then
+	echo "gen-bundle.sh: bundle/charts not found; pass the charts directory to copy" >&2
+	exit 1
+fi
+
+find charts -type f -exec sha256sum {} + | LC_ALL=C sort -k 2 > charts.sha256
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Chart.yaml annotations describing how a chart is installed as one of several
+// instances in a cluster, e.g.
+//
+//	annotations:
+//	  install-app/instance-value: instance
+//	  install-app/instance-namespaces: namespaces.sockShop,namespaces.monitoring
+//	  install-app/instance-singletons: monitoring.metricsServer.enabled=apiservice/v1beta1.metrics.k8s.io
+const (
+	// instanceValueAnnotation names the value the instance id is written to; the
+	// chart uses it to suffix its cluster-scoped names.
+	instanceValueAnnotation = "install-app/instance-value"
+	// instanceNamespacesAnnotation lists the namespace values suffixed with the id.
+	instanceNamespacesAnnotation = "install-app/instance-namespaces"
+	// instanceSingletonsAnnotation lists toggle=kind/name pairs of cluster-wide
+	// singletons: when the object already exists the toggle is switched off and the
+	// instance shares it.
+	instanceSingletonsAnnotation = "install-app/instance-singletons"
+)
+
+const (
+	// instancePortStride is the NodePort distance between instance slots. Any stride
+	// that isn't a difference of the chart's default ports keeps instances apart.
+	instancePortStride = 10
+	maxInstanceSlot    = 270 // keeps slot*stride below the range size
+)
+
+var instanceIDPattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// validateInstanceID checks that an instance id can be appended to namespace and
+// resource names.
+func validateInstanceID(id string) error {
+	if len(id) > 20 || !instanceIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid -instance %q: must be at most 20 lowercase letters, digits or '-'", id)
+	}
+	return nil
+}
+
+// instanceSlot maps an instance id to the slot its NodePorts are shifted by. Ids
+// 1 to maxInstanceSlot use their number, so numbered instances never collide; other
+// ids are hashed.
+func instanceSlot(id string) int {
+	if n, err := strconv.Atoi(id); err == nil && n >= 1 && n <= maxInstanceSlot {
+		return n
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32()%maxInstanceSlot) + 1
+}
+
+// instanceNodePort shifts a default NodePort into the instance's slot, wrapping
+// within the NodePort range.
+func instanceNodePort(port int64, slot int) int64 {
+	offset := int64(slot * instancePortStride)
+	if port < nodePortRangeStart || port >= nodePortRangeStart+nodePortRangeSize {
+		return port + offset
+	}
+	return nodePortRangeStart + (port-nodePortRangeStart+offset)%nodePortRangeSize
+}
+
+// resolveInstance derives the values that keep an -instance install apart from the
+// chart's other installs: the instance id, suffixed namespaces, shifted NodePorts and
+// shared singletons. They are layered under every user value, so anything set
+// explicitly still wins, and written to a temporary values file for helm.
+func resolveInstance(config *Config) (func(), error) {
+	if config.Instance == "" {
+		return func() {}, nil
+	}
+
+	annotations, err := chartAnnotations(config.chartPath())
+	if err != nil {
+		return nil, err
+	}
+	instanceKey := annotations[instanceValueAnnotation]
+	if instanceKey == "" {
+		return nil, fmt.Errorf("chart does not support -instance: Chart.yaml has no %s annotation", instanceValueAnnotation)
+	}
+
+	user, err := userValues(config)
+	if err != nil {
+		return nil, err
+	}
+	defaults, err := computeValues(config)
+	if err != nil {
+		return nil, err
+	}
+	userSet := func(path string) bool {
+		_, ok := lookupValue(user, path)
+		return ok
+	}
+
+	instance := map[string]interface{}{}
+	if err := parseSetValues(instance, instanceKey+"="+config.Instance, setString); err != nil {
+		return nil, err
+	}
+
+	for _, key := range annotationList(annotations[instanceNamespacesAnnotation]) {
+		// An explicit -namespace is wired into the namespace value instead.
+		if userSet(key) || (key == annotations[namespaceValueAnnotation] && config.Namespace != "") {
+			continue
+		}
+		if ns, _ := lookupValue(defaults, key); ns != nil && ns != "" {
+			if err := parseSetValues(instance, fmt.Sprintf("%s=%v-%s", key, ns, config.Instance), setString); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	slot := instanceSlot(config.Instance)
+	for _, p := range valuesNodePorts(defaults) {
+		if userSet(p.Path) {
+			continue
+		}
+		port := instanceNodePort(p.Port, slot)
+		if err := parseSetValues(instance, fmt.Sprintf("%s=%d", p.Path, port), setTyped); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range annotationList(annotations[instanceSingletonsAnnotation]) {
+		toggle, object, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s entry %q: expected toggle=kind/name", instanceSingletonsAnnotation, entry)
+		}
+		if enabled, _ := lookupValue(defaults, toggle); enabled != true || userSet(toggle) {
+			continue
+		}
+		if err := exec.Command("kubectl", kubectlArgs(config, "get", object)...).Run(); err == nil {
+			log.Printf("%s already exists in the cluster; instance %s shares it (%s=false)", object, config.Instance, toggle)
+			if err := parseSetValues(instance, toggle+"=false", setTyped); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	path, err := writeTempValues("install-app-instance-*.yaml", instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write instance values: %w", err)
+	}
+	config.instanceValuesFile = path
+
+	log.Printf("Installing as instance %s (NodePort slot %d)", config.Instance, slot)
+	return func() { os.Remove(path) }, nil
+}
+
+// annotationList splits a comma-separated annotation value.
+func annotationList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
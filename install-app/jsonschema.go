@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// schemaProblem is one schema violation, located by the JSON path of the value.
+type schemaProblem struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (p schemaProblem) String() string { return p.Path + ": " + p.Message }
+
+// validateJSONSchema checks a decoded document against a JSON schema and returns every
+// violation. It supports the keywords Helm chart schemas use in practice: type, enum,
+// const, properties, additionalProperties, patternProperties, required, items,
+// min/maxItems, minimum, maximum, exclusiveMinimum/Maximum, multipleOf, min/maxLength,
+// pattern, allOf, anyOf, oneOf, not, and local $ref pointers.
+func validateJSONSchema(schema map[string]interface{}, doc interface{}) []schemaProblem {
+	v := &schemaValidator{root: schema}
+	v.validate(schema, doc, "$")
+	return v.problems
+}
+
+type schemaValidator struct {
+	root     map[string]interface{}
+	problems []schemaProblem
+}
+
+func (v *schemaValidator) fail(path, format string, args ...interface{}) {
+	v.problems = append(v.problems, schemaProblem{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// valid reports whether doc matches schema without recording problems.
+func (v *schemaValidator) valid(schema interface{}, doc interface{}) bool {
+	probe := &schemaValidator{root: v.root}
+	probe.validate(schema, doc, "$")
+	return len(probe.problems) == 0
+}
+
+func (v *schemaValidator) validate(raw interface{}, doc interface{}, path string) {
+	switch s := raw.(type) {
+	case bool:
+		if !s {
+			v.fail(path, "not allowed")
+		}
+		return
+	case map[string]interface{}:
+		v.validateObject(s, doc, path)
+	}
+}
+
+func (v *schemaValidator) validateObject(s map[string]interface{}, doc interface{}, path string) {
+	if ref, ok := s["$ref"].(string); ok {
+		target, err := v.resolveRef(ref)
+		if err != nil {
+			v.fail(path, "%v", err)
+			return
+		}
+		v.validate(target, doc, path)
+	}
+
+	if t, ok := s["type"]; ok && !matchesType(t, doc) {
+		v.fail(path, "expected %s, got %s", describeType(t), jsonTypeName(doc))
+		return
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, doc) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, "must be one of %s, got %s", formatJSONList(enum), formatJSONValue(doc))
+		}
+	}
+	if c, ok := s["const"]; ok && !jsonEqual(c, doc) {
+		v.fail(path, "must be %s, got %s", formatJSONValue(c), formatJSONValue(doc))
+	}
+
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		v.validateProperties(s, d, path)
+	case []interface{}:
+		v.validateItems(s, d, path)
+	case string:
+		v.validateString(s, d, path)
+	}
+	if n, ok := jsonNumber(doc); ok {
+		v.validateNumber(s, n, path)
+	}
+
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			v.validate(sub, doc, path)
+		}
+	}
+	if any, ok := s["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range any {
+			if v.valid(sub, doc) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "does not match any of the allowed schemas")
+		}
+	}
+	if one, ok := s["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range one {
+			if v.valid(sub, doc) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.fail(path, "must match exactly one of the allowed schemas, matched %d", matched)
+		}
+	}
+	if not, ok := s["not"]; ok && v.valid(not, doc) {
+		v.fail(path, "matches a disallowed schema")
+	}
+}
+
+func (v *schemaValidator) validateProperties(s map[string]interface{}, doc map[string]interface{}, path string) {
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, ok := doc[name]; !ok {
+				v.fail(jsonPathKey(path, name), "required value is missing")
+			}
+		}
+	}
+
+	properties, _ := s["properties"].(map[string]interface{})
+	patterns, _ := s["patternProperties"].(map[string]interface{})
+	additional, hasAdditional := s["additionalProperties"]
+
+	for _, key := range sortedKeys(doc) {
+		child := jsonPathKey(path, key)
+		matched := false
+		if sub, ok := properties[key]; ok {
+			v.validate(sub, doc[key], child)
+			matched = true
+		}
+		for pattern, sub := range patterns {
+			if re, err := regexp.Compile(pattern); err == nil && re.MatchString(key) {
+				v.validate(sub, doc[key], child)
+				matched = true
+			}
+		}
+		if matched || !hasAdditional {
+			continue
+		}
+		if allowed, ok := additional.(bool); ok && !allowed {
+			msg := "unknown key"
+			if suggestion := closestKey(key, properties); suggestion != "" {
+				msg += fmt.Sprintf(" (did you mean %s?)", suggestion)
+			}
+			v.fail(child, "%s", msg)
+			continue
+		}
+		v.validate(additional, doc[key], child)
+	}
+}
+
+func (v *schemaValidator) validateItems(s map[string]interface{}, doc []interface{}, path string) {
+	switch items := s["items"].(type) {
+	case map[string]interface{}, bool:
+		for i, item := range doc {
+			v.validate(items, item, path+"["+strconv.Itoa(i)+"]")
+		}
+	case []interface{}:
+		for i, item := range doc {
+			if i < len(items) {
+				v.validate(items[i], item, path+"["+strconv.Itoa(i)+"]")
+			}
+		}
+	}
+	if n, ok := jsonNumber(s["minItems"]); ok && float64(len(doc)) < n {
+		v.fail(path, "must have at least %v items, has %d", n, len(doc))
+	}
+	if n, ok := jsonNumber(s["maxItems"]); ok && float64(len(doc)) > n {
+		v.fail(path, "must have at most %v items, has %d", n, len(doc))
+	}
+}
+
+func (v *schemaValidator) validateString(s map[string]interface{}, doc string, path string) {
+	length := float64(len([]rune(doc)))
+	if n, ok := jsonNumber(s["minLength"]); ok && length < n {
+		v.fail(path, "must be at least %v characters long", n)
+	}
+	if n, ok := jsonNumber(s["maxLength"]); ok && length > n {
+		v.fail(path, "must be at most %v characters long", n)
+	}
+	if pattern, ok := s["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			v.fail(path, "schema pattern %q is invalid: %v", pattern, err)
+		} else if !re.MatchString(doc) && pattern == quantityPattern {
+			v.fail(path, "%q is not a valid resource quantity", doc)
+		} else if !re.MatchString(doc) {
+			v.fail(path, "%q does not match pattern %s", doc, pattern)
+		}
+	}
+}
+
+func (v *schemaValidator) validateNumber(s map[string]interface{}, n float64, path string) {
+	if lower, ok := jsonNumber(s["minimum"]); ok {
+		if exclusive, _ := s["exclusiveMinimum"].(bool); exclusive && n <= lower {
+			v.fail(path, "must be greater than %v, got %v", lower, n)
+		} else if n < lower {
+			v.fail(path, "must be at least %v, got %v", lower, n)
+		}
+	}
+	if upper, ok := jsonNumber(s["maximum"]); ok {
+		if exclusive, _ := s["exclusiveMaximum"].(bool); exclusive && n >= upper {
+			v.fail(path, "must be less than %v, got %v", upper, n)
+		} else if n > upper {
+			v.fail(path, "must be at most %v, got %v", upper, n)
+		}
+	}
+	if lower, ok := jsonNumber(s["exclusiveMinimum"]); ok && n <= lower {
+		v.fail(path, "must be greater than %v, got %v", lower, n)
+	}
+	if upper, ok := jsonNumber(s["exclusiveMaximum"]); ok && n >= upper {
+		v.fail(path, "must be less than %v, got %v", upper, n)
+	}
+	if m, ok := jsonNumber(s["multipleOf"]); ok && m > 0 {
+		if q := n / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			v.fail(path, "must be a multiple of %v, got %v", m, n)
+		}
+	}
+}
+
+// resolveRef follows a local "#/..." JSON pointer within the root schema.
+func (v *schemaValidator) resolveRef(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported schema reference %s (only local references are supported)", ref)
+	}
+	var node interface{} = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("schema reference %s not found", ref)
+		}
+		if node, ok = m[part]; !ok {
+			return nil, fmt.Errorf("schema reference %s not found", ref)
+		}
+	}
+	return node, nil
+}
+
+// matchesType checks a "type" keyword (a name or a list of names).
+func matchesType(t interface{}, doc interface{}) bool {
+	switch t := t.(type) {
+	case string:
+		return isJSONType(t, doc)
+	case []interface{}:
+		for _, name := range t {
+			if s, ok := name.(string); ok && isJSONType(s, doc) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isJSONType(name string, doc interface{}) bool {
+	switch name {
+	case "object":
+		_, ok := doc.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := doc.([]interface{})
+		return ok
+	case "string":
+		_, ok := doc.(string)
+		return ok
+	case "boolean":
+		_, ok := doc.(bool)
+		return ok
+	case "null":
+		return doc == nil
+	case "number":
+		_, ok := jsonNumber(doc)
+		return ok
+	case "integer":
+		n, ok := jsonNumber(doc)
+		return ok && n == math.Trunc(n)
+	}
+	return false
+}
+
+func describeType(t interface{}) string {
+	if list, ok := t.([]interface{}); ok {
+		names := make([]string, len(list))
+		for i, name := range list {
+			names[i] = fmt.Sprint(name)
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func jsonTypeName(doc interface{}) string {
+	switch d := doc.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return fmt.Sprintf("string %q", d)
+	case bool:
+		return fmt.Sprintf("boolean %v", d)
+	}
+	if n, ok := jsonNumber(doc); ok {
+		if n == math.Trunc(n) {
+			return fmt.Sprintf("integer %v", doc)
+		}
+		return fmt.Sprintf("number %v", doc)
+	}
+	return fmt.Sprintf("%T", doc)
+}
+
+// jsonNumber returns the value of a decoded number (int64 from YAML, float64 from JSON).
+func jsonNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+func jsonEqual(a, b interface{}) bool {
+	if x, ok := jsonNumber(a); ok {
+		y, ok := jsonNumber(b)
+		return ok && x == y
+	}
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, xv := range x {
+			if yv, ok := y[k]; !ok || !jsonEqual(xv, yv) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+func formatJSONValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprint(v)
+}
+
+func formatJSONList(list []interface{}) string {
+	items := make([]string, len(list))
+	for i, item := range list {
+		items[i] = formatJSONValue(item)
+	}
+	return strings.Join(items, ", ")
+}
+
+var plainJSONPathKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// jsonPathKey appends a map key to a JSON path, bracket-quoting keys that are not
+// plain identifiers.
+func jsonPathKey(path, key string) string {
+	if plainJSONPathKey.MatchString(key) {
+		return path + "." + key
+	}
+	return path + "[" + strconv.Quote(key) + "]"
+}
+
+// closestKey suggests the declared property a mistyped key most likely meant.
+func closestKey(key string, properties map[string]interface{}) string {
+	best, bestDistance := "", 3
+	for candidate := range properties {
+		if strings.EqualFold(candidate, key) {
+			return candidate
+		}
+		if d := editDistance(key, candidate); d < bestDistance || (d == bestDistance && candidate < best) {
+			best, bestDistance = candidate, d
+		}
+	}
+	if bestDistance > 2 {
+		return ""
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateJSONSchema(t *testing.T) {
+	tests := []struct {
+		name, schema, doc string
+		// want lists the expected problems, joined by "; ".
+		want string
+	}{
+		{"type", `{"type": "object"}`, `[]`, "$: expected object, got array"},
+		{"type list", `{"type": ["string", "null"]}`, `null`, ""},
+		{"integer", `{"type": "integer"}`, `1.5`, "$: expected integer, got number 1.5"},
+		{"integral number", `{"type": "integer"}`, `2.0`, ""},
+		{"enum", `{"enum": ["a", "b"]}`, `"c"`, `$: must be one of "a", "b", got "c"`},
+		{"const", `{"const": 1}`, `1.0`, ""},
+		{"required", `{"required": ["a", "b"]}`, `{"a": 1}`, "$.b: required value is missing"},
+		{"properties", `{"properties": {"port": {"type": "integer", "minimum": 1, "maximum": 65535}}}`,
+			`{"port": 70000}`, "$.port: must be at most 65535, got 70000"},
+		{"unknown key", `{"properties": {"replicas": {}}, "additionalProperties": false}`,
+			`{"replicsa": 1}`, "$.replicsa: unknown key (did you mean replicas?)"},
+		{"additionalProperties schema", `{"additionalProperties": {"type": "string"}}`,
+			`{"a": "x", "b": 1}`, "$.b: expected string, got integer 1"},
+		{"patternProperties", `{"patternProperties": {"^x-": {"type": "boolean"}}, "additionalProperties": false}`,
+			`{"x-a": true, "y": 1}`, "$.y: unknown key"},
+		{"quoted path", `{"properties": {"a.b": {"type": "string"}}}`, `{"a.b": 1}`, `$["a.b"]: expected string, got integer 1`},
+		{"items", `{"items": {"type": "string"}, "minItems": 3}`, `["a", 1]`,
+			"$[1]: expected string, got integer 1; $: must have at least 3 items, has 2"},
+		{"tuple items", `{"items": [{"type": "string"}, {"type": "integer"}]}`, `["a", 1, true]`, ""},
+		{"string length", `{"minLength": 2, "maxLength": 3}`, `"é"`, "$: must be at least 2 characters long"},
+		{"pattern", `{"pattern": "^[a-z]+$"}`, `"A1"`, `$: "A1" does not match pattern ^[a-z]+$`},
+		{"quantity", `{"pattern": "` + strings.ReplaceAll(quantityPattern, `\`, `\\`) + `"}`, `"1 Gi"`,
+			`$: "1 Gi" is not a valid resource quantity`},
+		{"exclusive bounds", `{"exclusiveMinimum": 0, "exclusiveMaximum": 10}`, `0`, "$: must be greater than 0, got 0"},
+		{"draft-04 exclusive", `{"minimum": 0, "exclusiveMinimum": true}`, `0`, "$: must be greater than 0, got 0"},
+		{"multipleOf", `{"multipleOf": 0.1}`, `0.3`, ""},
+		{"not a multiple", `{"multipleOf": 2}`, `3`, "$: must be a multiple of 2, got 3"},
+		{"allOf", `{"allOf": [{"type": "integer"}, {"minimum": 5}]}`, `3`, "$: must be at least 5, got 3"},
+		{"anyOf", `{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `true`, "$: does not match any of the allowed schemas"},
+		{"oneOf", `{"oneOf": [{"type": "integer"}, {"type": "number"}]}`, `1`,
+			"$: must match exactly one of the allowed schemas, matched 2"},
+		{"not", `{"not": {"type": "null"}}`, `null`, "$: matches a disallowed schema"},
+		{"false schema", `{"properties": {"a": false}}`, `{"a": 1}`, "$.a: not allowed"},
+		{"ref", `{"definitions": {"port": {"type": "integer"}}, "properties": {"p": {"$ref": "#/definitions/port"}}}`,
+			`{"p": "80"}`, `$.p: expected integer, got string "80"`},
+		{"missing ref", `{"$ref": "#/definitions/none"}`, `1`, "$: schema reference #/definitions/none not found"},
+		{"remote ref", `{"$ref": "https://example.com/schema.json"}`, `1`,
+			"$: unsupported schema reference https://example.com/schema.json (only local references are supported)"},
+	}
+	for _, tt := range tests {
+		schema, err := decodeJSONValue([]byte(tt.schema))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		doc, err := decodeJSONValue([]byte(tt.doc))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for _, p := range validateJSONSchema(schema.(map[string]interface{}), doc) {
+			got = append(got, p.String())
+		}
+		if strings.Join(got, "; ") != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, strings.Join(got, "; "), tt.want)
+		}
+	}
+}
+
+// TestGeneratedChartSchema checks that the schema generated from sock-shop's
+// values.yaml accepts the defaults and every profile, and catches typos.
+func TestGeneratedChartSchema(t *testing.T) {
+	schema, err := generateChartSchema(sockShopChart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := listProfiles(sockShopChart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, profile := range append([]string{""}, profiles...) {
+		config := &Config{ChartsPath: filepath.Dir(sockShopChart), FolderName: filepath.Base(sockShopChart)}
+		if profile != "" {
+			config.profileValuesFile = filepath.Join(sockShopChart, profilesDir, profile+".yaml")
+		}
+		values, err := computeValues(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problems := validateJSONSchema(schema, values); len(problems) > 0 {
+			t.Errorf("profile %q: %v", profile, problems)
+		}
+	}
+
+	values := map[string]interface{}{"sockShop": map[string]interface{}{"frontEnd": map[string]interface{}{"replicsa": int64(2)}}}
+	if problems := validateJSONSchema(schema, values); len(problems) != 1 || !strings.Contains(problems[0].Message, "did you mean replicas?") {
+		t.Errorf("typo: got %v", problems)
+	}
+}
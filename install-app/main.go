@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -13,13 +15,16 @@ import (
 )
 
 const (
-	defaultChartsPath = "/charts"
-	defaultNamespace  = "default"
+	defaultChartsPath      = "/charts"
+	defaultNamespace       = "default"
+	defaultImagePullSecret = "jfrog-registry"
 )
 
 // setFlags implements flag.Value to accumulate multiple --set flags.
 // Go's flag package keeps only the last value for a flag; this type
-// appends each occurrence so all --set values are preserved.
+// appends each occurrence so all --set values are preserved. The --set
+// style flags use it since each value is a comma-separated list of
+// expressions that helm splits itself.
 type setFlags []string
 
 func (s *setFlags) String() string { return strings.Join(*s, ",") }
@@ -28,58 +33,390 @@ func (s *setFlags) Set(val string) error {
 	return nil
 }
 
+// Config holds the install options. The flag tag names the command-line flag (and,
+// through envName, the environment variable); the json tag is the key in the
+// -config file.
 type Config struct {
-	FolderName  string
-	ReleaseName string
-	Namespace   string
-	ChartsPath  string
-	ValuesFile  string
-	SetValues   setFlags // supports multiple --set flags
-	DryRun      bool
-	Wait        bool
-	Timeout     string
-	CreateNS    bool
-	Upgrade     bool
-	KubeConfig  string
-	KubeContext string
+	ConfigFile      string    `json:"-" flag:"config"`
+	FolderName      string    `json:"folder" flag:"folder"`
+	Chart           string    `json:"chart" flag:"chart"`
+	Repo            string    `json:"repo" flag:"repo"`
+	Version         string    `json:"version" flag:"version"`
+	Profile         string    `json:"profile" flag:"profile"`
+	Instance        string    `json:"instance" flag:"instance"`
+	Components      listFlags `json:"components" flag:"components"`
+	Skip            listFlags `json:"skip" flag:"skip"`
+	Services        listFlags `json:"services" flag:"services"`
+	CacheDir        string    `json:"cacheDir" flag:"cache-dir"`
+	PlainHTTP       bool      `json:"plainHTTP" flag:"plain-http"`
+	ReleaseName     string    `json:"release" flag:"release"`
+	Namespace       string    `json:"namespace" flag:"namespace"`
+	ChartsPath      string    `json:"chartsPath" flag:"charts-path"`
+	ValuesFiles     listFlags `json:"valuesFiles" flag:"values"`
+	AgeKeyFile      string    `json:"ageKeyFile" flag:"age-key-file"`
+	SetValues       setFlags  `json:"set" flag:"set"` // supports multiple --set flags
+	SetStringValues setFlags  `json:"setString" flag:"set-string"`
+	SetFileValues   setFlags  `json:"setFile" flag:"set-file"`
+	SetJSONValues   setFlags  `json:"setJSON" flag:"set-json"`
+	ValuesOutput    string    `json:"valuesOutput" flag:"values-output"`
+	DryRun          bool      `json:"dryRun" flag:"dry-run"`
+	Wait            bool      `json:"wait" flag:"wait"`
+	Timeout         string    `json:"timeout" flag:"timeout"`
+	CreateNS        bool      `json:"createNamespace" flag:"create-namespace"`
+	Upgrade         bool      `json:"upgrade" flag:"upgrade"`
+	KubeConfig      string    `json:"kubeconfig" flag:"kubeconfig"`
+	KubeContext     string    `json:"context" flag:"context"`
+	AutoNodePort    bool      `json:"autoNodePort" flag:"auto-nodeport"`
+	PreflightMode   string    `json:"preflightMode" flag:"preflight-mode"`
+	FitToCluster    bool      `json:"fitToCluster" flag:"fit-to-cluster"`
+	Prerequisites   string    `json:"prerequisites" flag:"prerequisites"`
+	Policy          string    `json:"policy" flag:"policy"`
+	Patches         listFlags `json:"patches" flag:"patches"`
+	Output          string    `json:"output" flag:"output"`
+	ResultFile      string    `json:"resultFile" flag:"result-file"`
+
+	// NodeSelector, Tolerations, Affinity and PriorityClass are set in the rendered
+	// pod templates matching SchedulingSelector, or in all of them.
+	NodeSelector       listFlags `json:"nodeSelector" flag:"node-selector"`
+	Tolerations        listFlags `json:"tolerations" flag:"toleration"`
+	Affinity           string    `json:"affinity" flag:"affinity"`
+	PriorityClass      string    `json:"priorityClass" flag:"priority-class"`
+	SchedulingSelector string    `json:"schedulingSelector" flag:"scheduling-selector"`
+
+	// PodSecurity, NamespaceLabels, NamespaceAnnotations, NamespaceQuota and
+	// DefaultDeny govern the namespaces the release owns, see provisionNamespace.
+	PodSecurity          string    `json:"podSecurity" flag:"pod-security"`
+	NamespaceLabels      listFlags `json:"namespaceLabels" flag:"namespace-label"`
+	NamespaceAnnotations listFlags `json:"namespaceAnnotations" flag:"namespace-annotation"`
+	NamespaceQuota       string    `json:"namespaceQuota" flag:"namespace-quota"`
+	DefaultDeny          string    `json:"defaultDeny" flag:"default-deny"`
+
+	AllowUnverified bool   `json:"allowUnverified" flag:"allow-unverified"`
+	Keyring         string `json:"keyring" flag:"keyring"`
+	ValidateValues  bool   `json:"validateValues" flag:"validate-values"`
+
+	// ImagePullSecrets are copied from ImagePullSecretNamespace into the target
+	// namespace before install.
+	ImagePullSecrets         listFlags `json:"imagePullSecrets" flag:"image-pull-secret"`
+	ImagePullSecretNamespace string    `json:"imagePullSecretNamespace" flag:"image-pull-secret-namespace"`
+
+	// Values are structured values overrides, applied after ValuesFiles and before
+	// the --set style flags. They can only be given in the config file.
+	Values map[string]interface{} `json:"values,omitempty"`
+
+	// PostRenderPatches are patches of the rendered manifests, applied after the
+	// -patches files. They can only be given in the config file.
+	PostRenderPatches []manifestPatch `json:"postRenderPatches,omitempty"`
+
+	// Scheduling are scheduling rules for different pods, applied before the rule of
+	// the scheduling flags. They can only be given in the config file.
+	Scheduling []schedulingRule `json:"scheduling,omitempty"`
+
+	// resolvedChart overrides the chart location derived from ChartsPath and
+	// FolderName: the selected version folder, a verified packaged archive, or a
+	// cached remote chart.
+	resolvedChart   string
+	resolvedVersion string
+
+	// instanceValuesFile holds the values derived for -instance, see resolveInstance.
+	instanceValuesFile string
+
+	// profileValuesFile is the values file of the selected profile, and activeProfile
+	// its name.
+	profileValuesFile string
+	activeProfile     string
+
+	// componentsValuesFile holds the toggles of -components and -skip.
+	componentsValuesFile string
+
+	// servicesValuesFile holds the microservices selected with -services.
+	servicesValuesFile string
+
+	// credentialValues is a values document with the chart's generated or stored
+	// credentials, and credentials are those to keep in the credentials Secret, see
+	// resolveCredentials.
+	credentialValues []byte
+	credentials      []storedCredential
+
+	// decryptedValues holds the plaintext of the encrypted ValuesFiles by path, see
+	// decryptValuesFiles.
+	decryptedValues map[string][]byte
+
+	// patches are the Patches and PostRenderPatches, see resolvePatches, and
+	// scheduling the rules of the scheduling flags and Scheduling, see
+	// resolveScheduling. postRenderFile passes them to helm's post-renderer.
+	patches        []manifestPatch
+	scheduling     []schedulingRule
+	postRenderFile string
+
+	// provisioning is the resolved namespace governance, see
+	// resolveNamespaceProvisioning.
+	provisioning *namespaceProvisioning
+
+	// inlineValuesFile is the temporary file Values are written to for helm.
+	inlineValuesFile string
+
+	// nodePortOverrides move conflicting NodePorts to free ports
+	// ("sockShop.frontEnd.service.nodePort=30002"), see resolveNodePorts.
+	nodePortOverrides []string
+
+	// prerequisiteOverrides switch off the parts of the chart whose prerequisites are
+	// missing ("chaosExperiments.enabled=false"), see resolvePrerequisites.
+	prerequisiteOverrides []string
+
+	// fitOverrides are the requests and heap sizes scaled by -fit-to-cluster
+	// ("sockShop.carts.resources.requests.cpu=150m"), see resolveFitToCluster.
+	fitOverrides []string
+
+	// result is reported with -output json and -result-file.
+	result *installResult
+
+	// namespaceOverride wires the release namespace into the chart's namespace value
+	// ("namespaces.sockShop=foo"), see resolveNamespace.
+	namespaceOverride string
+}
+
+// chartPath returns the chart folder or archive that helm should render.
+func (c *Config) chartPath() string {
+	if c.resolvedChart != "" {
+		return c.resolvedChart
+	}
+	return filepath.Join(c.ChartsPath, c.FolderName)
+}
+
+// subcommands maps the optional first argument to its handler. Any other
+// invocation is an install driven by the flags below.
+var subcommands = map[string]func(args []string) error{
+	"package":      runPackage,
+	"config":       runConfigCommand,
+	"schema":       runSchema,
+	"catalog":      runCatalog,
+	"status":       runStatus,
+	"upgrade-path": runUpgradePath,
+	"forward":      runForward,
+	"credentials":  runCredentials,
+	"post-render":  runPostRender,
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := subcommands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatalf("%s failed: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
 	config := parseFlags()
 
+	err := run(config)
+	if resultErr := writeResult(config, err); resultErr != nil {
+		log.Printf("Warning: %v", resultErr)
+	}
+	if err != nil {
+		var integrityErr *chartIntegrityError
+		if errors.As(err, &integrityErr) {
+			log.Print(err)
+			os.Exit(exitIntegrityFailure)
+		}
+		log.Fatal(err)
+	}
+
+	if config.isRemoteChart() {
+		log.Printf("Successfully installed chart: %s", config.Chart)
+		return
+	}
+	log.Printf("Successfully installed chart from folder: %s", config.FolderName)
+}
+
+// run resolves the chart source and installs the chart. It is separate from main so
+// that deferred cleanup (extracted embedded charts) runs before the process exits.
+func run(config *Config) error {
+	config.result = &installResult{}
 	if err := validateConfig(config); err != nil {
-		log.Fatalf("Configuration error: %v", err)
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+	if err := decryptValuesFiles(config); err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+
+	if config.isRemoteChart() {
+		if err := fetchRemoteChart(config); err != nil {
+			return fmt.Errorf("Configuration error: %w", err)
+		}
+	} else {
+		cleanup, err := resolveChartsPath(config)
+		if err != nil {
+			return fmt.Errorf("Configuration error: %w", err)
+		}
+		defer cleanup()
+
+		if err := validateChartFolder(config); err != nil {
+			return fmt.Errorf("Configuration error: %w", err)
+		}
+	}
+
+	cleanupValues, err := writeInlineValues(config)
+	if err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+	defer cleanupValues()
+
+	if err := verifyChart(config); err != nil {
+		return err
+	}
+
+	cleanupProfile, err := resolveProfile(config)
+	if err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+	defer cleanupProfile()
+
+	cleanupComponents, err := resolveComponents(config)
+	if err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+	defer cleanupComponents()
+
+	cleanupInstance, err := resolveInstance(config)
+	if err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+	defer cleanupInstance()
+
+	if err := resolveNamespace(config); err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+
+	if err := resolveNamespaceProvisioning(config); err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+
+	if err := resolveScheduling(config); err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+
+	if err := resolvePatches(config); err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+
+	cleanupPostRender, err := writePostRenderSpec(config)
+	if err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+	defer cleanupPostRender()
+
+	if err := resolvePrerequisites(config); err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+
+	cleanupServices, err := resolveServices(config)
+	if err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+	defer cleanupServices()
+
+	if err := resolveCredentials(config); err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+
+	if err := resolveNodePorts(config); err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+
+	if err := resolveFitToCluster(config); err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
+	}
+
+	if err := prepareValues(config); err != nil {
+		return fmt.Errorf("Configuration error: %w", err)
 	}
 
 	if err := installChart(config); err != nil {
-		log.Fatalf("Installation failed: %v", err)
+		return fmt.Errorf("Installation failed: %w", err)
 	}
 
-	log.Printf("Successfully installed chart from folder: %s", config.FolderName)
+	return nil
 }
 
 func parseFlags() *Config {
-	config := &Config{}
-
-	flag.StringVar(&config.FolderName, "folder", "", "Name of the folder containing Helm chart (required)")
-	flag.StringVar(&config.ReleaseName, "release", "", "Helm release name (defaults to folder name)")
-	flag.StringVar(&config.Namespace, "namespace", defaultNamespace, "Kubernetes namespace to install into")
-	flag.StringVar(&config.ChartsPath, "charts-path", defaultChartsPath, "Base path where charts are located")
-	flag.StringVar(&config.ValuesFile, "values", "", "Path to custom values file")
-	flag.Var(&config.SetValues, "set", "Set values on command line (can be repeated: --set key=value --set key2=value2)")
-	flag.BoolVar(&config.DryRun, "dry-run", false, "Simulate installation without applying")
-	flag.BoolVar(&config.Wait, "wait", true, "Wait for resources to be ready")
-	flag.StringVar(&config.Timeout, "timeout", "20m", "Timeout for installation")
-	flag.BoolVar(&config.CreateNS, "create-namespace", true, "Create namespace if it doesn't exist")
-	flag.BoolVar(&config.Upgrade, "upgrade", true, "Use helm upgrade --install for idempotent installs (set to false to use helm install)")
-	flag.StringVar(&config.KubeConfig, "kubeconfig", "", "Path to kubeconfig file")
-	flag.StringVar(&config.KubeContext, "context", "", "Kubernetes context to use")
-
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: install-app [options]\n\n")
+	config, err := loadConfig(os.Args[1:], flag.ExitOnError)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	return config
+}
+
+// newInstallFlagSet registers the install flags, bound to the fields of config.
+func newInstallFlagSet(config *Config, errorHandling flag.ErrorHandling) *flag.FlagSet {
+	flags := flag.NewFlagSet("install-app", errorHandling)
+
+	flags.StringVar(&config.ConfigFile, "config", "", "Path to a YAML config file with install options (see README)")
+	flags.StringVar(&config.FolderName, "folder", "", "Name of the folder containing Helm chart (required unless -chart is set)")
+	flags.StringVar(&config.Chart, "chart", "", "Remote chart to install instead of a folder: an oci:// reference, or a chart name in -repo")
+	flags.StringVar(&config.Repo, "repo", "", "URL of a chart repository (index.yaml) to install -chart from")
+	flags.StringVar(&config.Version, "version", "", "Chart version to install, for remote charts or folders with version subfolders (defaults to the latest)")
+	flags.StringVar(&config.Profile, "profile", "", "Values profile shipped in the chart's profiles/ folder (e.g. local, kind, minikube, large), or auto to detect it from the cluster")
+	flags.Var(&config.Components, "components", "Only install these component groups of the chart's components.yaml, e.g. app,monitoring (comma-separated or repeated)")
+	flags.Var(&config.Skip, "skip", "Don't install these component groups, e.g. chaos,mcp (comma-separated or repeated)")
+	flags.Var(&config.Services, "services", "Only install these microservices and the services they depend on, e.g. catalogue,front-end (comma-separated or repeated)")
+	flags.StringVar(&config.Instance, "instance", "", "Instance id for running several copies of the chart in one cluster: suffixes its namespaces, release and cluster-scoped names and shifts its NodePorts")
+	flags.StringVar(&config.CacheDir, "cache-dir", defaultCacheDir(), "Directory remote charts are cached in")
+	flags.BoolVar(&config.PlainHTTP, "plain-http", false, "Use plain HTTP for OCI registries (local test registries)")
+	flags.StringVar(&config.ReleaseName, "release", "", "Helm release name (defaults to folder or chart name)")
+	flags.StringVar(&config.Namespace, "namespace", "", "Kubernetes namespace to install into (defaults to the chart's namespace value, or "+defaultNamespace+")")
+	flags.StringVar(&config.ChartsPath, "charts-path", "", "Base path where charts are located (defaults to the charts embedded in the binary, or "+defaultChartsPath+" if none are embedded)")
+	flags.Var(&config.ValuesFiles, "values", "Path to custom values file (can be repeated; later files win); age- and SOPS-encrypted files are decrypted in memory")
+	flags.StringVar(&config.AgeKeyFile, "age-key-file", "", "age identity file for encrypted values files (defaults to "+envName("age-key")+", SOPS_AGE_KEY or SOPS_AGE_KEY_FILE)")
+	flags.Var(&config.SetValues, "set", "Set values on command line (can be repeated: --set key=value --set key2=value2)")
+	flags.Var(&config.SetStringValues, "set-string", "Set STRING values on command line, e.g. totalChaosDuration=\"30\" stays a string (can be repeated)")
+	flags.Var(&config.SetFileValues, "set-file", "Set values from files: key=path sets key to the file contents (can be repeated)")
+	flags.Var(&config.SetJSONValues, "set-json", "Set JSON values on command line, e.g. key='{\"a\":1}' (can be repeated)")
+	flags.StringVar(&config.ValuesOutput, "values-output", "", "Write the final merged values to this file")
+	flags.BoolVar(&config.DryRun, "dry-run", false, "Simulate installation without applying")
+	flags.BoolVar(&config.Wait, "wait", true, "Wait for resources to be ready")
+	flags.StringVar(&config.Timeout, "timeout", "20m", "Timeout for installation")
+	flags.BoolVar(&config.CreateNS, "create-namespace", true, "Create namespace if it doesn't exist")
+	flags.BoolVar(&config.Upgrade, "upgrade", true, "Use helm upgrade --install for idempotent installs (set to false to use helm install)")
+	flags.StringVar(&config.KubeConfig, "kubeconfig", "", "Path to kubeconfig file")
+	flags.StringVar(&config.KubeContext, "context", "", "Kubernetes context to use")
+	flags.BoolVar(&config.AutoNodePort, "auto-nodeport", false, "Move NodePorts that are already allocated in the cluster to free ports instead of failing")
+	flags.StringVar(&config.PreflightMode, "preflight-mode", preflightFail, "Cluster capacity preflight: fail to abort when the rendered requests don't fit, warn, or off")
+	flags.BoolVar(&config.FitToCluster, "fit-to-cluster", false, "Scale CPU and memory requests and Java heap sizes down in proportion so the release fits the cluster's free capacity")
+	flags.StringVar(&config.Prerequisites, "prerequisites", prerequisitesFail, "When cluster prerequisites of the chart (CRDs, operators) are missing: fail, skip the parts needing them, or install them")
+	flags.StringVar(&config.Policy, "policy", "", "Policy file setting the severity (error, warn, off) of the built-in manifest rules and adding custom CEL rules")
+	flags.Var(&config.NodeSelector, "node-selector", "Node selector label key=value for the chart's pods (comma-separated or repeated)")
+	flags.Var(&config.Tolerations, "toleration", "Toleration for the chart's pods, written like a taint: key[=value][:effect] (comma-separated or repeated)")
+	flags.StringVar(&config.Affinity, "affinity", "", "Affinity for the chart's pods in JSON or YAML, or @file")
+	flags.StringVar(&config.PriorityClass, "priority-class", "", "Priority class for the chart's pods")
+	flags.StringVar(&config.SchedulingSelector, "scheduling-selector", "", "Only apply the scheduling flags to pods with these labels, e.g. name in (carts,orders)")
+	flags.StringVar(&config.PodSecurity, "pod-security", "", "Pod Security Admission level for the release's namespaces (privileged, baseline, restricted), or mode=level pairs, e.g. enforce=baseline,warn=restricted")
+	flags.Var(&config.NamespaceLabels, "namespace-label", "Label key=value for the release's namespaces (comma-separated or repeated)")
+	flags.Var(&config.NamespaceAnnotations, "namespace-annotation", "Annotation key=value for the release's namespaces (comma-separated or repeated)")
+	flags.StringVar(&config.NamespaceQuota, "namespace-quota", "", "Template of the ResourceQuota and LimitRange objects to keep in the release's namespaces")
+	flags.StringVar(&config.DefaultDeny, "default-deny", "", "Add a NetworkPolicy to the release's namespaces denying ingress from other namespaces (ingress), or egress to them too except DNS (all)")
+	flags.Var(&config.Patches, "patches", "Strategic merge or JSON6902 patch file, or directory of them, applied to the rendered manifests (can be repeated)")
+	flags.StringVar(&config.Output, "output", "text", "Output format: text, or json to print the install result to stdout")
+	flags.StringVar(&config.ResultFile, "result-file", "", "Write the install result as JSON to this file")
+	flags.BoolVar(&config.AllowUnverified, "allow-unverified", false, "Install even if the chart does not match the embedded checksum manifest or provenance file")
+	flags.StringVar(&config.Keyring, "keyring", "", "Keyring used to verify Helm provenance (.prov) files (defaults to helm's keyring)")
+	flags.BoolVar(&config.ValidateValues, "validate-values", true, "Validate the merged values against the chart's "+valuesSchemaFile+" (or a schema generated from values.yaml) before installing")
+	flags.Var(&config.ImagePullSecrets, "image-pull-secret", "Image pull secret to copy into the namespace (can be repeated; default "+defaultImagePullSecret+")")
+	flags.StringVar(&config.ImagePullSecretNamespace, "image-pull-secret-namespace", "kube-system", "Namespace image pull secrets are copied from")
+
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: install-app [options]\n")
+		fmt.Fprintf(os.Stderr, "       install-app package [options]\n")
+		fmt.Fprintf(os.Stderr, "       install-app catalog [options]\n")
+		fmt.Fprintf(os.Stderr, "       install-app status <release> [options]\n")
+		fmt.Fprintf(os.Stderr, "       install-app upgrade-path -folder <name> [options]\n")
+		fmt.Fprintf(os.Stderr, "       install-app forward <release> [options]\n")
+		fmt.Fprintf(os.Stderr, "       install-app config print [options]\n")
+		fmt.Fprintf(os.Stderr, "       install-app schema -folder <name> [options]\n\n")
 		fmt.Fprintf(os.Stderr, "A tool to install Helm charts from the packaged repository.\n\n")
-		fmt.Fprintf(os.Stderr, "Options:\n")
-		flag.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "Options (each can also be set as %s<FLAG_NAME>, or in the -config file):\n", envPrefix)
+		flags.PrintDefaults()
 		fmt.Fprintf(os.Stderr, "\nExamples:\n")
 		fmt.Fprintf(os.Stderr, "  # Install sock-shop chart into sock-shop namespace\n")
 		fmt.Fprintf(os.Stderr, "  install-app -folder sock-shop -namespace sock-shop\n\n")
@@ -88,73 +425,202 @@ func parseFlags() *Config {
 		fmt.Fprintf(os.Stderr, "  # Upgrade existing release\n")
 		fmt.Fprintf(os.Stderr, "  install-app -folder sock-shop -upgrade -namespace sock-shop\n\n")
 		fmt.Fprintf(os.Stderr, "  # Dry-run installation\n")
-		fmt.Fprintf(os.Stderr, "  install-app -folder sock-shop -dry-run\n")
+		fmt.Fprintf(os.Stderr, "  install-app -folder sock-shop -dry-run\n\n")
+		fmt.Fprintf(os.Stderr, "  # Install from a chart checkout instead of the embedded charts\n")
+		fmt.Fprintf(os.Stderr, "  install-app -folder sock-shop -charts-path ./charts\n\n")
+		fmt.Fprintf(os.Stderr, "  # Install from an OCI registry or a chart repository\n")
+		fmt.Fprintf(os.Stderr, "  install-app -chart oci://localhost:5000/charts/sock-shop -version 0.1.0 -plain-http\n")
+		fmt.Fprintf(os.Stderr, "  install-app -repo https://charts.example.com -chart sock-shop\n\n")
+		fmt.Fprintf(os.Stderr, "  # Install with the values profile matching the cluster (kind, minikube, ...)\n")
+		fmt.Fprintf(os.Stderr, "  install-app -folder sock-shop -profile auto\n\n")
+		fmt.Fprintf(os.Stderr, "  # Install from a config file and show the resolved configuration\n")
+		fmt.Fprintf(os.Stderr, "  install-app -config install.yaml\n")
+		fmt.Fprintf(os.Stderr, "  install-app config print -config install.yaml\n")
 	}
 
-	flag.Parse()
+	return flags
+}
 
-	// Default release name to folder name if not specified
-	if config.ReleaseName == "" {
-		config.ReleaseName = config.FolderName
+// writeInlineValues writes the structured Values from the config file to a
+// temporary values file so they can be passed to helm with -f.
+func writeInlineValues(config *Config) (func(), error) {
+	if len(config.Values) == 0 {
+		return func() {}, nil
 	}
 
-	return config
+	f, err := os.CreateTemp("", "install-app-values-*.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write inline values: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(marshalYAML(config.Values)); err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to write inline values: %w", err)
+	}
+
+	config.inlineValuesFile = f.Name()
+	return func() { os.Remove(f.Name()) }, nil
+}
+
+// helmValuesArgs returns the values flags shared by `helm template` and the install:
+// the instance values, the profile, the component toggles, the selected services,
+// the credentials, the values files, the inline values from the config file, then the
+// --set style expressions of setExpressions, which userValues applies in the order
+// helm does.
+func helmValuesArgs(config *Config) []string {
+	var args []string
+	if config.instanceValuesFile != "" {
+		args = append(args, "-f", config.instanceValuesFile)
+	}
+	if config.profileValuesFile != "" {
+		args = append(args, "-f", config.profileValuesFile)
+	}
+	if config.componentsValuesFile != "" {
+		args = append(args, "-f", config.componentsValuesFile)
+	}
+	if config.servicesValuesFile != "" {
+		args = append(args, "-f", config.servicesValuesFile)
+	}
+	if config.credentialValues != nil {
+		args = append(args, "-f", credentialValuesArg())
+	}
+	for i := range config.ValuesFiles {
+		args = append(args, "-f", valuesFileArg(config, i))
+	}
+	if config.inlineValuesFile != "" {
+		args = append(args, "-f", config.inlineValuesFile)
+	}
+	for _, set := range setExpressions(config) {
+		for _, expr := range set.exprs {
+			args = append(args, set.flag, expr)
+		}
+	}
+	return args
 }
 
 func validateConfig(config *Config) error {
-	if config.FolderName == "" {
-		return fmt.Errorf("folder name is required. Use -folder flag")
+	switch {
+	case config.FolderName == "" && config.Chart == "":
+		return fmt.Errorf("folder name is required. Use -folder flag (or -chart for a remote chart)")
+	case config.FolderName != "" && config.Chart != "":
+		return fmt.Errorf("-folder and -chart are mutually exclusive")
+	case config.Repo != "" && config.Chart == "":
+		return fmt.Errorf("-repo requires -chart to name the chart to install")
+	case config.Repo != "" && strings.HasPrefix(config.Chart, ociScheme):
+		return fmt.Errorf("-repo cannot be combined with an %s chart reference", ociScheme)
+	case config.Chart != "" && config.Repo == "" && !strings.HasPrefix(config.Chart, ociScheme):
+		return fmt.Errorf("-chart must be an %s reference unless -repo is set", ociScheme)
+	case config.Output != "" && config.Output != "text" && config.Output != "json":
+		return fmt.Errorf("invalid -output %q: must be text or json", config.Output)
+	case config.PreflightMode != "" && config.PreflightMode != preflightFail && config.PreflightMode != preflightWarn && config.PreflightMode != preflightOff:
+		return fmt.Errorf("invalid -preflight-mode %q: must be fail, warn or off", config.PreflightMode)
+	case config.Prerequisites != "" && config.Prerequisites != prerequisitesFail && config.Prerequisites != prerequisitesSkip && config.Prerequisites != prerequisitesInstall:
+		return fmt.Errorf("invalid -prerequisites %q: must be fail, skip or install", config.Prerequisites)
 	}
 
-	chartPath := filepath.Join(config.ChartsPath, config.FolderName)
+	if config.Instance != "" {
+		if err := validateInstanceID(config.Instance); err != nil {
+			return err
+		}
+	}
+
+	// Validate values files if specified
+	for _, valuesFile := range config.ValuesFiles {
+		if _, err := os.Stat(valuesFile); os.IsNotExist(err) {
+			return fmt.Errorf("values file not found: %s", valuesFile)
+		}
+	}
+	for _, expr := range config.SetFileValues {
+		for _, pair := range strings.Split(expr, ",") {
+			_, path, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("invalid -set-file %s: expected key=path", expr)
+			}
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				return fmt.Errorf("-set-file file not found: %s", path)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateChartFolder checks that the chart folder exists under ChartsPath and
+// looks like a Helm chart, and selects the requested version when the folder holds
+// several versions side by side.
+func validateChartFolder(config *Config) error {
+	chartPath := config.chartPath()
 	if _, err := os.Stat(chartPath); os.IsNotExist(err) {
 		return fmt.Errorf("chart folder not found: %s", chartPath)
 	}
 
-	// Check for Chart.yaml to verify it's a valid Helm chart
-	chartYaml := filepath.Join(chartPath, "Chart.yaml")
-	if _, err := os.Stat(chartYaml); os.IsNotExist(err) {
+	// Check for Chart.yaml (directly, or in version subfolders) to verify it's a valid Helm chart
+	versions, err := listChartVersions(config.ChartsPath, config.FolderName)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
 		return fmt.Errorf("not a valid Helm chart - Chart.yaml not found in: %s", chartPath)
 	}
 
-	// Validate values file if specified
-	if config.ValuesFile != "" {
-		if _, err := os.Stat(config.ValuesFile); os.IsNotExist(err) {
-			return fmt.Errorf("values file not found: %s", config.ValuesFile)
-		}
+	selected, err := selectChartVersion(versions, config.Version)
+	if err != nil {
+		return fmt.Errorf("chart folder %s: %w", chartPath, err)
 	}
+	log.Printf("Selected %s version %s", config.FolderName, selected.Version)
+	config.resolvedChart = selected.Path
+	config.resolvedVersion = selected.Version
 
 	return nil
 }
 
 func installChart(config *Config) error {
-	chartPath := filepath.Join(config.ChartsPath, config.FolderName)
-
-	// Pre-create namespace if requested, instead of relying on Helm's --create-namespace
-	// which fails with "already exists" error on upgrade --install when namespace was
-	// created outside of Helm
-	if config.CreateNS {
-		if err := ensureNamespace(config.Namespace, config.ReleaseName); err != nil {
-			log.Printf("Warning: failed to ensure namespace %s: %v", config.Namespace, err)
+	chartPath := config.chartPath()
+
+	// Render the chart to find every namespace it deploys to (its namespaces.* values,
+	// kube-system for metrics-server, ...) and the deployments to wait for.
+	resources, err := renderChart(config)
+	if err != nil {
+		log.Printf("Warning: %v; only preparing namespace %s", err, config.Namespace)
+	}
+	namespaces, owned := targetNamespaces(config, resources)
+	log.Printf("Chart deploys to namespaces: %s", strings.Join(namespaces, ", "))
+
+	// Check the rendered objects against the policy rules, that the cluster serves
+	// their APIs and that the pods will fit before creating anything, rather than
+	// failing halfway or waiting for the rollout to time out on Pending pods.
+	if resources != nil {
+		checkSchedulingTargets(config, resources)
+		checkPatchTargets(config, resources)
+		if err := checkPolicy(config, resources); err != nil {
+			return err
+		}
+		if err := preflightCompatibility(config, resources); err != nil {
+			return err
 		}
 	}
+	if err := preflightCapacity(config, resources); err != nil {
+		return err
+	}
 
-	// Copy jfrog-registry imagePullSecret from kube-system into the target namespace
-	// so pods can pull images from JFrog without waiting for jfrog-secret-sync.
-	ensureImagePullSecret(config.Namespace)
+	if err := prepareNamespaces(config, resources, namespaces, owned); err != nil {
+		return err
+	}
+
+	if err := storeCredentials(config); err != nil {
+		return err
+	}
 
 	// Clean up any stuck Helm release before attempting install.
-	if err := cleanupStuckRelease(config.ReleaseName, config.Namespace); err != nil {
+	if err := cleanupStuckRelease(config); err != nil {
 		log.Printf("Warning: stuck release cleanup failed: %v", err)
 	}
 
 	// Adopt any pre-existing resources so Helm can manage them on upgrade --install.
 	// Prevents "invalid ownership metadata" errors when resources were left behind
 	// from a previous Helm release purged without deleting the underlying resources.
-	if config.Upgrade {
-		if err := adoptExistingResources(config); err != nil {
-			log.Printf("Warning: failed to adopt existing resources: %v", err)
-		}
+	if config.Upgrade && resources != nil {
+		adoptExistingResources(config, resources)
 	}
 
 	// Build helm command
@@ -171,13 +637,13 @@ func installChart(config *Config) error {
 
 	// Namespace is pre-created by ensureNamespace(), no need for --create-namespace
 
-	if config.ValuesFile != "" {
-		args = append(args, "-f", config.ValuesFile)
-	}
+	args = append(args, helmValuesArgs(config)...)
 
-	for _, setValue := range config.SetValues {
-		args = append(args, "--set", setValue)
+	postRenderer, err := postRendererArgs(config)
+	if err != nil {
+		return err
 	}
+	args = append(args, postRenderer...)
 
 	if config.DryRun {
 		args = append(args, "--dry-run")
@@ -202,48 +668,91 @@ func installChart(config *Config) error {
 
 	log.Printf("Executing: helm %s", strings.Join(args, " "))
 
-	cmd := exec.Command("helm", args...)
-	cmd.Stdout = os.Stdout
+	cmd, closePipes, err := helmCommand(config, args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = config.progressOutput()
 	cmd.Stderr = os.Stderr
-
-	if err := cmd.Run(); err != nil {
+	err = cmd.Run()
+	closePipes()
+	if err != nil {
 		return err
 	}
 
 	// If --wait was requested, use kubectl rollout status instead of Helm's
 	// built-in wait which suffers from client-go rate limiter bugs in v3.14
 	if config.Wait {
-		if err := waitForDeployments(config.Namespace, config.Timeout); err != nil {
+		deployments := renderedDeployments(resources)
+		if resources == nil {
+			deployments = listDeployments(config, namespaces)
+		}
+		if err := waitForDeployments(config, deployments); err != nil {
 			return fmt.Errorf("deployments not ready: %w", err)
 		}
 	}
 
+	if !config.DryRun && resources != nil {
+		access, err := summarizeAccess(config, resources)
+		if err != nil {
+			log.Printf("Warning: failed to summarize access: %v", err)
+			return nil
+		}
+		config.result.Access = access
+		log.Printf("Access:")
+		printAccess(config.progressOutput(), access)
+	}
+
 	return nil
 }
 
-// waitForDeployments waits for all deployments in the namespace to be ready
-// using kubectl rollout status, which doesn't suffer from Helm's rate limiter bug.
-func waitForDeployments(namespace, timeout string) error {
-	if timeout == "" {
-		timeout = "15m"
+// renderedDeployments returns the Deployments among the rendered chart resources.
+func renderedDeployments(resources []k8sResource) []k8sResource {
+	var deployments []k8sResource
+	for _, res := range resources {
+		if res.Kind == "Deployment" {
+			deployments = append(deployments, res)
+		}
 	}
+	return deployments
+}
 
-	log.Printf("Waiting for all deployments in namespace %s to be ready (timeout: %s)...", namespace, timeout)
+// listDeployments returns every deployment in the namespaces, for when the chart's
+// own deployments are unknown because it could not be rendered.
+func listDeployments(config *Config, namespaces []string) []k8sResource {
+	var deployments []k8sResource
+	for _, ns := range namespaces {
+		listCmd := exec.Command("kubectl", kubectlArgs(config, "get", "deployments", "-n", ns, "-o", "jsonpath={.items[*].metadata.name}")...)
+		out, err := listCmd.Output()
+		if err != nil {
+			log.Printf("Warning: failed to list deployments in namespace %s: %v", ns, err)
+			continue
+		}
+		for _, name := range strings.Fields(string(out)) {
+			deployments = append(deployments, k8sResource{Kind: "Deployment", Name: name, Namespace: ns})
+		}
+	}
+	return deployments
+}
 
-	// Get list of deployments
-	listCmd := exec.Command("kubectl", "get", "deployments", "-n", namespace, "-o", "jsonpath={.items[*].metadata.name}")
-	out, err := listCmd.Output()
-	if err != nil {
-		return fmt.Errorf("failed to list deployments: %w", err)
+// waitForDeployments waits for the deployments to be ready using kubectl rollout
+// status, which doesn't suffer from Helm's rate limiter bug.
+func waitForDeployments(config *Config, deployments []k8sResource) error {
+	timeout, out := config.Timeout, config.progressOutput()
+	if timeout == "" {
+		timeout = "15m"
 	}
 
-	deployments := strings.Fields(string(out))
 	if len(deployments) == 0 {
-		log.Printf("No deployments found in namespace %s, skipping wait", namespace)
+		log.Printf("No deployments found, skipping wait")
 		return nil
 	}
 
-	log.Printf("Found %d deployments: %s", len(deployments), strings.Join(deployments, ", "))
+	names := make([]string, len(deployments))
+	for i, d := range deployments {
+		names[i] = d.Namespace + "/" + d.Name
+	}
+	log.Printf("Waiting for %d deployments to be ready (timeout: %s): %s", len(deployments), timeout, strings.Join(names, ", "))
 
 	// Wait for all deployments concurrently so slow Java services don't serialize the wait
 	type result struct {
@@ -253,18 +762,18 @@ func waitForDeployments(namespace, timeout string) error {
 	results := make(chan result, len(deployments))
 
 	for _, dep := range deployments {
-		go func(d string) {
-			log.Printf("Waiting for deployment %s...", d)
-			waitCmd := exec.Command("kubectl", "rollout", "status", "deployment/"+d,
-				"-n", namespace, "--timeout="+timeout)
-			waitCmd.Stdout = os.Stdout
+		go func(d k8sResource) {
+			log.Printf("Waiting for deployment %s/%s...", d.Namespace, d.Name)
+			waitCmd := exec.Command("kubectl", kubectlArgs(config, "rollout", "status", "deployment/"+d.Name,
+				"-n", d.Namespace, "--timeout="+timeout)...)
+			waitCmd.Stdout = out
 			waitCmd.Stderr = os.Stderr
 			if err := waitCmd.Run(); err != nil {
-				results <- result{d, fmt.Errorf("deployment %s not ready: %w", d, err)}
+				results <- result{d.Name, fmt.Errorf("deployment %s/%s not ready: %w", d.Namespace, d.Name, err)}
 				return
 			}
-			log.Printf("Deployment %s is ready", d)
-			results <- result{d, nil}
+			log.Printf("Deployment %s/%s is ready", d.Namespace, d.Name)
+			results <- result{d.Name, nil}
 		}(dep)
 	}
 
@@ -280,20 +789,21 @@ func waitForDeployments(namespace, timeout string) error {
 		return fmt.Errorf("%s", strings.Join(errs, "; "))
 	}
 
-	log.Printf("All deployments in namespace %s are ready", namespace)
+	log.Printf("All deployments are ready")
 	return nil
 }
 
 // cleanupStuckRelease checks if a Helm release exists in a broken state
 // (pending-install, pending-upgrade, pending-rollback, or failed) and
 // uninstalls it so that the next "helm upgrade --install" can succeed.
-func cleanupStuckRelease(releaseName, namespace string) error {
+func cleanupStuckRelease(config *Config) error {
+	releaseName, namespace := config.ReleaseName, config.Namespace
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	// Get release status via helm
-	statusCmd := exec.CommandContext(ctx, "helm", "status", releaseName,
-		"-n", namespace, "-o", "json")
+	statusCmd := exec.CommandContext(ctx, "helm", helmKubeArgs(config, "status", releaseName,
+		"-n", namespace, "-o", "json")...)
 	out, err := statusCmd.Output()
 	if err != nil {
 		// Release doesn't exist — nothing to clean up
@@ -316,9 +826,9 @@ func cleanupStuckRelease(releaseName, namespace string) error {
 	}
 
 	log.Printf("Uninstalling stuck release %s in namespace %s", releaseName, namespace)
-	uninstallCmd := exec.CommandContext(ctx, "helm", "uninstall", releaseName,
-		"-n", namespace, "--no-hooks")
-	uninstallCmd.Stdout = os.Stdout
+	uninstallCmd := exec.CommandContext(ctx, "helm", helmKubeArgs(config, "uninstall", releaseName,
+		"-n", namespace, "--no-hooks")...)
+	uninstallCmd.Stdout = config.progressOutput()
 	uninstallCmd.Stderr = os.Stderr
 	if err := uninstallCmd.Run(); err != nil {
 		// helm uninstall can fail when the release secret is corrupted or partially
@@ -327,7 +837,7 @@ func cleanupStuckRelease(releaseName, namespace string) error {
 		// performs a clean install instead of failing with
 		// "'<release>' has no deployed releases".
 		log.Printf("helm uninstall failed (%v), falling back to deleting Helm state secrets", err)
-		if secretErr := deleteHelmStateSecrets(ctx, releaseName, namespace); secretErr != nil {
+		if secretErr := deleteHelmStateSecrets(ctx, config); secretErr != nil {
 			return fmt.Errorf("failed to uninstall stuck release %s: helm uninstall: %w; secret delete: %v", releaseName, err, secretErr)
 		}
 		log.Printf("Successfully removed Helm state secrets for release %s", releaseName)
@@ -340,17 +850,18 @@ func cleanupStuckRelease(releaseName, namespace string) error {
 
 // deleteHelmStateSecrets removes all Helm release secrets for a given release name,
 // which is the fallback when "helm uninstall" itself fails on a corrupted release.
-func deleteHelmStateSecrets(ctx context.Context, releaseName, namespace string) error {
-	listCmd := exec.CommandContext(ctx, "kubectl", "get", "secret",
+func deleteHelmStateSecrets(ctx context.Context, config *Config) error {
+	releaseName, namespace := config.ReleaseName, config.Namespace
+	listCmd := exec.CommandContext(ctx, "kubectl", kubectlArgs(config, "get", "secret",
 		"-n", namespace,
 		"-l", fmt.Sprintf("name=%s,owner=helm", releaseName),
-		"-o", "jsonpath={.items[*].metadata.name}")
-	out, err := listCmd.Output()
+		"-o", "jsonpath={.items[*].metadata.name}")...)
+	list, err := listCmd.Output()
 	if err != nil {
 		return fmt.Errorf("failed to list Helm state secrets: %w", err)
 	}
 
-	names := strings.Fields(string(out))
+	names := strings.Fields(string(list))
 	if len(names) == 0 {
 		log.Printf("No Helm state secrets found for release %s in namespace %s", releaseName, namespace)
 		return nil
@@ -358,25 +869,26 @@ func deleteHelmStateSecrets(ctx context.Context, releaseName, namespace string)
 
 	log.Printf("Deleting Helm state secrets: %s", strings.Join(names, ", "))
 	deleteArgs := append([]string{"delete", "secret", "-n", namespace}, names...)
-	deleteCmd := exec.CommandContext(ctx, "kubectl", deleteArgs...)
-	deleteCmd.Stdout = os.Stdout
+	deleteCmd := exec.CommandContext(ctx, "kubectl", kubectlArgs(config, deleteArgs...)...)
+	deleteCmd.Stdout = config.progressOutput()
 	deleteCmd.Stderr = os.Stderr
 	return deleteCmd.Run()
 }
 
 // ensureNamespace creates the namespace if it doesn't already exist and ensures
 // it has the required Helm ownership labels and annotations so Helm can adopt it.
-func ensureNamespace(namespace, releaseName string) error {
+func ensureNamespace(config *Config, namespace string) error {
+	releaseName, releaseNamespace := config.ReleaseName, config.Namespace
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
 	// Check if namespace exists
-	checkCmd := exec.Command("kubectl", "get", "namespace", namespace)
+	checkCmd := exec.Command("kubectl", kubectlArgs(config, "get", "namespace", namespace)...)
 	if err := checkCmd.Run(); err != nil {
 		// Create namespace
 		log.Printf("Creating namespace: %s", namespace)
-		createCmd := exec.CommandContext(ctx, "kubectl", "create", "namespace", namespace)
-		createCmd.Stdout = os.Stdout
+		createCmd := exec.CommandContext(ctx, "kubectl", kubectlArgs(config, "create", "namespace", namespace)...)
+		createCmd.Stdout = config.progressOutput()
 		createCmd.Stderr = os.Stderr
 		if err := createCmd.Run(); err != nil {
 			return fmt.Errorf("failed to create namespace: %w", err)
@@ -387,19 +899,19 @@ func ensureNamespace(namespace, releaseName string) error {
 
 	// Add Helm ownership labels and annotations so Helm can adopt the namespace
 	log.Printf("Labeling namespace %s for Helm ownership", namespace)
-	labelCmd := exec.CommandContext(ctx, "kubectl", "label", "namespace", namespace,
-		"app.kubernetes.io/managed-by=Helm", "--overwrite")
-	labelCmd.Stdout = os.Stdout
+	labelCmd := exec.CommandContext(ctx, "kubectl", kubectlArgs(config, "label", "namespace", namespace,
+		"app.kubernetes.io/managed-by=Helm", "--overwrite")...)
+	labelCmd.Stdout = config.progressOutput()
 	labelCmd.Stderr = os.Stderr
 	if err := labelCmd.Run(); err != nil {
 		return fmt.Errorf("failed to label namespace: %w", err)
 	}
 
-	annotateCmd := exec.CommandContext(ctx, "kubectl", "annotate", "namespace", namespace,
+	annotateCmd := exec.CommandContext(ctx, "kubectl", kubectlArgs(config, "annotate", "namespace", namespace,
 		fmt.Sprintf("meta.helm.sh/release-name=%s", releaseName),
-		fmt.Sprintf("meta.helm.sh/release-namespace=%s", namespace),
-		"--overwrite")
-	annotateCmd.Stdout = os.Stdout
+		fmt.Sprintf("meta.helm.sh/release-namespace=%s", releaseNamespace),
+		"--overwrite")...)
+	annotateCmd.Stdout = config.progressOutput()
 	annotateCmd.Stderr = os.Stderr
 	if err := annotateCmd.Run(); err != nil {
 		return fmt.Errorf("failed to annotate namespace: %w", err)
@@ -412,41 +924,22 @@ func ensureNamespace(namespace, releaseName string) error {
 // then labels/annotates any that already exist in the cluster without Helm ownership metadata.
 // This prevents "invalid ownership metadata" errors on upgrade --install when resources were
 // left behind after a previous release was purged without deleting the K8s resources.
-func adoptExistingResources(config *Config) error {
-	chartPath := filepath.Join(config.ChartsPath, config.FolderName)
-
-	args := []string{"template", config.ReleaseName, chartPath, "--namespace", config.Namespace}
-	if config.ValuesFile != "" {
-		args = append(args, "-f", config.ValuesFile)
-	}
-	for _, setValue := range config.SetValues {
-		args = append(args, "--set", setValue)
-	}
-
-	log.Printf("Discovering chart resources via: helm %s", strings.Join(args, " "))
-	cmd := exec.Command("helm", args...)
-	out, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("helm template failed: %w", err)
-	}
-
-	resources := parseHelmTemplateOutput(string(out))
+func adoptExistingResources(config *Config, resources []k8sResource) {
 	if len(resources) == 0 {
 		log.Printf("No resources discovered from chart template")
-		return nil
+		return
 	}
 
 	log.Printf("Discovered %d resources from chart template", len(resources))
 	adopted := 0
 	for _, res := range resources {
-		if adoptResource(res, config.ReleaseName, config.Namespace) {
+		if adoptResource(config, res) {
 			adopted++
 		}
 	}
 	if adopted > 0 {
 		log.Printf("Adopted %d pre-existing resources for Helm release %s", adopted, config.ReleaseName)
 	}
-	return nil
 }
 
 // k8sResource represents a Kubernetes resource extracted from helm template output.
@@ -454,6 +947,9 @@ type k8sResource struct {
 	Kind      string
 	Name      string
 	Namespace string
+
+	// Object is the full manifest, when the resource was rendered by renderChart.
+	Object map[string]interface{}
 }
 
 // parseHelmTemplateOutput parses multi-document YAML from `helm template` and
@@ -508,34 +1004,52 @@ func parseHelmTemplateOutput(output string) []k8sResource {
 
 // adoptResource labels/annotates a pre-existing K8s resource with Helm ownership metadata.
 // Returns true if the resource existed and was adopted.
-func adoptResource(res k8sResource, releaseName, releaseNamespace string) bool {
+func adoptResource(config *Config, res k8sResource) bool {
+	releaseName, releaseNamespace := config.ReleaseName, config.Namespace
 	resourceType := strings.ToLower(res.Kind)
 	ns := res.Namespace
 	if ns == "" {
 		ns = releaseNamespace
 	}
 
-	getArgs := []string{"get", resourceType, res.Name, "-n", ns, "--no-headers", "--ignore-not-found"}
-	out, err := exec.Command("kubectl", getArgs...).Output()
+	getArgs := []string{"get", resourceType, res.Name, "-n", ns, "--ignore-not-found", "-o", "json"}
+	out, err := exec.Command("kubectl", kubectlArgs(config, getArgs...)...).Output()
 	if err != nil || strings.TrimSpace(string(out)) == "" {
 		return false
 	}
 
+	// Never take over an object another release owns, e.g. another instance's object
+	// in a namespace the instances share: helm then reports the conflict instead.
+	var existing struct {
+		Metadata struct {
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(out, &existing); err == nil {
+		owner := existing.Metadata.Annotations["meta.helm.sh/release-name"]
+		ownerNamespace := existing.Metadata.Annotations["meta.helm.sh/release-namespace"]
+		if owner != "" && (owner != releaseName || ownerNamespace != releaseNamespace) {
+			log.Printf("Warning: not adopting %s/%s (ns=%s): it belongs to Helm release %s in namespace %s",
+				res.Kind, res.Name, ns, owner, ownerNamespace)
+			return false
+		}
+	}
+
 	log.Printf("Adopting existing %s/%s (ns=%s) for Helm release %s", res.Kind, res.Name, ns, releaseName)
 
-	labelCmd := exec.Command("kubectl", "label", resourceType, res.Name, "-n", ns,
-		"app.kubernetes.io/managed-by=Helm", "--overwrite")
-	labelCmd.Stdout = os.Stdout
+	labelCmd := exec.Command("kubectl", kubectlArgs(config, "label", resourceType, res.Name, "-n", ns,
+		"app.kubernetes.io/managed-by=Helm", "--overwrite")...)
+	labelCmd.Stdout = config.progressOutput()
 	labelCmd.Stderr = os.Stderr
 	if err := labelCmd.Run(); err != nil {
 		log.Printf("Warning: failed to label %s/%s: %v", res.Kind, res.Name, err)
 	}
 
-	annotateCmd := exec.Command("kubectl", "annotate", resourceType, res.Name, "-n", ns,
+	annotateCmd := exec.Command("kubectl", kubectlArgs(config, "annotate", resourceType, res.Name, "-n", ns,
 		fmt.Sprintf("meta.helm.sh/release-name=%s", releaseName),
 		fmt.Sprintf("meta.helm.sh/release-namespace=%s", releaseNamespace),
-		"--overwrite")
-	annotateCmd.Stdout = os.Stdout
+		"--overwrite")...)
+	annotateCmd.Stdout = config.progressOutput()
 	annotateCmd.Stderr = os.Stderr
 	if err := annotateCmd.Run(); err != nil {
 		log.Printf("Warning: failed to annotate %s/%s: %v", res.Kind, res.Name, err)
@@ -543,7 +1057,8 @@ func adoptResource(res k8sResource, releaseName, releaseNamespace string) bool {
 	return true
 }
 
-// ListAvailableCharts lists all available charts in the charts path
+// ListAvailableCharts lists all available charts in the charts path, including
+// folders that hold one chart per version subfolder
 func ListAvailableCharts(chartsPath string) ([]string, error) {
 	var charts []string
 
@@ -554,8 +1069,8 @@ func ListAvailableCharts(chartsPath string) ([]string, error) {
 
 	for _, entry := range entries {
 		if entry.IsDir() {
-			chartYaml := filepath.Join(chartsPath, entry.Name(), "Chart.yaml")
-			if _, err := os.Stat(chartYaml); err == nil {
+			versions, err := listChartVersions(chartsPath, entry.Name())
+			if err == nil && len(versions) > 0 {
 				charts = append(charts, entry.Name())
 			}
 		}
@@ -564,23 +1079,21 @@ func ListAvailableCharts(chartsPath string) ([]string, error) {
 	return charts, nil
 }
 
-// ensureImagePullSecret copies the jfrog-registry secret from kube-system into the
-// target namespace so that pods can pull images immediately without waiting for
-// the jfrog-secret-sync controller's 60s reconciliation cycle.
-func ensureImagePullSecret(namespace string) {
-	secretName := "jfrog-registry"
-	sourceNS := "kube-system"
-
+// ensureImagePullSecret copies an image pull secret (jfrog-registry from kube-system
+// by default) into the target namespace so that pods can pull images immediately
+// without waiting for the jfrog-secret-sync controller's 60s reconciliation cycle.
+func ensureImagePullSecret(config *Config, secretName, namespace string) {
+	sourceNS := config.ImagePullSecretNamespace
 	// Check if secret already exists in target namespace
-	checkCmd := exec.Command("kubectl", "get", "secret", secretName, "-n", namespace)
+	checkCmd := exec.Command("kubectl", kubectlArgs(config, "get", "secret", secretName, "-n", namespace)...)
 	if checkCmd.Run() == nil {
 		log.Printf("Secret %s already exists in namespace %s", secretName, namespace)
 		return
 	}
 
 	// Get the dockerconfigjson from kube-system
-	getCmd := exec.Command("kubectl", "get", "secret", secretName, "-n", sourceNS,
-		"-o", "jsonpath={.data.\\.dockerconfigjson}")
+	getCmd := exec.Command("kubectl", kubectlArgs(config, "get", "secret", secretName, "-n", sourceNS,
+		"-o", "jsonpath={.data.\\.dockerconfigjson}")...)
 	out, err := getCmd.Output()
 	if err != nil || len(out) == 0 {
 		log.Printf("Warning: could not read %s from %s: %v", secretName, sourceNS, err)
@@ -588,11 +1101,11 @@ func ensureImagePullSecret(namespace string) {
 	}
 
 	// Create the secret in target namespace using the same dockerconfigjson
-	createCmd := exec.Command("kubectl", "create", "secret", "generic", secretName,
+	createCmd := exec.Command("kubectl", kubectlArgs(config, "create", "secret", "generic", secretName,
 		"--namespace", namespace,
 		"--type=kubernetes.io/dockerconfigjson",
 		"--from-literal=.dockerconfigjson=PLACEHOLDER",
-		"--dry-run=client", "-o", "yaml")
+		"--dry-run=client", "-o", "yaml")...)
 	yamlOut, err := createCmd.Output()
 	if err != nil {
 		log.Printf("Warning: failed to generate secret YAML: %v", err)
@@ -600,8 +1113,8 @@ func ensureImagePullSecret(namespace string) {
 	}
 
 	// Use kubectl apply with the raw secret data patched in via a simpler approach
-	applyCmd := exec.Command("kubectl", "get", "secret", secretName, "-n", sourceNS,
-		"-o", "yaml")
+	applyCmd := exec.Command("kubectl", kubectlArgs(config, "get", "secret", secretName, "-n", sourceNS,
+		"-o", "yaml")...)
 	secretYAML, err := applyCmd.Output()
 	if err != nil {
 		log.Printf("Warning: failed to get source secret: %v", err)
@@ -621,7 +1134,7 @@ func ensureImagePullSecret(namespace string) {
 	}
 	_ = yamlOut // suppress unused
 
-	applyFinal := exec.Command("kubectl", "apply", "-f", "-")
+	applyFinal := exec.Command("kubectl", kubectlArgs(config, "apply", "-f", "-")...)
 	applyFinal.Stdin = strings.NewReader(strings.Join(filtered, "\n"))
 	if output, err := applyFinal.CombinedOutput(); err != nil {
 		log.Printf("Warning: failed to apply secret to %s: %v (%s)", namespace, err, string(output))
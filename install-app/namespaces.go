@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// namespaceValueAnnotation is the Chart.yaml annotation naming the value that holds
+// the namespace the chart's main workloads are deployed to, e.g.
+//
+//	annotations:
+//	  install-app/namespace-value: namespaces.sockShop
+//
+// install-app keeps that value and the release namespace in step.
+const namespaceValueAnnotation = "install-app/namespace-value"
+
+// resolveNamespace reconciles -namespace with the chart's namespace value. An
+// explicit -namespace is wired into the value; without one the release is stored in
+// the namespace the value names. Conflicting explicit settings are an error rather
+// than a release stored apart from its workloads.
+func resolveNamespace(config *Config) error {
+	annotations, err := chartAnnotations(config.chartPath())
+	if err != nil {
+		return err
+	}
+	key := annotations[namespaceValueAnnotation]
+	if key == "" {
+		if config.Namespace == "" {
+			config.Namespace = defaultNamespace
+		}
+		return nil
+	}
+
+	overrides, err := userValues(config)
+	if err != nil {
+		return err
+	}
+	userNamespace, userSet := lookupValue(overrides, key)
+
+	switch {
+	case config.Namespace == "" && userSet:
+		ns, ok := userNamespace.(string)
+		if !ok || ns == "" {
+			return fmt.Errorf("%s must be a namespace name, got %v", key, userNamespace)
+		}
+		config.Namespace = ns
+	case config.Namespace == "":
+		values, err := computeValues(config)
+		if err != nil {
+			return err
+		}
+		ns, _ := lookupValue(values, key)
+		if s, ok := ns.(string); ok && s != "" {
+			config.Namespace = s
+		} else {
+			config.Namespace = defaultNamespace
+		}
+		existing, err := existingReleaseNamespace(config)
+		if err != nil {
+			return err
+		}
+		if existing != "" && existing != config.Namespace {
+			// Releases installed before the chart named its namespace live elsewhere;
+			// a second release in the new namespace would take over their objects.
+			log.Printf("Warning: release %s is stored in namespace %s, not %s from the chart's %s value; "+
+				"keeping it there. To move it, uninstall it and install again, or pass -namespace",
+				config.ReleaseName, existing, config.Namespace, key)
+			config.Namespace = existing
+			return nil
+		}
+		log.Printf("Using namespace %s from the chart's %s value", config.Namespace, key)
+	case userSet && userNamespace != config.Namespace:
+		return fmt.Errorf("-namespace %s conflicts with %s=%v set in the values: the release "+
+			"would be stored in %s while the chart deploys its workloads to %v. Drop one of "+
+			"the two, or set them to the same namespace", config.Namespace, key, userNamespace,
+			config.Namespace, userNamespace)
+	default:
+		config.namespaceOverride = key + "=" + config.Namespace
+	}
+	return nil
+}
+
+// existingReleaseNamespace returns the namespace the release is already stored in,
+// or "" for a new release. A release in several namespaces is an error unless one
+// of them is config.Namespace.
+func existingReleaseNamespace(config *Config) (string, error) {
+	releases, err := listReleases(config.ReleaseName, "", config.KubeConfig, config.KubeContext)
+	if err != nil {
+		log.Printf("Warning: could not look for an existing release %s: %v", config.ReleaseName, err)
+		return "", nil
+	}
+	switch len(releases) {
+	case 0:
+		return "", nil
+	case 1:
+		return releases[0].Namespace, nil
+	}
+	for _, r := range releases {
+		if r.Namespace == config.Namespace {
+			return r.Namespace, nil
+		}
+	}
+	return "", fmt.Errorf("release %s exists in several namespaces, use -namespace to pick one", config.ReleaseName)
+}
+
+// chartAnnotations returns the string annotations of a chart's Chart.yaml.
+func chartAnnotations(chartPath string) (map[string]string, error) {
+	data, err := readChartFile(chartPath, "Chart.yaml")
+	if err != nil {
+		return nil, err
+	}
+	doc, err := parseYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse Chart.yaml: %w", err)
+	}
+	chart, _ := doc.(map[string]interface{})
+	raw, _ := chart["annotations"].(map[string]interface{})
+	annotations := make(map[string]string, len(raw))
+	for key, value := range raw {
+		if s, ok := value.(string); ok {
+			annotations[key] = s
+		}
+	}
+	return annotations, nil
+}
+
+// lookupValue returns the value at a dotted path such as "namespaces.sockShop".
+func lookupValue(values map[string]interface{}, path string) (interface{}, bool) {
+	var node interface{} = values
+	for _, key := range strings.Split(path, ".") {
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if node, ok = m[key]; !ok {
+			return nil, false
+		}
+	}
+	return node, true
+}
+
+// targetNamespaces returns every namespace the rendered chart deploys to, release
+// namespace first. owned reports which of them the release itself creates
+// (the release namespace and rendered Namespace objects); the others, such as
+// kube-system, are only deployed into.
+func targetNamespaces(config *Config, resources []k8sResource) (namespaces []string, owned map[string]bool) {
+	owned = map[string]bool{config.Namespace: true}
+	seen := map[string]bool{config.Namespace: true}
+	for _, res := range resources {
+		ns := res.Namespace
+		if res.Kind == "Namespace" {
+			ns = res.Name
+			owned[ns] = true
+		}
+		if ns != "" {
+			seen[ns] = true
+		}
+	}
+
+	for ns := range seen {
+		if ns != config.Namespace {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	sort.Strings(namespaces)
+	return append([]string{config.Namespace}, namespaces...), owned
+}
+
+// prepareNamespaces creates (and labels for Helm adoption) the namespaces the release
+// owns, reconciles their labels, quotas and network policies, and copies the image
+// pull secrets into every namespace the chart targets.
+func prepareNamespaces(config *Config, resources []k8sResource, namespaces []string, owned map[string]bool) error {
+	network, err := newReleaseNetwork(config, namespaces, resources)
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		// Pre-create namespace if requested, instead of relying on Helm's --create-namespace
+		// which fails with "already exists" error on upgrade --install when namespace was
+		// created outside of Helm
+		if config.CreateNS && owned[ns] {
+			if err := ensureNamespace(config, ns); err != nil {
+				log.Printf("Warning: failed to ensure namespace %s: %v", ns, err)
+			}
+		}
+		if owned[ns] {
+			if err := provisionNamespace(config, ns, network); err != nil {
+				return err
+			}
+		}
+
+		// Copy imagePullSecrets (jfrog-registry by default) from kube-system into the target
+		// namespace so pods can pull images from JFrog without waiting for jfrog-secret-sync.
+		if ns == config.ImagePullSecretNamespace {
+			continue
+		}
+		for _, secretName := range config.ImagePullSecrets {
+			ensureImagePullSecret(config, secretName, ns)
+		}
+	}
+	return nil
+}
+
+// renderChart runs `helm template` with the install's values and returns the
+// resources the release will contain.
+func renderChart(config *Config) ([]k8sResource, error) {
+	args := []string{"template", config.ReleaseName, config.chartPath(), "--namespace", config.Namespace}
+	args = append(args, helmValuesArgs(config)...)
+	postRenderer, err := postRendererArgs(config)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, postRenderer...)
+
+	log.Printf("Discovering chart resources via: helm %s", strings.Join(args, " "))
+	cmd, closePipes, err := helmCommand(config, args...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	closePipes()
+	if err != nil {
+		return nil, fmt.Errorf("helm template failed: %w", err)
+	}
+
+	var resources []k8sResource
+	if docs, err := parseYAMLDocuments(out); err == nil {
+		resources = manifestResources(docs)
+	} else {
+		log.Printf("Warning: failed to parse rendered manifests, falling back to kind/name scan: %v", err)
+		resources = parseHelmTemplateOutput(string(out))
+	}
+	for i := range resources {
+		if resources[i].Namespace == "" && !clusterScopedKinds[resources[i].Kind] {
+			resources[i].Namespace = config.Namespace
+		}
+	}
+	return resources, nil
+}
+
+// manifestResources returns the Kubernetes objects among parsed YAML documents.
+func manifestResources(docs []interface{}) []k8sResource {
+	var resources []k8sResource
+	for _, doc := range docs {
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		kind, _ := obj["kind"].(string)
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		name, _ := metadata["name"].(string)
+		namespace, _ := metadata["namespace"].(string)
+		if kind != "" && name != "" {
+			resources = append(resources, k8sResource{Kind: kind, Name: name, Namespace: namespace, Object: obj})
+		}
+	}
+	return resources
+}
+
+// clusterScopedKinds are the cluster-scoped kinds charts commonly render.
+var clusterScopedKinds = map[string]bool{
+	"Namespace":                      true,
+	"ClusterRole":                    true,
+	"ClusterRoleBinding":             true,
+	"CustomResourceDefinition":       true,
+	"APIService":                     true,
+	"PersistentVolume":               true,
+	"StorageClass":                   true,
+	"PriorityClass":                  true,
+	"ValidatingWebhookConfiguration": true,
+	"MutatingWebhookConfiguration":   true,
+	"IngressClass":                   true,
+	"RuntimeClass":                   true,
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+const (
+	nodePortRangeStart = 30000
+	nodePortRangeSize  = 2768 // 30000-32767, the Kubernetes default
+)
+
+// nodePortAssignment is a NodePort the release requests, as reported in the result.
+type nodePortAssignment struct {
+	Service string `json:"service"` // namespace/name
+	Port    int64  `json:"port"`
+	// Value is the values path the port is set by, if any.
+	Value string `json:"value,omitempty"`
+	// Requested is the port the chart asked for when -auto-nodeport replaced it.
+	Requested int64 `json:"requested,omitempty"`
+}
+
+// renderedNodePort is a fixed NodePort of a rendered Service.
+type renderedNodePort struct {
+	Service k8sResource
+	Port    int64
+}
+
+// resolveNodePorts checks the fixed NodePorts of the rendered chart against those
+// allocated in the cluster. Conflicts fail the install with the full list or, with
+// -auto-nodeport, are moved to free ports through their nodePort values.
+func resolveNodePorts(config *Config) error {
+	resources, err := renderChart(config)
+	if err != nil {
+		log.Printf("Warning: %v; skipping NodePort check", err)
+		return nil
+	}
+	requested := serviceNodePorts(resources)
+	if len(requested) == 0 {
+		return nil
+	}
+
+	// The release's own Services keep their ports on upgrade.
+	own := map[string]bool{}
+	for _, p := range requested {
+		own[p.Service.Namespace+"/"+p.Service.Name] = true
+	}
+	used, err := clusterNodePorts(config, own)
+	if err != nil {
+		log.Printf("Warning: %v; skipping NodePort check", err)
+		config.result.NodePorts = nodePortResult(requested, nil, nil)
+		return nil
+	}
+
+	values, err := computeValues(config)
+	if err != nil {
+		return err
+	}
+	paths := map[int64][]string{}
+	for _, p := range valuesNodePorts(values) {
+		paths[p.Port] = append(paths[p.Port], p.Path)
+	}
+
+	var conflicts []renderedNodePort
+	for _, p := range requested {
+		if _, ok := used[p.Port]; ok {
+			conflicts = append(conflicts, p)
+		}
+	}
+	if len(conflicts) == 0 {
+		config.result.NodePorts = nodePortResult(requested, paths, nil)
+		return nil
+	}
+
+	if !config.AutoNodePort {
+		lines := make([]string, len(conflicts))
+		for i, c := range conflicts {
+			lines[i] = fmt.Sprintf("  %d (%s/%s%s) is used by service %s", c.Port, c.Service.Namespace,
+				c.Service.Name, valuesHint(paths[c.Port]), used[c.Port])
+		}
+		return fmt.Errorf("NodePorts already allocated in the cluster:\n%s\nuse -auto-nodeport to pick free "+
+			"ports, or set them with -set", strings.Join(lines, "\n"))
+	}
+
+	taken := map[int64]bool{}
+	for port := range used {
+		taken[port] = true
+	}
+	for _, p := range requested {
+		taken[p.Port] = true
+	}
+	assigned := map[int64]int64{}
+	for _, c := range conflicts {
+		if _, ok := assigned[c.Port]; ok {
+			continue
+		}
+		if len(paths[c.Port]) == 0 {
+			return fmt.Errorf("NodePort %d of service %s/%s is used by service %s and isn't set by a nodePort "+
+				"value, so it can't be reassigned", c.Port, c.Service.Namespace, c.Service.Name, used[c.Port])
+		}
+		port, ok := freeNodePort(c.Port, taken)
+		if !ok {
+			return fmt.Errorf("no free NodePort left for service %s/%s", c.Service.Namespace, c.Service.Name)
+		}
+		taken[port] = true
+		assigned[c.Port] = port
+		for _, path := range paths[c.Port] {
+			config.nodePortOverrides = append(config.nodePortOverrides, fmt.Sprintf("%s=%d", path, port))
+		}
+		log.Printf("NodePort %d of service %s/%s is used by service %s, using %d instead",
+			c.Port, c.Service.Namespace, c.Service.Name, used[c.Port], port)
+	}
+	config.result.NodePorts = nodePortResult(requested, paths, assigned)
+	return nil
+}
+
+// serviceNodePorts returns the fixed NodePorts of the rendered Services.
+func serviceNodePorts(resources []k8sResource) []renderedNodePort {
+	var ports []renderedNodePort
+	for _, res := range resources {
+		if res.Kind != "Service" {
+			continue
+		}
+		spec, _ := res.Object["spec"].(map[string]interface{})
+		list, _ := spec["ports"].([]interface{})
+		for _, item := range list {
+			port, _ := item.(map[string]interface{})
+			if n, ok := jsonNumber(port["nodePort"]); ok && n > 0 {
+				ports = append(ports, renderedNodePort{Service: res, Port: int64(n)})
+			}
+		}
+	}
+	return ports
+}
+
+// clusterNodePorts maps the NodePorts allocated in the cluster to their Services,
+// leaving out the own Services (namespace/name) of the release.
+func clusterNodePorts(config *Config, own map[string]bool) (map[int64]string, error) {
+	out, err := exec.Command("kubectl", kubectlArgs(config, "get", "services", "-A", "-o", "json")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+	var services struct {
+		Items []struct {
+			Metadata struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"metadata"`
+			Spec struct {
+				Ports []struct {
+					NodePort int64 `json:"nodePort"`
+				} `json:"ports"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &services); err != nil {
+		return nil, fmt.Errorf("failed to parse services: %w", err)
+	}
+
+	used := map[int64]string{}
+	for _, svc := range services.Items {
+		if own[svc.Metadata.Namespace+"/"+svc.Metadata.Name] {
+			continue
+		}
+		for _, port := range svc.Spec.Ports {
+			if port.NodePort != 0 {
+				used[port.NodePort] = svc.Metadata.Namespace + "/" + svc.Metadata.Name
+			}
+		}
+	}
+	return used, nil
+}
+
+// freeNodePort returns the first port after want that isn't taken, wrapping around
+// the NodePort range.
+func freeNodePort(want int64, taken map[int64]bool) (int64, bool) {
+	start := want - nodePortRangeStart
+	if start < 0 || start >= nodePortRangeSize {
+		start = 0
+	}
+	for i := int64(1); i <= nodePortRangeSize; i++ {
+		port := nodePortRangeStart + (start+i)%nodePortRangeSize
+		if !taken[port] {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// nodePortResult lists the release's NodePorts for the result, with the ports
+// -auto-nodeport replaced.
+func nodePortResult(requested []renderedNodePort, paths map[int64][]string, assigned map[int64]int64) []nodePortAssignment {
+	result := make([]nodePortAssignment, 0, len(requested))
+	for _, p := range requested {
+		a := nodePortAssignment{
+			Service: p.Service.Namespace + "/" + p.Service.Name,
+			Port:    p.Port,
+			Value:   strings.Join(paths[p.Port], ","),
+		}
+		if port, ok := assigned[p.Port]; ok {
+			a.Port, a.Requested = port, p.Port
+		}
+		result = append(result, a)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Service < result[j].Service })
+	return result
+}
+
+func valuesHint(paths []string) string {
+	if len(paths) == 0 {
+		return ""
+	}
+	return ", from " + strings.Join(paths, ", ")
+}
+
+// valueNodePort is a nodePort found in the values.
+type valueNodePort struct {
+	Path string
+	Port int64
+}
+
+// valuesNodePorts returns every integer nodePort value, sorted by path.
+func valuesNodePorts(values map[string]interface{}) []valueNodePort {
+	var ports []valueNodePort
+	var walk func(m map[string]interface{}, path string)
+	walk = func(m map[string]interface{}, path string) {
+		for _, key := range sortedKeys(m) {
+			child := joinValuesPath(path, key)
+			switch v := m[key].(type) {
+			case map[string]interface{}:
+				walk(v, child)
+			default:
+				if n, ok := jsonNumber(v); ok && key == "nodePort" && n > 0 {
+					ports = append(ports, valueNodePort{Path: child, Port: int64(n)})
+				}
+			}
+		}
+	}
+	walk(values, "")
+	return ports
+}
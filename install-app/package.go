@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// packageConfig holds the options of the `package` command.
+type packageConfig struct {
+	ChartsPath  string
+	FolderName  string
+	Destination string
+	URL         string
+	Push        string
+	PlainHTTP   bool
+	Sign        bool
+	Key         string
+	Keyring     string
+}
+
+// runPackage implements `install-app package`: it builds a .tgz archive for every
+// chart version, writes an index.yaml so the destination can be served as a classic chart
+// repository, and optionally pushes the archives to an OCI registry.
+func runPackage(args []string) error {
+	config := &packageConfig{}
+
+	flags := flag.NewFlagSet("package", flag.ExitOnError)
+	flags.StringVar(&config.ChartsPath, "charts-path", "", "Base path where charts are located (defaults to the embedded charts, or "+defaultChartsPath+")")
+	flags.StringVar(&config.FolderName, "folder", "", "Package only this chart folder (defaults to all charts)")
+	flags.StringVar(&config.Destination, "destination", "dist", "Directory to write chart archives and index.yaml to")
+	flags.StringVar(&config.URL, "url", "", "Base URL the repository will be served from (written into index.yaml)")
+	flags.StringVar(&config.Push, "push", "", "OCI registry to push archives to, e.g. oci://localhost:5000/charts")
+	flags.BoolVar(&config.PlainHTTP, "plain-http", false, "Use plain HTTP when pushing (local test registries)")
+	flags.BoolVar(&config.Sign, "sign", false, "Sign archives and write .prov provenance files")
+	flags.StringVar(&config.Key, "key", "", "Name of the signing key (with -sign)")
+	flags.StringVar(&config.Keyring, "keyring", "", "Secret keyring holding the signing key (with -sign)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: install-app package [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Package charts as .tgz archives with an index.yaml and optionally push them to an OCI registry.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		flags.PrintDefaults()
+		fmt.Fprintf(os.Stderr, "\nExamples:\n")
+		fmt.Fprintf(os.Stderr, "  # Build a chart repository in ./dist\n")
+		fmt.Fprintf(os.Stderr, "  install-app package -url https://charts.example.com\n\n")
+		fmt.Fprintf(os.Stderr, "  # Push to a local registry started with `make registry-up`\n")
+		fmt.Fprintf(os.Stderr, "  install-app package -push oci://localhost:5000/charts -plain-http\n")
+	}
+	flags.Parse(args)
+
+	if config.Push != "" && !strings.HasPrefix(config.Push, ociScheme) {
+		return fmt.Errorf("-push must be an %s reference, got %s", ociScheme, config.Push)
+	}
+	if config.Sign && config.Key == "" {
+		return fmt.Errorf("-sign requires -key")
+	}
+
+	source := &Config{ChartsPath: config.ChartsPath}
+	cleanup, err := resolveChartsPath(source)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	charts := []string{config.FolderName}
+	if config.FolderName == "" {
+		charts, err = ListAvailableCharts(source.ChartsPath)
+		if err != nil {
+			return err
+		}
+	}
+	if len(charts) == 0 {
+		return fmt.Errorf("no charts found in %s", source.ChartsPath)
+	}
+
+	if err := os.MkdirAll(config.Destination, 0o755); err != nil {
+		return fmt.Errorf("failed to create destination: %w", err)
+	}
+
+	var archives []string
+	for _, chart := range charts {
+		versions, err := listChartVersions(source.ChartsPath, chart)
+		if err != nil {
+			return err
+		}
+		for _, version := range versions {
+			archive, err := packageChart(config, version.Path)
+			if err != nil {
+				return err
+			}
+			archives = append(archives, archive)
+		}
+	}
+
+	indexArgs := []string{"repo", "index", config.Destination}
+	if config.URL != "" {
+		indexArgs = append(indexArgs, "--url", config.URL)
+	}
+	if err := runHelm(indexArgs...); err != nil {
+		return fmt.Errorf("failed to write index.yaml: %w", err)
+	}
+	log.Printf("Wrote %s", filepath.Join(config.Destination, "index.yaml"))
+
+	if config.Push == "" {
+		return nil
+	}
+	for _, archive := range archives {
+		pushArgs := []string{"push", archive, config.Push}
+		if config.PlainHTTP {
+			pushArgs = append(pushArgs, "--plain-http")
+		}
+		if err := runHelm(pushArgs...); err != nil {
+			return fmt.Errorf("failed to push %s: %w", archive, err)
+		}
+		log.Printf("Pushed %s to %s", filepath.Base(archive), config.Push)
+	}
+	return nil
+}
+
+// packageChart runs `helm package` for one chart folder and returns the archive path.
+func packageChart(config *packageConfig, chartPath string) (string, error) {
+	args := []string{"package", chartPath, "--destination", config.Destination}
+	if config.Sign {
+		args = append(args, "--sign", "--key", config.Key)
+		if config.Keyring != "" {
+			args = append(args, "--keyring", config.Keyring)
+		}
+	}
+
+	log.Printf("Executing: helm %s", strings.Join(args, " "))
+	cmd := exec.Command("helm", args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to package %s: %w", chartPath, err)
+	}
+	os.Stdout.Write(out)
+
+	// helm names the archive <name>-<version>.tgz from Chart.yaml and reports
+	// "Successfully packaged chart and saved it to: <path>".
+	const marker = "saved it to:"
+	for _, line := range strings.Split(string(out), "\n") {
+		if i := strings.Index(line, marker); i >= 0 {
+			return strings.TrimSpace(line[i+len(marker):]), nil
+		}
+	}
+	return "", fmt.Errorf("helm package did not report an archive for %s", chartPath)
+}
+
+// runHelm runs a helm command with output passed through to the terminal.
+func runHelm(args ...string) error {
+	log.Printf("Executing: helm %s", strings.Join(args, " "))
+	cmd := exec.Command("helm", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
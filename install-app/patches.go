@@ -0,0 +1,678 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// manifestPatch changes the rendered objects its target matches. Patch is a
+// strategic merge patch (a mapping) or a JSON6902 patch (a list of operations).
+type manifestPatch struct {
+	// Source is the file the patch came from, or "config" for the config file.
+	Source string      `json:"source,omitempty"`
+	Target patchTarget `json:"target"`
+	Patch  interface{} `json:"patch"`
+}
+
+// patchTarget selects objects by kind, and by name and namespace globs; empty fields
+// match every object.
+type patchTarget struct {
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+func (t patchTarget) String() string {
+	s := t.Kind
+	if s == "" {
+		s = "*"
+	}
+	if t.Namespace != "" {
+		return s + " " + t.Namespace + "/" + t.Name
+	}
+	if t.Name != "" {
+		return s + " " + t.Name
+	}
+	return s
+}
+
+// matches reports whether the target selects an object; namespace is the object's
+// namespace, or the release namespace for namespaced objects without one.
+func (t patchTarget) matches(kind, name, namespace string) bool {
+	if t.Kind != "" && t.Kind != kind {
+		return false
+	}
+	if ok, _ := path.Match(t.Name, name); t.Name != "" && !ok {
+		return false
+	}
+	if ok, _ := path.Match(t.Namespace, namespace); t.Namespace != "" && !ok {
+		return false
+	}
+	return true
+}
+
+// resolvePatches loads the -patches files and directories and the config file's
+// postRenderPatches. Helm's post-renderer applies them, see postRendererArgs.
+func resolvePatches(config *Config) error {
+	var patches []manifestPatch
+	for _, p := range config.Patches {
+		loaded, err := loadPatches(p)
+		if err != nil {
+			return err
+		}
+		patches = append(patches, loaded...)
+	}
+	for _, p := range config.PostRenderPatches {
+		p.Source = "config"
+		if err := validatePatch(&p); err != nil {
+			return fmt.Errorf("invalid postRenderPatches entry for %s: %w", p.Target, err)
+		}
+		patches = append(patches, p)
+	}
+	for _, p := range patches {
+		log.Printf("Patching %s with %s", p.Target, p.Source)
+	}
+	config.patches = patches
+	return nil
+}
+
+// loadPatches reads the patches of a file, or of the .yaml, .yml and .json files of a
+// directory in name order. Each document is either an object, which is a strategic
+// merge patch of the object with its kind, name and namespace, or a mapping with a
+// target and a patch.
+func loadPatches(p string) ([]manifestPatch, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, fmt.Errorf("patches not found: %w", err)
+	}
+	files := []string{p}
+	if info.IsDir() {
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read patches directory: %w", err)
+		}
+		files = nil
+		for _, e := range entries {
+			switch filepath.Ext(e.Name()) {
+			case ".yaml", ".yml", ".json":
+				if !e.IsDir() {
+					files = append(files, filepath.Join(p, e.Name()))
+				}
+			}
+		}
+		sort.Strings(files)
+	}
+
+	var patches []manifestPatch
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read patch: %w", err)
+		}
+		docs, err := parseYAMLDocuments(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse patch %s: %w", file, err)
+		}
+		for _, doc := range docs {
+			m, ok := doc.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("patch %s: documents must be objects or target/patch mappings", file)
+			}
+			patch := manifestPatch{Source: file}
+			if kind, _ := m["kind"].(string); kind != "" {
+				metadata, _ := m["metadata"].(map[string]interface{})
+				name, _ := metadata["name"].(string)
+				namespace, _ := metadata["namespace"].(string)
+				patch.Target = patchTarget{Kind: kind, Name: name, Namespace: namespace}
+				patch.Patch = m
+			} else {
+				raw, err := json.Marshal(m)
+				if err == nil {
+					err = json.Unmarshal(raw, &patch)
+				}
+				if err != nil {
+					return nil, fmt.Errorf("patch %s: %w", file, err)
+				}
+				patch.Source = file
+			}
+			if err := validatePatch(&patch); err != nil {
+				return nil, fmt.Errorf("patch %s for %s: %w", file, patch.Target, err)
+			}
+			patches = append(patches, patch)
+		}
+	}
+	return patches, nil
+}
+
+// validatePatch checks a patch and parses a patch given as a YAML or JSON string.
+func validatePatch(p *manifestPatch) error {
+	if s, ok := p.Patch.(string); ok {
+		parsed, err := parseYAML([]byte(s))
+		if err != nil {
+			return fmt.Errorf("invalid patch: %w", err)
+		}
+		p.Patch = parsed
+	}
+	p.Patch = normalizeNumbers(p.Patch)
+	switch patch := p.Patch.(type) {
+	case map[string]interface{}:
+		if p.Target.Kind == "" && p.Target.Name == "" {
+			return fmt.Errorf("a strategic merge patch needs a target kind or name")
+		}
+	case []interface{}:
+		for _, item := range patch {
+			op, _ := item.(map[string]interface{})
+			switch op["op"] {
+			case "add", "replace", "test":
+				if _, ok := op["value"]; !ok {
+					return fmt.Errorf("%s operation without a value", op["op"])
+				}
+			case "move", "copy":
+				if _, ok := op["from"].(string); !ok {
+					return fmt.Errorf("%s operation without from", op["op"])
+				}
+			case "remove":
+			default:
+				return fmt.Errorf("invalid JSON patch operation %v", op["op"])
+			}
+			if _, ok := op["path"].(string); !ok {
+				return fmt.Errorf("%s operation without a path", op["op"])
+			}
+		}
+	default:
+		return fmt.Errorf("patch must be a strategic merge mapping or a list of JSON patch operations")
+	}
+	return nil
+}
+
+// normalizeNumbers turns whole float64 numbers, as decoded from JSON, back into
+// integers so they render as 8080 rather than 8080.0.
+func normalizeNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			t[k] = normalizeNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range t {
+			t[i] = normalizeNumbers(child)
+		}
+	case float64:
+		if t == math.Trunc(t) && math.Abs(t) < 1<<53 {
+			return int64(t)
+		}
+	}
+	return v
+}
+
+// postRenderSpec is what the post-render command applies to the rendered manifests:
+// the scheduling rules, then the patches.
+type postRenderSpec struct {
+	Scheduling []schedulingRule `json:"scheduling,omitempty"`
+	Patches    []manifestPatch  `json:"patches,omitempty"`
+}
+
+// writePostRenderSpec writes the scheduling rules and patches to a file for the
+// post-render command, if there are any. The returned function removes the file.
+func writePostRenderSpec(config *Config) (func(), error) {
+	noop := func() {}
+	if len(config.scheduling) == 0 && len(config.patches) == 0 {
+		return noop, nil
+	}
+	data, err := json.Marshal(postRenderSpec{Scheduling: config.scheduling, Patches: config.patches})
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp("", "install-app-post-render-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write post-render spec: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to write post-render spec: %w", err)
+	}
+	config.postRenderFile = f.Name()
+	return func() { os.Remove(f.Name()) }, nil
+}
+
+// postRendererArgs makes helm pipe the rendered manifests through the post-render
+// command of this binary when there are scheduling rules or patches, so `helm
+// template` for discovery and the install both see the changed objects.
+func postRendererArgs(config *Config) ([]string, error) {
+	if config.postRenderFile == "" {
+		return nil, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("can't locate install-app for helm's post-renderer: %w", err)
+	}
+	return []string{
+		"--post-renderer", self,
+		"--post-renderer-args=post-render",
+		"--post-renderer-args=-spec=" + config.postRenderFile,
+		"--post-renderer-args=-namespace=" + config.Namespace,
+	}, nil
+}
+
+// checkPatchTargets warns about patches that match none of the rendered objects,
+// e.g. because of a typo or a microservice left out with -services.
+func checkPatchTargets(config *Config, resources []k8sResource) {
+	for _, p := range config.patches {
+		matched := 0
+		for _, res := range resources {
+			if p.Target.matches(res.Kind, res.Name, res.Namespace) {
+				matched++
+			}
+		}
+		if matched == 0 {
+			log.Printf("Warning: patch %s for %s matches no rendered object", p.Source, p.Target)
+		}
+	}
+}
+
+// runPostRender is helm's post-renderer: it reads the rendered manifests on stdin,
+// applies the scheduling rules and patches to the objects they target and writes the
+// manifests to stdout. Other documents pass through unchanged.
+func runPostRender(args []string) error {
+	var specFile, namespace string
+	flags := flag.NewFlagSet("post-render", flag.ExitOnError)
+	flags.StringVar(&specFile, "spec", "", "JSON file with the scheduling rules and patches, written by install-app")
+	flags.StringVar(&namespace, "namespace", "", "Release namespace, for objects without one")
+	flags.Parse(args)
+
+	data, err := os.ReadFile(specFile)
+	if err != nil {
+		return fmt.Errorf("failed to read post-render spec: %w", err)
+	}
+	var spec postRenderSpec
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("invalid post-render spec: %w", err)
+	}
+	for i := range spec.Patches {
+		spec.Patches[i].Patch = normalizeNumbers(spec.Patches[i].Patch)
+	}
+	for i, rule := range spec.Scheduling {
+		spec.Scheduling[i].Affinity, _ = normalizeNumbers(rule.Affinity).(map[string]interface{})
+		for j, t := range rule.Tolerations {
+			rule.Tolerations[j], _ = normalizeNumbers(t).(map[string]interface{})
+		}
+	}
+
+	manifests, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	out, err := postRender(manifests, spec, namespace)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// postRender applies scheduling rules and patches to a rendered manifest stream.
+func postRender(manifests []byte, spec postRenderSpec, namespace string) ([]byte, error) {
+	var b bytes.Buffer
+	for _, doc := range splitYAMLDocuments(manifests) {
+		b.WriteString("---\n")
+		parsed, err := parseYAML(doc)
+		obj, ok := parsed.(map[string]interface{})
+		if err != nil || !ok {
+			b.Write(doc)
+			b.WriteString("\n")
+			continue
+		}
+		kind, _ := obj["kind"].(string)
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		name, _ := metadata["name"].(string)
+		objectNamespace, _ := metadata["namespace"].(string)
+		if objectNamespace == "" && !clusterScopedKinds[kind] {
+			objectNamespace = namespace
+		}
+
+		matched := false
+		if labels, podSpec := podTemplate(kind, obj); podSpec != nil {
+			matched = applyScheduling(spec.Scheduling, labels, podSpec)
+		}
+		var patched interface{} = obj
+		for _, p := range spec.Patches {
+			if !p.Target.matches(kind, name, objectNamespace) {
+				continue
+			}
+			matched = true
+			if ops, ok := p.Patch.([]interface{}); ok {
+				patched, err = applyJSONPatch(patched, ops)
+			} else {
+				patched, err = strategicMerge(patched, copyValues(p.Patch), "")
+			}
+			if err != nil {
+				return nil, fmt.Errorf("patch %s on %s %s: %w", p.Source, kind, name, err)
+			}
+		}
+		if !matched {
+			b.Write(doc)
+			b.WriteString("\n")
+			continue
+		}
+		// Keep the "# Source:" comments helm puts above each document.
+		for _, line := range strings.Split(string(doc), "\n") {
+			if !strings.HasPrefix(line, "#") {
+				break
+			}
+			b.WriteString(line + "\n")
+		}
+		b.Write(marshalYAML(patched))
+	}
+	return b.Bytes(), nil
+}
+
+// strategicMergeKeys are the fields of the Kubernetes API whose lists strategic
+// merge patches merge by key instead of replacing, with the key of their items.
+var strategicMergeKeys = map[string]string{
+	"containers":                "name",
+	"initContainers":            "name",
+	"ephemeralContainers":       "name",
+	"env":                       "name",
+	"volumes":                   "name",
+	"volumeMounts":              "mountPath",
+	"volumeDevices":             "devicePath",
+	"imagePullSecrets":          "name",
+	"hostAliases":               "ip",
+	"topologySpreadConstraints": "topologyKey",
+	"resourceClaims":            "name",
+	"ports":                     "containerPort",
+}
+
+// strategicMerge merges patch into obj like kubectl's strategic merge patch: maps are
+// merged key by key and null deletes a key, the lists of strategicMergeKeys are
+// merged by key, other lists are replaced. The $patch directive replaces or deletes a
+// map, and replaces a list or deletes a list item. Other directives, such as
+// $retainKeys and $setElementOrder, are errors rather than being merged as fields.
+func strategicMerge(obj, patch interface{}, field string) (interface{}, error) {
+	switch p := patch.(type) {
+	case map[string]interface{}:
+		if err := checkPatchDirectives(p); err != nil {
+			return nil, err
+		}
+		switch p["$patch"] {
+		case "delete":
+			return nil, fmt.Errorf("$patch: delete can only delete a field of an object, not the object itself")
+		case "replace":
+			delete(p, "$patch")
+			return p, nil
+		}
+		delete(p, "$patch")
+		m, ok := obj.(map[string]interface{})
+		if !ok {
+			return p, nil
+		}
+		for k, v := range p {
+			if child, _ := v.(map[string]interface{}); v == nil || child != nil && child["$patch"] == "delete" {
+				delete(m, k)
+				continue
+			}
+			merged, err := strategicMerge(m[k], v, k)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			m[k] = merged
+		}
+		return m, nil
+	case []interface{}:
+		key, ok := strategicMergeKeys[field]
+		if !ok {
+			for _, item := range p {
+				if item, _ := item.(map[string]interface{}); item != nil && item["$patch"] != nil {
+					return nil, fmt.Errorf("$patch in a list that is replaced rather than merged by key")
+				}
+			}
+			return p, nil
+		}
+		list, _ := obj.([]interface{})
+		// Service ports are keyed by port, container ports by containerPort.
+		if field == "ports" && len(p) > 0 {
+			if item, _ := p[0].(map[string]interface{}); item != nil && item["containerPort"] == nil {
+				key = "port"
+			}
+		}
+		for _, item := range p {
+			patchItem, ok := item.(map[string]interface{})
+			if !ok {
+				return p, nil
+			}
+			if err := checkPatchDirectives(patchItem); err != nil {
+				return nil, err
+			}
+			if patchItem["$patch"] == "replace" {
+				var rest []interface{}
+				for _, other := range p {
+					if other, _ := other.(map[string]interface{}); other["$patch"] == nil {
+						rest = append(rest, other)
+					}
+				}
+				return rest, nil
+			}
+			index := -1
+			for i, existing := range list {
+				if existing, _ := existing.(map[string]interface{}); existing != nil && jsonEqual(existing[key], patchItem[key]) {
+					index = i
+					break
+				}
+			}
+			var err error
+			switch {
+			case patchItem["$patch"] == "delete":
+				if index >= 0 {
+					list = append(list[:index], list[index+1:]...)
+				}
+			case index >= 0:
+				list[index], err = strategicMerge(list[index], patchItem, "")
+			default:
+				var added interface{}
+				added, err = strategicMerge(map[string]interface{}{}, patchItem, "")
+				list = append(list, added)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+	return patch, nil
+}
+
+// checkPatchDirectives rejects the strategic merge directives strategicMerge doesn't
+// implement, which would otherwise end up in the manifest as fields.
+func checkPatchDirectives(p map[string]interface{}) error {
+	for k, v := range p {
+		if !strings.HasPrefix(k, "$") {
+			continue
+		}
+		if k != "$patch" {
+			return fmt.Errorf("unsupported strategic merge directive %s", k)
+		}
+		if v != "replace" && v != "delete" && v != "merge" {
+			return fmt.Errorf("unsupported $patch: %v", v)
+		}
+	}
+	return nil
+}
+
+// applyJSONPatch applies RFC 6902 operations to a document.
+func applyJSONPatch(doc interface{}, ops []interface{}) (interface{}, error) {
+	for _, item := range ops {
+		op, _ := item.(map[string]interface{})
+		target, _ := op["path"].(string)
+		var err error
+		switch op["op"] {
+		case "add":
+			doc, err = jsonPointerSet(doc, target, copyValues(op["value"]), true)
+		case "replace":
+			doc, err = jsonPointerSet(doc, target, copyValues(op["value"]), false)
+		case "remove":
+			doc, _, err = jsonPointerRemove(doc, target)
+		case "move", "copy":
+			from, _ := op["from"].(string)
+			var value interface{}
+			if op["op"] == "move" {
+				doc, value, err = jsonPointerRemove(doc, from)
+			} else {
+				value, err = jsonPointerGet(doc, from)
+				value = copyValues(value)
+			}
+			if err == nil {
+				doc, err = jsonPointerSet(doc, target, value, true)
+			}
+		case "test":
+			var value interface{}
+			if value, err = jsonPointerGet(doc, target); err == nil && !jsonEqual(value, op["value"]) {
+				err = fmt.Errorf("test failed: %s is %v, not %v", target, value, op["value"])
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", op["op"], target, err)
+		}
+	}
+	return doc, nil
+}
+
+// splitJSONPointer returns the unescaped tokens of a JSON pointer.
+func splitJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("JSON pointer %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens, nil
+}
+
+// listIndex parses a list index token; "-" is the end of the list when allowed.
+func listIndex(token string, length int, end bool) (int, error) {
+	if token == "-" && end {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || (i == length && !end) {
+		return 0, fmt.Errorf("invalid list index %s", token)
+	}
+	return i, nil
+}
+
+func jsonPointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := splitJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		switch c := doc.(type) {
+		case map[string]interface{}:
+			v, ok := c[t]
+			if !ok {
+				return nil, fmt.Errorf("no %s", t)
+			}
+			doc = v
+		case []interface{}:
+			i, err := listIndex(t, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, fmt.Errorf("can't index %s", t)
+		}
+	}
+	return doc, nil
+}
+
+// jsonPointerSet sets the value at pointer and returns the updated document. With add
+// a list index inserts and a missing map key is created; replace needs the target to
+// exist.
+func jsonPointerSet(doc interface{}, pointer string, value interface{}, add bool) (interface{}, error) {
+	tokens, err := splitJSONPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := jsonPointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch c := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := c[last]; !ok && !add {
+			return nil, fmt.Errorf("no %s", last)
+		}
+		c[last] = value
+		return doc, nil
+	case []interface{}:
+		i, err := listIndex(last, len(c), add)
+		if err != nil {
+			return nil, err
+		}
+		if !add {
+			c[i] = value
+			return doc, nil
+		}
+		list := append(c[:i:i], append([]interface{}{value}, c[i:]...)...)
+		return jsonPointerSet(doc, parentPointer, list, false)
+	}
+	return nil, fmt.Errorf("can't index %s", last)
+}
+
+// jsonPointerRemove removes the value at pointer and returns the updated document
+// and the removed value.
+func jsonPointerRemove(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := splitJSONPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil, fmt.Errorf("can't remove the whole document")
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := jsonPointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch c := parent.(type) {
+	case map[string]interface{}:
+		value, ok := c[last]
+		if !ok {
+			return nil, nil, fmt.Errorf("no %s", last)
+		}
+		delete(c, last)
+		return doc, value, nil
+	case []interface{}:
+		i, err := listIndex(last, len(c), false)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := c[i]
+		list := append(c[:i:i], c[i+1:]...)
+		doc, err = jsonPointerSet(doc, parentPointer, list, false)
+		return doc, value, err
+	}
+	return nil, nil, fmt.Errorf("can't index %s", last)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustParseYAML(t *testing.T, s string) interface{} {
+	t.Helper()
+	v, err := parseYAML([]byte(s))
+	if err != nil {
+		t.Fatalf("%v in %q", err, s)
+	}
+	return v
+}
+
+func TestStrategicMerge(t *testing.T) {
+	tests := []struct {
+		name, obj, patch, want string
+	}{
+		{"maps merge",
+			"spec:\n  replicas: 1\n  paused: false\n",
+			"spec:\n  replicas: 3\n  minReadySeconds: 5\n",
+			"spec:\n  replicas: 3\n  paused: false\n  minReadySeconds: 5\n"},
+		{"null deletes",
+			"metadata:\n  labels:\n    a: x\n    b: y\n",
+			"metadata:\n  labels:\n    a: null\n",
+			"metadata:\n  labels:\n    b: y\n"},
+		{"containers merge by name",
+			"containers:\n  - name: app\n    image: app:1\n  - name: sidecar\n    image: s:1\n",
+			"containers:\n  - name: sidecar\n    image: s:2\n  - name: extra\n    image: e:1\n",
+			"containers:\n  - name: app\n    image: app:1\n  - name: sidecar\n    image: s:2\n  - name: extra\n    image: e:1\n"},
+		{"env merges by name",
+			"env:\n  - name: A\n    value: \"1\"\n",
+			"env:\n  - name: A\n    value: \"2\"\n",
+			"env:\n  - name: A\n    value: \"2\"\n"},
+		{"container ports merge by containerPort",
+			"ports:\n  - containerPort: 80\n    name: http\n",
+			"ports:\n  - containerPort: 80\n    protocol: TCP\n",
+			"ports:\n  - containerPort: 80\n    name: http\n    protocol: TCP\n"},
+		{"service ports merge by port",
+			"ports:\n  - port: 80\n    targetPort: 8079\n",
+			"ports:\n  - port: 80\n    nodePort: 30001\n",
+			"ports:\n  - port: 80\n    targetPort: 8079\n    nodePort: 30001\n"},
+		{"other lists replace",
+			"args: [a, b]\n",
+			"args: [c]\n",
+			"args: [c]\n"},
+		{"delete directive",
+			"volumes:\n  - name: a\n  - name: b\n",
+			"volumes:\n  - name: a\n    $patch: delete\n",
+			"volumes:\n  - name: b\n"},
+		{"replace list directive",
+			"volumes:\n  - name: a\n  - name: b\n",
+			"volumes:\n  - $patch: replace\n  - name: c\n",
+			"volumes:\n  - name: c\n"},
+		{"replace map directive",
+			"resources:\n  limits:\n    cpu: 1\n  requests:\n    cpu: 1\n",
+			"resources:\n  $patch: replace\n  requests:\n    cpu: 2\n",
+			"resources:\n  requests:\n    cpu: 2\n"},
+		{"delete map directive",
+			"spec:\n  replicas: 1\n  strategy:\n    type: Recreate\n",
+			"spec:\n  strategy:\n    $patch: delete\n",
+			"spec:\n  replicas: 1\n"},
+		{"merge directive",
+			"spec:\n  replicas: 1\n",
+			"spec:\n  $patch: merge\n  paused: true\n",
+			"spec:\n  replicas: 1\n  paused: true\n"},
+		{"keyed list that doesn't exist yet",
+			"spec: {}\n",
+			"spec:\n  volumes:\n    - name: a\n      $patch: delete\n    - name: b\n",
+			"spec:\n  volumes:\n    - name: b\n"},
+	}
+	for _, tt := range tests {
+		got, err := strategicMerge(mustParseYAML(t, tt.obj), mustParseYAML(t, tt.patch), "")
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if want := mustParseYAML(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, want)
+		}
+	}
+}
+
+// TestStrategicMergeErrors checks that directives strategicMerge doesn't implement
+// fail instead of ending up in the manifest.
+func TestStrategicMergeErrors(t *testing.T) {
+	obj := "spec:\n  containers:\n    - name: app\n  args: [a]\n"
+	tests := []struct{ patch, err string }{
+		{"spec:\n  $retainKeys: [containers]\n", "unsupported strategic merge directive $retainKeys"},
+		{"spec:\n  $setElementOrder/containers:\n    - name: app\n", "unsupported strategic merge directive $setElementOrder/containers"},
+		{"spec:\n  $deleteFromPrimitiveList/args: [a]\n", "unsupported strategic merge directive"},
+		{"spec:\n  containers:\n    - name: app\n      $patch: remove\n", "unsupported $patch: remove"},
+		{"spec:\n  args:\n    - $patch: replace\n", "$patch in a list that is replaced"},
+		{"$patch: delete\n", "not the object itself"},
+	}
+	for _, tt := range tests {
+		_, err := strategicMerge(mustParseYAML(t, obj), mustParseYAML(t, tt.patch), "")
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%q: got error %v, want %q", tt.patch, err, tt.err)
+		}
+	}
+}
+
+// The cases are the examples of RFC 6902, appendix A.
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		name, doc, patch, want string
+	}{
+		{"add object member", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`,
+			`{"baz": "qux", "foo": "bar"}`},
+		{"add array element", `{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			`{"foo": ["bar", "qux", "baz"]}`},
+		{"append", `{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+			`{"foo": ["bar", ["abc", "def"]]}`},
+		{"remove object member", `{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`,
+			`{"foo": "bar"}`},
+		{"remove array element", `{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`,
+			`{"foo": ["bar", "baz"]}`},
+		{"replace", `{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			`{"baz": "boo", "foo": "bar"}`},
+		{"move value", `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			`[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			`{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`},
+		{"move array element", `{"foo": ["all", "grass", "cows", "eat"]}`,
+			`[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			`{"foo": ["all", "cows", "eat", "grass"]}`},
+		{"copy", `{"foo": {"bar": 1}}`, `[{"op": "copy", "from": "/foo", "path": "/baz"}]`,
+			`{"foo": {"bar": 1}, "baz": {"bar": 1}}`},
+		{"test", `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			`[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			`{"baz": "qux", "foo": ["a", 2, "c"]}`},
+		{"escaped keys", `{"a/b": 1, "m~n": 2}`,
+			`[{"op": "replace", "path": "/a~1b", "value": 3}, {"op": "remove", "path": "/m~0n"}]`,
+			`{"a/b": 3}`},
+		{"nested array", `{"spec": {"containers": [{"name": "a", "args": []}]}}`,
+			`[{"op": "add", "path": "/spec/containers/0/args/-", "value": "--debug"}]`,
+			`{"spec": {"containers": [{"name": "a", "args": ["--debug"]}]}}`},
+	}
+	for _, tt := range tests {
+		doc, _ := decodeJSONValue([]byte(tt.doc))
+		ops, _ := decodeJSONValue([]byte(tt.patch))
+		want, _ := decodeJSONValue([]byte(tt.want))
+		got, err := applyJSONPatch(doc, ops.([]interface{}))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, want)
+		}
+	}
+}
+
+func TestApplyJSONPatchErrors(t *testing.T) {
+	for _, patch := range []string{
+		`[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+		`[{"op": "replace", "path": "/missing", "value": 1}]`,
+		`[{"op": "remove", "path": "/list/5"}]`,
+		`[{"op": "add", "path": "/list/3", "value": 1}]`,
+		`[{"op": "test", "path": "/foo", "value": "other"}]`,
+		`[{"op": "remove", "path": "foo"}]`,
+		`[{"op": "remove", "path": ""}]`,
+		`[{"op": "move", "from": "/missing", "path": "/x"}]`,
+	} {
+		doc, _ := decodeJSONValue([]byte(`{"foo": "bar", "list": [1]}`))
+		ops, _ := decodeJSONValue([]byte(patch))
+		if _, err := applyJSONPatch(doc, ops.([]interface{})); err == nil {
+			t.Errorf("%s: expected an error", patch)
+		}
+	}
+}
+
+func TestPatchTargetMatches(t *testing.T) {
+	tests := []struct {
+		target                patchTarget
+		kind, name, namespace string
+		want                  bool
+	}{
+		{patchTarget{}, "Deployment", "carts", "sock-shop", true},
+		{patchTarget{Kind: "Deployment"}, "Service", "carts", "sock-shop", false},
+		{patchTarget{Name: "carts*"}, "Deployment", "carts-db", "sock-shop", true},
+		{patchTarget{Name: "carts"}, "Deployment", "carts-db", "sock-shop", false},
+		{patchTarget{Namespace: "sock-*"}, "Deployment", "carts", "sock-shop", true},
+		{patchTarget{Namespace: "monitoring"}, "Deployment", "carts", "sock-shop", false},
+	}
+	for _, tt := range tests {
+		if got := tt.target.matches(tt.kind, tt.name, tt.namespace); got != tt.want {
+			t.Errorf("%s matches %s %s/%s = %v, want %v", tt.target, tt.kind, tt.namespace, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoadPatches(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"01-object.yaml": "kind: Deployment\nmetadata:\n  name: carts\nspec:\n  replicas: 2\n",
+		"02-target.yaml": "target:\n  kind: Service\n  name: front-end\npatch:\n  - op: replace\n    path: /spec/type\n    value: NodePort\n",
+		"03-string.json": `{"target": {"name": "orders"}, "patch": "spec:\n  replicas: 3\n"}`,
+		"notes.txt":      "ignored",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patches, err := loadPatches(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var targets []string
+	for _, p := range patches {
+		targets = append(targets, p.Target.String())
+	}
+	if got, want := strings.Join(targets, ", "), "Deployment carts, Service front-end, * orders"; got != want {
+		t.Errorf("targets = %s, want %s", got, want)
+	}
+	if want := mustParseYAML(t, "spec:\n  replicas: 3\n"); !reflect.DeepEqual(patches[2].Patch, want) {
+		t.Errorf("string patch = %#v", patches[2].Patch)
+	}
+
+	for name, content := range map[string]string{
+		"untargeted.yaml": "patch:\n  spec: {}\n",
+		"bad-op.yaml":     "target:\n  kind: Service\npatch:\n  - op: frobnicate\n    path: /spec\n",
+		"no-value.yaml":   "target:\n  kind: Service\npatch:\n  - op: add\n    path: /spec\n",
+	} {
+		file := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadPatches(file); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestPostRender(t *testing.T) {
+	manifests := `---
+# Source: sock-shop/templates/carts.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: carts
+spec:
+  replicas: 1
+---
+# Source: sock-shop/templates/front-end.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: front-end
+spec:
+  type: LoadBalancer
+`
+	spec := postRenderSpec{Patches: []manifestPatch{
+		{Source: "a.yaml", Target: patchTarget{Kind: "Deployment", Name: "carts", Namespace: "sock-shop"},
+			Patch: mustParseYAML(t, "spec:\n  replicas: 2\n")},
+		{Source: "b.yaml", Target: patchTarget{Kind: "Deployment", Namespace: "other"},
+			Patch: mustParseYAML(t, "spec:\n  replicas: 9\n")},
+	}}
+	out, err := postRender([]byte(manifests), spec, "sock-shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := parseYAMLDocuments(out)
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, out)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("got %d documents:\n%s", len(docs), out)
+	}
+	if replicas := docs[0].(map[string]interface{})["spec"].(map[string]interface{})["replicas"]; replicas != int64(2) {
+		t.Errorf("replicas = %v:\n%s", replicas, out)
+	}
+	if !strings.Contains(string(out), "# Source: sock-shop/templates/carts.yaml\n") {
+		t.Errorf("the source comment of a patched object is lost:\n%s", out)
+	}
+	if !strings.Contains(string(out), "type: LoadBalancer") {
+		t.Errorf("an untargeted object changed:\n%s", out)
+	}
+
+	spec.Patches = []manifestPatch{{Source: "c.yaml", Target: patchTarget{Kind: "Service"},
+		Patch: mustParseYAML(t, "- op: test\n  path: /spec/type\n  value: ClusterIP\n")}}
+	if _, err := postRender([]byte(manifests), spec, "sock-shop"); err == nil || !strings.Contains(err.Error(), "c.yaml") {
+		t.Errorf("got error %v, want the failing patch named", err)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Severities of policy rules.
+const (
+	policyError = "error"
+	policyWarn  = "warn"
+	policyOff   = "off"
+)
+
+// ciProfiles are the profiles of throwaway clusters, where a LoadBalancer Service
+// stays pending forever. Docker Desktop and k3d, the "local" profile, serve
+// LoadBalancers on localhost.
+var ciProfiles = []string{"kind", "minikube"}
+
+// policyRule is a check run on every rendered object. Profiles limits the rule to
+// installs with one of those profiles.
+type policyRule struct {
+	Name     string
+	Severity string
+	Profiles []string
+	check    func(res k8sResource) []string
+}
+
+// builtinPolicyRules returns the built-in rules with their default severities. They
+// only warn, except for LoadBalancers on throwaway clusters, so that a chart which
+// installed before keeps installing; a policy file makes them errors.
+func builtinPolicyRules() []policyRule {
+	return []policyRule{
+		{Name: "image-tag", Severity: policyWarn, check: checkImageTags},
+		{Name: "resources", Severity: policyWarn, check: checkResources},
+		{Name: "privilege-escalation", Severity: policyWarn, check: checkPrivilegeEscalation},
+		{Name: "literal-credentials", Severity: policyWarn, check: checkLiteralCredentials},
+		{Name: "no-loadbalancer", Severity: policyError, Profiles: ciProfiles, check: checkLoadBalancers},
+	}
+}
+
+// policyFile is the -policy file: severities of the built-in rules, and custom rules.
+type policyFile struct {
+	// Rules maps a built-in rule to its severity, or to {severity, profiles}.
+	Rules  map[string]interface{} `json:"rules"`
+	Custom []customPolicyRule     `json:"custom"`
+}
+
+// customPolicyRule is a CEL expression that is true for compliant objects, with the
+// variables object (the manifest) and profile (the selected profile, or "").
+type customPolicyRule struct {
+	Name       string   `json:"name"`
+	Severity   string   `json:"severity"`
+	Kinds      []string `json:"kinds"`
+	Profiles   []string `json:"profiles"`
+	Expression string   `json:"expression"`
+	Message    string   `json:"message"`
+}
+
+// policyFinding is an object breaking a policy rule.
+type policyFinding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Object   string `json:"object"`
+	Message  string `json:"message"`
+}
+
+// loadPolicyRules returns the built-in rules with the severities of the policy file,
+// followed by its custom rules, whose expressions see profile.
+func loadPolicyRules(path, profile string) ([]policyRule, error) {
+	rules := builtinPolicyRules()
+	if path == "" {
+		return rules, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy file: %w", err)
+	}
+	var file policyFile
+	if err := decodeYAMLInto(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", path, err)
+	}
+
+	for _, name := range sortedKeys(file.Rules) {
+		i := slices.IndexFunc(rules, func(r policyRule) bool { return r.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("policy file %s: unknown rule %q", path, name)
+		}
+		switch setting := file.Rules[name].(type) {
+		case string:
+			rules[i].Severity = setting
+		case map[string]interface{}:
+			if severity, ok := setting["severity"].(string); ok {
+				rules[i].Severity = severity
+			}
+			// An empty list applies the rule with every profile.
+			if profiles, ok := setting["profiles"].([]interface{}); ok {
+				rules[i].Profiles = nil
+				for _, p := range profiles {
+					rules[i].Profiles = append(rules[i].Profiles, scalarString(p))
+				}
+			}
+		default:
+			return nil, fmt.Errorf("policy file %s: rule %s: want a severity or {severity, profiles}", path, name)
+		}
+	}
+
+	for _, c := range file.Custom {
+		if c.Name == "" || c.Expression == "" {
+			return nil, fmt.Errorf("policy file %s: custom rules need a name and an expression", path)
+		}
+		expr, err := compileCEL(c.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("policy file %s: rule %s: %w", path, c.Name, err)
+		}
+		rule := policyRule{Name: c.Name, Severity: c.Severity, Profiles: c.Profiles,
+			check: celPolicyCheck(expr, c, profile)}
+		if rule.Severity == "" {
+			rule.Severity = policyError
+		}
+		rules = append(rules, rule)
+	}
+
+	for _, r := range rules {
+		if r.Severity != policyError && r.Severity != policyWarn && r.Severity != policyOff {
+			return nil, fmt.Errorf("policy file %s: rule %s: invalid severity %q: must be error, warn or off", path, r.Name, r.Severity)
+		}
+	}
+	return rules, nil
+}
+
+// celPolicyCheck adapts a custom rule to a check.
+func celPolicyCheck(expr cel.Program, c customPolicyRule, profile string) func(res k8sResource) []string {
+	return func(res k8sResource) []string {
+		if len(c.Kinds) > 0 && !slices.Contains(c.Kinds, res.Kind) {
+			return nil
+		}
+		ok, err := evalCELBool(expr, map[string]interface{}{"object": res.Object, "profile": profile})
+		switch {
+		case err != nil:
+			return []string{fmt.Sprintf("can't evaluate %s: %v", c.Expression, err)}
+		case !ok && c.Message != "":
+			return []string{c.Message}
+		case !ok:
+			return []string{"violates " + c.Expression}
+		}
+		return nil
+	}
+}
+
+// checkPolicy runs the policy rules on the rendered objects before anything is
+// installed. Findings of error rules abort the install; the others are logged.
+func checkPolicy(config *Config, resources []k8sResource) error {
+	rules, err := loadPolicyRules(config.Policy, config.activeProfile)
+	if err != nil {
+		return err
+	}
+
+	var findings []policyFinding
+	for _, rule := range rules {
+		if rule.Severity == policyOff || (len(rule.Profiles) > 0 && !slices.Contains(rule.Profiles, config.activeProfile)) {
+			continue
+		}
+		for _, res := range resources {
+			for _, message := range rule.check(res) {
+				findings = append(findings, policyFinding{Rule: rule.Name, Severity: rule.Severity,
+					Object: objectName(res), Message: message})
+			}
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Severity < findings[j].Severity })
+	config.result.Policy = findings
+
+	var errs []string
+	for _, f := range findings {
+		message := fmt.Sprintf("%s: %s [%s]", f.Object, f.Message, f.Rule)
+		if f.Severity == policyError {
+			errs = append(errs, message)
+			continue
+		}
+		log.Printf("Warning: %s", message)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("the rendered chart has %d policy violations (set the severity of their rules in a "+
+			"-policy file to install anyway):\n  %s", len(errs), strings.Join(errs, "\n  "))
+	}
+	if len(findings) == 0 {
+		log.Printf("Policy: the rendered chart passes %d rules", len(rules))
+	}
+	return nil
+}
+
+// objectName names a rendered object as "Kind namespace/name".
+func objectName(res k8sResource) string {
+	if res.Namespace == "" {
+		return res.Kind + " " + res.Name
+	}
+	return res.Kind + " " + res.Namespace + "/" + res.Name
+}
+
+// podSpecOf returns the pod spec of a pod or a workload.
+func podSpecOf(res k8sResource) map[string]interface{} {
+	spec, _ := res.Object["spec"].(map[string]interface{})
+	switch res.Kind {
+	case "Pod":
+		return spec
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		return templatePodSpec(spec)
+	case "CronJob":
+		jobTemplate, _ := spec["jobTemplate"].(map[string]interface{})
+		jobSpec, _ := jobTemplate["spec"].(map[string]interface{})
+		return templatePodSpec(jobSpec)
+	}
+	return nil
+}
+
+// podContainers returns the containers and init containers of a pod spec.
+func podContainers(podSpec map[string]interface{}) []map[string]interface{} {
+	var containers []map[string]interface{}
+	for _, key := range []string{"initContainers", "containers"} {
+		list, _ := podSpec[key].([]interface{})
+		for _, c := range list {
+			if container, ok := c.(map[string]interface{}); ok {
+				containers = append(containers, container)
+			}
+		}
+	}
+	return containers
+}
+
+func checkImageTags(res k8sResource) []string {
+	var messages []string
+	for _, c := range podContainers(podSpecOf(res)) {
+		image, _ := c["image"].(string)
+		if image == "" || strings.Contains(image, "@") {
+			continue
+		}
+		// The tag follows the last ":" unless that belongs to a registry port.
+		name := image[strings.LastIndex(image, "/")+1:]
+		_, tag, tagged := strings.Cut(name, ":")
+		switch {
+		case !tagged:
+			messages = append(messages, fmt.Sprintf("container %s: image %s has no tag", c["name"], image))
+		case tag == "latest":
+			messages = append(messages, fmt.Sprintf("container %s: image %s uses the latest tag", c["name"], image))
+		}
+	}
+	return messages
+}
+
+func checkResources(res k8sResource) []string {
+	var messages []string
+	podSpec := podSpecOf(res)
+	containers, _ := podSpec["containers"].([]interface{})
+	for _, item := range containers {
+		c, _ := item.(map[string]interface{})
+		resources, _ := c["resources"].(map[string]interface{})
+		var missing []string
+		for _, key := range []string{"requests", "limits"} {
+			if m, _ := resources[key].(map[string]interface{}); len(m) == 0 {
+				missing = append(missing, key)
+			}
+		}
+		if len(missing) > 0 {
+			messages = append(messages, fmt.Sprintf("container %s has no resource %s", c["name"], strings.Join(missing, " or ")))
+		}
+	}
+	return messages
+}
+
+func checkPrivilegeEscalation(res k8sResource) []string {
+	var messages []string
+	for _, c := range podContainers(podSpecOf(res)) {
+		securityContext, _ := c["securityContext"].(map[string]interface{})
+		if allowed, ok := securityContext["allowPrivilegeEscalation"].(bool); !ok || allowed {
+			messages = append(messages, fmt.Sprintf("container %s doesn't set allowPrivilegeEscalation: false", c["name"]))
+		}
+	}
+	return messages
+}
+
+// credentialName matches the names of environment variables and Secret keys holding
+// credentials.
+var credentialName = regexp.MustCompile(`(?i)pass(word|wd)?$|password|secret|token|api_?key`)
+
+// wellKnownPasswords are default and placeholder passwords found in demo charts.
+var wellKnownPasswords = []string{"", "admin", "changeme", "default", "fake_password", "pass", "password",
+	"root", "secret", "test", "123456"}
+
+func checkLiteralCredentials(res k8sResource) []string {
+	var messages []string
+	if res.Kind == "Secret" {
+		// data holds the same keys as stringData, base64-encoded.
+		values := map[string]string{}
+		data, _ := res.Object["data"].(map[string]interface{})
+		for key, encoded := range data {
+			if decoded, err := base64.StdEncoding.DecodeString(scalarString(encoded)); err == nil {
+				values[key] = string(decoded)
+			}
+		}
+		stringData, _ := res.Object["stringData"].(map[string]interface{})
+		for key, value := range stringData {
+			values[key] = scalarString(value)
+		}
+		for _, key := range sortedStringKeys(values) {
+			value := values[key]
+			if credentialName.MatchString(key) && slices.Contains(wellKnownPasswords, strings.ToLower(value)) {
+				messages = append(messages, fmt.Sprintf("key %s holds the well-known password %q", key, value))
+			}
+		}
+		return messages
+	}
+	for _, c := range podContainers(podSpecOf(res)) {
+		env, _ := c["env"].([]interface{})
+		for _, item := range env {
+			e, _ := item.(map[string]interface{})
+			name, _ := e["name"].(string)
+			if _, literal := e["value"]; literal && credentialName.MatchString(name) {
+				messages = append(messages, fmt.Sprintf("container %s: %s is a literal value; take it from a Secret with valueFrom",
+					c["name"], name))
+			}
+		}
+	}
+	return messages
+}
+
+func checkLoadBalancers(res k8sResource) []string {
+	if res.Kind != "Service" {
+		return nil
+	}
+	spec, _ := res.Object["spec"].(map[string]interface{})
+	if spec["type"] == "LoadBalancer" {
+		return []string{"LoadBalancer Services stay pending on this cluster; use NodePort or ClusterIP"}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sockShopChart = "../charts/sock-shop"
+
+// TestShippedProfilesPassDefaultPolicy installs every profile of the sock-shop
+// chart against the built-in rules: a profile that breaks an error rule can't be
+// installed without a -policy file.
+func TestShippedProfilesPassDefaultPolicy(t *testing.T) {
+	profiles, err := listProfiles(sockShopChart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) == 0 {
+		t.Fatal("sock-shop has no profiles")
+	}
+	_, helmErr := exec.LookPath("helm")
+
+	for _, profile := range append([]string{""}, profiles...) {
+		name := profile
+		if name == "" {
+			name = "default"
+		}
+		t.Run(name, func(t *testing.T) {
+			config := &Config{
+				ChartsPath:    filepath.Dir(sockShopChart),
+				FolderName:    filepath.Base(sockShopChart),
+				ReleaseName:   "sock-shop",
+				Namespace:     "sock-shop",
+				activeProfile: profile,
+				result:        &installResult{},
+			}
+			if profile != "" {
+				config.profileValuesFile = filepath.Join(sockShopChart, profilesDir, profile+".yaml")
+			}
+
+			// The Services the values ask for, so that the check runs without helm.
+			values, err := computeValues(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkPolicy(config, valuesServices(values, "")); err != nil {
+				t.Errorf("values: %v", err)
+			}
+
+			if helmErr != nil {
+				t.Skip("helm not installed, skipping the rendered chart")
+			}
+			resources, err := renderChart(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkPolicy(config, resources); err != nil {
+				t.Errorf("rendered chart: %v", err)
+			}
+		})
+	}
+}
+
+// valuesServices returns a Service for every service.type in values.
+func valuesServices(values map[string]interface{}, path string) []k8sResource {
+	var services []k8sResource
+	for _, key := range sortedKeys(values) {
+		child, ok := values[key].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if serviceType, ok := child["type"].(string); ok && key == "service" {
+			services = append(services, k8sResource{Kind: "Service", Name: path, Namespace: "sock-shop",
+				Object: map[string]interface{}{"spec": map[string]interface{}{"type": serviceType}}})
+		}
+		services = append(services, valuesServices(child, strings.TrimPrefix(path+"."+key, "."))...)
+	}
+	return services
+}
+
+func TestNoLoadBalancerProfiles(t *testing.T) {
+	lb := k8sResource{Kind: "Service", Name: "front-end", Namespace: "sock-shop",
+		Object: map[string]interface{}{"spec": map[string]interface{}{"type": "LoadBalancer"}}}
+	tests := []struct {
+		profile string
+		fails   bool
+	}{
+		{"", false},
+		{"local", false},
+		{"large", false},
+		{"kind", true},
+		{"minikube", true},
+	}
+	for _, tt := range tests {
+		config := &Config{activeProfile: tt.profile, result: &installResult{}}
+		err := checkPolicy(config, []k8sResource{lb})
+		if (err != nil) != tt.fails {
+			t.Errorf("profile %q: got error %v, want failure %v", tt.profile, err, tt.fails)
+		}
+	}
+}
+
+func TestCheckLiteralCredentials(t *testing.T) {
+	secret := func(field string, values map[string]interface{}) k8sResource {
+		return k8sResource{Kind: "Secret", Name: "db", Object: map[string]interface{}{field: values}}
+	}
+	tests := []struct {
+		name string
+		res  k8sResource
+		want int
+	}{
+		{"stringData", secret("stringData", map[string]interface{}{"password": "admin"}), 1},
+		{"data", secret("data", map[string]interface{}{"MYSQL_ROOT_PASSWORD": "ZmFrZV9wYXNzd29yZA=="}), 1},
+		{"data empty", secret("data", map[string]interface{}{"password": ""}), 1},
+		{"data strong", secret("data", map[string]interface{}{"password": "czNjcjN0LXhZeg=="}), 0},
+		{"data not a credential", secret("data", map[string]interface{}{"username": "YWRtaW4="}), 0},
+		{"data invalid base64", secret("data", map[string]interface{}{"password": "!!"}), 0},
+		{"env literal", k8sResource{Kind: "Pod", Name: "p", Object: map[string]interface{}{
+			"spec": map[string]interface{}{"containers": []interface{}{map[string]interface{}{
+				"name": "db", "env": []interface{}{map[string]interface{}{"name": "DB_PASSWORD", "value": "x"}},
+			}}},
+		}}, 1},
+	}
+	for _, tt := range tests {
+		if got := checkLiteralCredentials(tt.res); len(got) != tt.want {
+			t.Errorf("%s: got %q, want %d findings", tt.name, got, tt.want)
+		}
+	}
+}
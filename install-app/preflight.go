@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os/exec"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Preflight modes of -preflight-mode.
+const (
+	preflightFail = "fail"
+	preflightWarn = "warn"
+	preflightOff  = "off"
+)
+
+// resourceAmounts are CPU and memory requests.
+type resourceAmounts struct {
+	CPU    int64 `json:"cpuMillicores"`
+	Memory int64 `json:"memoryBytes"`
+}
+
+func (a resourceAmounts) add(b resourceAmounts) resourceAmounts {
+	return resourceAmounts{CPU: a.CPU + b.CPU, Memory: a.Memory + b.Memory}
+}
+
+func (a resourceAmounts) sub(b resourceAmounts) resourceAmounts {
+	return resourceAmounts{CPU: a.CPU - b.CPU, Memory: a.Memory - b.Memory}
+}
+
+func (a resourceAmounts) times(n int64) resourceAmounts {
+	return resourceAmounts{CPU: a.CPU * n, Memory: a.Memory * n}
+}
+
+func (a resourceAmounts) fits(free resourceAmounts) bool {
+	return a.CPU <= free.CPU && a.Memory <= free.Memory
+}
+
+// workloadRequests are the requests of one rendered workload.
+type workloadRequests struct {
+	Namespace string          `json:"namespace"`
+	Kind      string          `json:"kind"`
+	Name      string          `json:"name"`
+	Pods      int64           `json:"pods"`
+	PerPod    resourceAmounts `json:"perPod"`
+	Total     resourceAmounts `json:"total"`
+	// Unschedulable is the number of pods that found no node with room for them.
+	Unschedulable int64 `json:"unschedulable,omitempty"`
+
+	// podSpec decides which nodes the pods may run on, see podFitsNode.
+	podSpec map[string]interface{}
+}
+
+// preflightReport compares the requests of the rendered workloads with the free
+// capacity of the cluster's schedulable nodes.
+type preflightReport struct {
+	Mode       string                     `json:"mode"`
+	Workloads  []workloadRequests         `json:"workloads"`
+	Namespaces map[string]resourceAmounts `json:"namespaces"`
+	Required   resourceAmounts            `json:"required"`
+	// Free is the allocatable capacity of the schedulable nodes minus the requests of
+	// the pods running on them, not counting the release's own pods.
+	Free     resourceAmounts `json:"free"`
+	Nodes    int             `json:"nodes"`
+	Problems []string        `json:"problems,omitempty"`
+}
+
+// nodeCapacity is the free capacity of a schedulable node, with the labels and
+// taints that decide which pods may run there.
+type nodeCapacity struct {
+	Name   string
+	Free   resourceAmounts
+	Labels map[string]string
+	Taints []nodeTaint
+}
+
+// preflightCapacity checks that the cluster has room for the rendered workloads
+// before anything is installed, so that pods don't sit Pending until the rollout
+// wait times out. With -preflight-mode fail a shortage aborts the install; with warn
+// it is only logged.
+func preflightCapacity(config *Config, resources []k8sResource) error {
+	if config.PreflightMode == preflightOff || resources == nil {
+		return nil
+	}
+
+	workloads := renderedWorkloadRequests(resources)
+	if len(workloads) == 0 {
+		return nil
+	}
+	nodes, err := clusterCapacity(config, workloads)
+	if err != nil {
+		log.Printf("Warning: skipping the capacity preflight: %v", err)
+		return nil
+	}
+
+	report := checkCapacity(workloads, nodes)
+	report.Mode = config.PreflightMode
+	config.result.Preflight = report
+	if len(report.Problems) == 0 {
+		log.Printf("Preflight: the release requests %s CPU and %s memory; %d schedulable nodes have %s CPU and %s memory free",
+			formatCPU(report.Required.CPU), formatMemory(report.Required.Memory), report.Nodes,
+			formatCPU(report.Free.CPU), formatMemory(report.Free.Memory))
+		return nil
+	}
+
+	log.Printf("Preflight: the cluster does not have room for the release:")
+	printPreflight(config.progressOutput(), report)
+	if config.PreflightMode == preflightWarn {
+		for _, problem := range report.Problems {
+			log.Printf("Warning: %s", problem)
+		}
+		return nil
+	}
+	return fmt.Errorf("insufficient cluster capacity (use -preflight-mode warn to install anyway):\n  %s",
+		strings.Join(report.Problems, "\n  "))
+}
+
+// renderedWorkloadRequests returns the requests of the rendered workloads that run
+// pods at install time. DaemonSets get their pod count from the nodes later.
+func renderedWorkloadRequests(resources []k8sResource) []workloadRequests {
+	var workloads []workloadRequests
+	for _, res := range resources {
+		spec, _ := res.Object["spec"].(map[string]interface{})
+		var podSpec map[string]interface{}
+		pods := int64(1)
+		switch res.Kind {
+		case "Deployment", "StatefulSet", "ReplicaSet":
+			if n, ok := jsonNumber(spec["replicas"]); ok {
+				pods = int64(n)
+			}
+			podSpec = templatePodSpec(spec)
+		case "Job":
+			if n, ok := jsonNumber(spec["parallelism"]); ok {
+				pods = int64(n)
+			}
+			podSpec = templatePodSpec(spec)
+		case "DaemonSet":
+			pods = 0
+			podSpec = templatePodSpec(spec)
+		case "Pod":
+			podSpec = spec
+		default:
+			continue
+		}
+		perPod := podRequests(podSpec)
+		workloads = append(workloads, workloadRequests{
+			Namespace: res.Namespace,
+			Kind:      res.Kind,
+			Name:      res.Name,
+			Pods:      pods,
+			PerPod:    perPod,
+			Total:     perPod.times(pods),
+			podSpec:   podSpec,
+		})
+	}
+	return workloads
+}
+
+func templatePodSpec(spec map[string]interface{}) map[string]interface{} {
+	template, _ := spec["template"].(map[string]interface{})
+	podSpec, _ := template["spec"].(map[string]interface{})
+	return podSpec
+}
+
+// podRequests returns the requests the scheduler accounts for a pod: the sum over
+// its containers, or the largest init container if that is more. A container
+// without requests but with limits requests its limits.
+func podRequests(podSpec map[string]interface{}) resourceAmounts {
+	var total, init resourceAmounts
+	containers, _ := podSpec["containers"].([]interface{})
+	for _, c := range containers {
+		total = total.add(containerRequests(c))
+	}
+	initContainers, _ := podSpec["initContainers"].([]interface{})
+	for _, c := range initContainers {
+		r := containerRequests(c)
+		init.CPU = max(init.CPU, r.CPU)
+		init.Memory = max(init.Memory, r.Memory)
+	}
+	return resourceAmounts{CPU: max(total.CPU, init.CPU), Memory: max(total.Memory, init.Memory)}
+}
+
+func containerRequests(c interface{}) resourceAmounts {
+	container, _ := c.(map[string]interface{})
+	resources, _ := container["resources"].(map[string]interface{})
+	requests, _ := resources["requests"].(map[string]interface{})
+	limits, _ := resources["limits"].(map[string]interface{})
+	amount := func(name string) float64 {
+		if v, ok := parseQuantity(requests[name]); ok {
+			return v
+		}
+		v, _ := parseQuantity(limits[name])
+		return v
+	}
+	return resourceAmounts{
+		CPU:    int64(math.Ceil(amount("cpu") * 1000)),
+		Memory: int64(math.Ceil(amount("memory"))),
+	}
+}
+
+// clusterCapacity returns the free capacity of the schedulable nodes: allocatable
+// minus the requests of the pods running there. Pods of the release's own workloads
+// don't count, as an upgrade replaces them.
+func clusterCapacity(config *Config, workloads []workloadRequests) ([]nodeCapacity, error) {
+	out, err := exec.Command("kubectl", kubectlArgs(config, "get", "nodes", "-o", "json")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes: %w", err)
+	}
+	var nodeList struct {
+		Items []struct {
+			Metadata struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+			Spec struct {
+				Unschedulable bool        `json:"unschedulable"`
+				Taints        []nodeTaint `json:"taints"`
+			} `json:"spec"`
+			Status struct {
+				Allocatable map[string]interface{} `json:"allocatable"`
+			} `json:"status"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &nodeList); err != nil {
+		return nil, fmt.Errorf("failed to parse nodes: %w", err)
+	}
+
+	free := map[string]*nodeCapacity{}
+	var names []string
+	for _, node := range nodeList.Items {
+		// Tainted nodes stay: pods tolerating the taints may run there, see podFitsNode.
+		if node.Spec.Unschedulable {
+			continue
+		}
+		cpu, _ := parseQuantity(node.Status.Allocatable["cpu"])
+		memory, _ := parseQuantity(node.Status.Allocatable["memory"])
+		free[node.Metadata.Name] = &nodeCapacity{
+			Name:   node.Metadata.Name,
+			Free:   resourceAmounts{CPU: int64(cpu * 1000), Memory: int64(memory)},
+			Labels: node.Metadata.Labels,
+			Taints: node.Spec.Taints,
+		}
+		names = append(names, node.Metadata.Name)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("the cluster has no schedulable nodes")
+	}
+
+	out, err = exec.Command("kubectl", kubectlArgs(config, "get", "pods", "-A", "-o", "json",
+		"--field-selector", "status.phase!=Succeeded,status.phase!=Failed")...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %w", err)
+	}
+	var podList struct {
+		Items []struct {
+			Metadata struct {
+				Namespace       string `json:"namespace"`
+				OwnerReferences []struct {
+					Kind string `json:"kind"`
+					Name string `json:"name"`
+				} `json:"ownerReferences"`
+			} `json:"metadata"`
+			Spec map[string]interface{} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &podList); err != nil {
+		return nil, fmt.Errorf("failed to parse pods: %w", err)
+	}
+
+	own := map[string]bool{}
+	for _, w := range workloads {
+		own[w.Namespace+"/"+w.Kind+"/"+w.Name] = true
+	}
+	for _, pod := range podList.Items {
+		nodeName, _ := pod.Spec["nodeName"].(string)
+		node := free[nodeName]
+		if node == nil {
+			continue
+		}
+		released := false
+		for _, owner := range pod.Metadata.OwnerReferences {
+			kind, name := owner.Kind, owner.Name
+			if kind == "ReplicaSet" {
+				// Deployment pods belong to <deployment>-<pod-template-hash>.
+				kind, name = "Deployment", replicaSetHash.ReplaceAllString(name, "")
+			}
+			released = released || own[pod.Metadata.Namespace+"/"+kind+"/"+name]
+		}
+		if !released {
+			node.Free = node.Free.sub(podRequests(pod.Spec))
+		}
+	}
+
+	sort.Strings(names)
+	nodes := make([]nodeCapacity, 0, len(names))
+	for _, name := range names {
+		nodes = append(nodes, *free[name])
+	}
+	return nodes, nil
+}
+
+var replicaSetHash = regexp.MustCompile(`-[a-z0-9]+$`)
+
+// checkCapacity places the workloads' pods on the nodes the way a scheduler would
+// roughly do it, largest pods first, and reports the pods that don't fit. Pods only go
+// on nodes matching their node selector and affinity and whose taints they tolerate;
+// DaemonSet pods go on every such node. The free capacity is that of the nodes some
+// pod may run on.
+func checkCapacity(workloads []workloadRequests, nodes []nodeCapacity) *preflightReport {
+	report := &preflightReport{Namespaces: map[string]resourceAmounts{}}
+	for _, node := range nodes {
+		if slices.ContainsFunc(workloads, func(w workloadRequests) bool { return podFitsNode(w.podSpec, node.Labels, node.Taints) }) {
+			report.Free = report.Free.add(node.Free)
+			report.Nodes++
+		}
+	}
+
+	type pod struct {
+		workload int
+		requests resourceAmounts
+	}
+	var pods []pod
+	for i := range workloads {
+		w := &workloads[i]
+		if w.Kind == "DaemonSet" {
+			w.Pods = 0
+			for j := range nodes {
+				if !podFitsNode(w.podSpec, nodes[j].Labels, nodes[j].Taints) {
+					continue
+				}
+				w.Pods++
+				if w.PerPod.fits(nodes[j].Free) {
+					nodes[j].Free = nodes[j].Free.sub(w.PerPod)
+				} else {
+					w.Unschedulable++
+				}
+			}
+			w.Total = w.PerPod.times(w.Pods)
+		} else {
+			for n := int64(0); n < w.Pods; n++ {
+				pods = append(pods, pod{workload: i, requests: w.PerPod})
+			}
+		}
+		report.Required = report.Required.add(w.Total)
+		report.Namespaces[w.Namespace] = report.Namespaces[w.Namespace].add(w.Total)
+	}
+
+	sort.SliceStable(pods, func(i, j int) bool {
+		a, b := pods[i].requests, pods[j].requests
+		if a.CPU != b.CPU {
+			return a.CPU > b.CPU
+		}
+		return a.Memory > b.Memory
+	})
+	for _, p := range pods {
+		placed := false
+		podSpec := workloads[p.workload].podSpec
+		for j := range nodes {
+			if p.requests.fits(nodes[j].Free) && podFitsNode(podSpec, nodes[j].Labels, nodes[j].Taints) {
+				nodes[j].Free = nodes[j].Free.sub(p.requests)
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			workloads[p.workload].Unschedulable++
+		}
+	}
+
+	sort.Slice(workloads, func(i, j int) bool {
+		if workloads[i].Namespace != workloads[j].Namespace {
+			return workloads[i].Namespace < workloads[j].Namespace
+		}
+		return workloads[i].Kind+"/"+workloads[i].Name < workloads[j].Kind+"/"+workloads[j].Name
+	})
+	report.Workloads = workloads
+
+	if report.Required.CPU > report.Free.CPU {
+		report.Problems = append(report.Problems, fmt.Sprintf("the release requests %s CPU but the cluster has %s free",
+			formatCPU(report.Required.CPU), formatCPU(report.Free.CPU)))
+	}
+	if report.Required.Memory > report.Free.Memory {
+		report.Problems = append(report.Problems, fmt.Sprintf("the release requests %s memory but the cluster has %s free",
+			formatMemory(report.Required.Memory), formatMemory(report.Free.Memory)))
+	}
+	for _, w := range workloads {
+		if w.Unschedulable > 0 {
+			report.Problems = append(report.Problems, fmt.Sprintf("%d of %d pods of %s/%s/%s (%s CPU, %s memory each) fit on no node",
+				w.Unschedulable, w.Pods, w.Namespace, w.Kind, w.Name, formatCPU(w.PerPod.CPU), formatMemory(w.PerPod.Memory)))
+		}
+	}
+	return report
+}
+
+// printPreflight writes the per-workload breakdown of the preflight, with a total
+// per namespace and the cluster's free capacity.
+func printPreflight(out io.Writer, report *preflightReport) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tWORKLOAD\tPODS\tCPU\tMEMORY\tUNSCHEDULABLE")
+	for i, wl := range report.Workloads {
+		unschedulable := "-"
+		if wl.Unschedulable > 0 {
+			unschedulable = fmt.Sprint(wl.Unschedulable)
+		}
+		fmt.Fprintf(w, "%s\t%s/%s\t%d\t%s\t%s\t%s\n", wl.Namespace, wl.Kind, wl.Name, wl.Pods,
+			formatCPU(wl.Total.CPU), formatMemory(wl.Total.Memory), unschedulable)
+		if i == len(report.Workloads)-1 || report.Workloads[i+1].Namespace != wl.Namespace {
+			total := report.Namespaces[wl.Namespace]
+			fmt.Fprintf(w, "%s\ttotal\t\t%s\t%s\t\n", wl.Namespace, formatCPU(total.CPU), formatMemory(total.Memory))
+		}
+	}
+	fmt.Fprintf(w, "\trequired\t\t%s\t%s\t\n", formatCPU(report.Required.CPU), formatMemory(report.Required.Memory))
+	fmt.Fprintf(w, "\tfree on %d nodes\t\t%s\t%s\t\n", report.Nodes, formatCPU(report.Free.CPU), formatMemory(report.Free.Memory))
+	w.Flush()
+}
+
+// formatCPU formats millicores the way Kubernetes quantities are written.
+func formatCPU(millicores int64) string {
+	if millicores%1000 == 0 {
+		return fmt.Sprint(millicores / 1000)
+	}
+	return fmt.Sprintf("%dm", millicores)
+}
+
+// formatMemory formats bytes in Mi, or Gi from 10Gi.
+func formatMemory(bytes int64) string {
+	if bytes >= 10<<30 || bytes <= -10<<30 {
+		return fmt.Sprintf("%.1fGi", float64(bytes)/(1<<30))
+	}
+	return fmt.Sprintf("%dMi", int64(math.Round(float64(bytes)/(1<<20))))
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// prerequisitesFile is the file inside a chart listing what the cluster must provide
+// for parts of the chart, e.g. the Litmus CRDs and operator for its ChaosEngines.
+const prerequisitesFile = "prerequisites.yaml"
+
+// Modes of -prerequisites for missing prerequisites.
+const (
+	prerequisitesFail    = "fail"
+	prerequisitesSkip    = "skip"
+	prerequisitesInstall = "install"
+)
+
+// prerequisite is an entry of a chart's prerequisites.yaml.
+type prerequisite struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// When names the value that makes the chart need the prerequisite.
+	When string `json:"when"`
+	// Disable are the toggles -prerequisites skip switches off.
+	Disable         []string             `json:"disable"`
+	CRDs            []string             `json:"crds"`
+	ServiceAccounts []prerequisiteObject `json:"serviceAccounts"`
+	// Deployments must have a ready replica. Without a namespace any namespace will do.
+	Deployments []prerequisiteObject `json:"deployments"`
+	// Chart is the chart, next to the application charts, that -prerequisites install
+	// installs into the namespace of the first ServiceAccount.
+	Chart string `json:"chart"`
+}
+
+// prerequisiteObject is a namespaced object, in Namespace or in the namespace held by
+// the NamespaceValue value.
+type prerequisiteObject struct {
+	Name           string `json:"name"`
+	Namespace      string `json:"namespace"`
+	NamespaceValue string `json:"namespaceValue"`
+}
+
+// prerequisiteResult reports a prerequisite the install needed.
+type prerequisiteResult struct {
+	Name    string   `json:"name"`
+	Missing []string `json:"missing,omitempty"`
+	// Action is "satisfied", "skipped", "installed", or "missing" when the install
+	// was aborted.
+	Action string `json:"action"`
+}
+
+// loadPrerequisites reads a chart's prerequisites.yaml; it returns nil if the chart
+// has none.
+func loadPrerequisites(chartPath string) ([]prerequisite, error) {
+	data, err := readChartFile(chartPath, prerequisitesFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Prerequisites []prerequisite `json:"prerequisites"`
+	}
+	if err := decodeYAMLInto(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", prerequisitesFile, err)
+	}
+	return file.Prerequisites, nil
+}
+
+// resolvePrerequisites checks the prerequisites the values enable before anything is
+// rendered or installed, so that helm doesn't fail halfway through on, e.g., a
+// ChaosEngine without its CRD. Missing prerequisites abort the install, or with
+// -prerequisites skip the parts of the chart needing them are switched off, or with
+// -prerequisites install they are installed from the bundled chart.
+func resolvePrerequisites(config *Config) error {
+	prerequisites, err := loadPrerequisites(config.chartPath())
+	if err != nil || len(prerequisites) == 0 {
+		return err
+	}
+	values, err := computeValues(config)
+	if err != nil {
+		return err
+	}
+
+	var failures []string
+	for _, p := range prerequisites {
+		if when, _ := lookupValue(values, p.When); !truthy(when) {
+			continue
+		}
+		result := prerequisiteResult{Name: p.Name, Missing: missingPrerequisites(config, p, values), Action: "satisfied"}
+		switch {
+		case len(result.Missing) == 0:
+			log.Printf("Prerequisite %s is satisfied", p.Name)
+		case config.Prerequisites == prerequisitesSkip:
+			log.Printf("Warning: prerequisite %s is missing %s; switching off %s", p.Name,
+				strings.Join(result.Missing, ", "), strings.Join(p.Disable, ", "))
+			for _, toggle := range p.Disable {
+				config.prerequisiteOverrides = append(config.prerequisiteOverrides, toggle+"=false")
+			}
+			result.Action = "skipped"
+		case config.Prerequisites == prerequisitesInstall:
+			if err := installPrerequisiteChart(config, p, values); err != nil {
+				return fmt.Errorf("failed to install prerequisite %s: %w", p.Name, err)
+			}
+			result.Action = "installed"
+		default:
+			result.Action = "missing"
+			failures = append(failures, fmt.Sprintf("%s (%s, needed for %s): missing %s", p.Name, p.Description,
+				p.When, strings.Join(result.Missing, ", ")))
+		}
+		config.result.Prerequisites = append(config.result.Prerequisites, result)
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("the cluster is missing prerequisites of the chart:\n  %s\nuse -prerequisites skip to "+
+			"install without the parts that need them, or -prerequisites install to install them",
+			strings.Join(failures, "\n  "))
+	}
+	return nil
+}
+
+// missingPrerequisites returns what of p the cluster lacks, e.g.
+// "CRD chaosengines.litmuschaos.io".
+func missingPrerequisites(config *Config, p prerequisite, values map[string]interface{}) []string {
+	var missing []string
+	for _, crd := range p.CRDs {
+		if exec.Command("kubectl", kubectlArgs(config, "get", "crd", crd)...).Run() != nil {
+			missing = append(missing, "CRD "+crd)
+		}
+	}
+	for _, sa := range p.ServiceAccounts {
+		namespace := prerequisiteNamespace(config, sa, values)
+		if exec.Command("kubectl", kubectlArgs(config, "get", "serviceaccount", sa.Name, "-n", namespace)...).Run() != nil {
+			missing = append(missing, fmt.Sprintf("ServiceAccount %s/%s", namespace, sa.Name))
+		}
+	}
+	for _, d := range p.Deployments {
+		namespace := d.Namespace
+		if d.NamespaceValue != "" {
+			namespace = prerequisiteNamespace(config, d, values)
+		}
+		args := []string{"get", "deployments", "--field-selector", "metadata.name=" + d.Name,
+			"-o", "jsonpath={.items[*].status.readyReplicas}"}
+		name := d.Name
+		if namespace == "" {
+			args = append(args, "-A")
+		} else {
+			args = append(args, "-n", namespace)
+			name = namespace + "/" + d.Name
+		}
+		out, err := exec.Command("kubectl", kubectlArgs(config, args...)...).Output()
+		ready := false
+		for _, n := range strings.Fields(string(out)) {
+			ready = ready || n != "0"
+		}
+		if err != nil || !ready {
+			missing = append(missing, "running Deployment "+name)
+		}
+	}
+	return missing
+}
+
+// prerequisiteNamespace returns the namespace of a prerequisite object, defaulting to
+// the release namespace.
+func prerequisiteNamespace(config *Config, object prerequisiteObject, values map[string]interface{}) string {
+	if object.Namespace != "" {
+		return object.Namespace
+	}
+	if object.NamespaceValue != "" {
+		if ns, _ := lookupValue(values, object.NamespaceValue); ns != nil && ns != "" {
+			return fmt.Sprint(ns)
+		}
+	}
+	return config.Namespace
+}
+
+// installPrerequisiteChart installs p's chart from the charts path into the
+// namespace of its first ServiceAccount and, with -wait, waits for its Deployments.
+func installPrerequisiteChart(config *Config, p prerequisite, values map[string]interface{}) error {
+	if p.Chart == "" {
+		return fmt.Errorf("%s names no chart to install it from", prerequisitesFile)
+	}
+	if config.ChartsPath == "" {
+		return fmt.Errorf("chart %s is not available with a remote chart; install it from a charts path", p.Chart)
+	}
+	chart := &Config{
+		ChartsPath:      config.ChartsPath,
+		FolderName:      p.Chart,
+		AllowUnverified: config.AllowUnverified,
+		Keyring:         config.Keyring,
+	}
+	if _, err := os.Stat(filepath.Join(chart.ChartsPath, p.Chart, "Chart.yaml")); err != nil {
+		return fmt.Errorf("chart %s not found in %s", p.Chart, chart.ChartsPath)
+	}
+	if err := verifyChart(chart); err != nil {
+		return err
+	}
+
+	namespace := config.Namespace
+	if len(p.ServiceAccounts) > 0 {
+		namespace = prerequisiteNamespace(config, p.ServiceAccounts[0], values)
+	}
+	args := []string{"upgrade", "--install", p.Chart, chart.chartPath(), "--namespace", namespace, "--create-namespace"}
+	if config.DryRun {
+		args = append(args, "--dry-run")
+	}
+	if config.KubeConfig != "" {
+		args = append(args, "--kubeconfig", config.KubeConfig)
+	}
+	if config.KubeContext != "" {
+		args = append(args, "--kube-context", config.KubeContext)
+	}
+	log.Printf("Installing prerequisite %s: helm %s", p.Name, strings.Join(args, " "))
+	cmd := exec.Command("helm", args...)
+	cmd.Stdout = config.progressOutput()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("helm install of %s failed: %w", p.Chart, err)
+	}
+	if config.DryRun || !config.Wait {
+		return nil
+	}
+
+	var deployments []k8sResource
+	for _, d := range p.Deployments {
+		ns := namespace
+		if d.Namespace != "" || d.NamespaceValue != "" {
+			ns = prerequisiteNamespace(config, d, values)
+		}
+		deployments = append(deployments, k8sResource{Kind: "Deployment", Name: d.Name, Namespace: ns})
+	}
+	return waitForDeployments(config, deployments)
+}
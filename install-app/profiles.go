@@ -0,0 +1,233 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	// profilesDir is the folder inside a chart holding named values profiles,
+	// e.g. charts/sock-shop/profiles/kind.yaml.
+	profilesDir = "profiles"
+
+	// autoProfile selects the profile from the cluster the install targets.
+	autoProfile = "auto"
+
+	// largeClusterNodes is the node count from which -profile auto picks "large".
+	largeClusterNodes = 3
+)
+
+// resolveProfile locates the values file of the selected profile and records it in
+// config so helm layers it between the chart's values.yaml and the user's values.
+// The returned function removes the file if it had to be extracted from an archive.
+func resolveProfile(config *Config) (func(), error) {
+	noop := func() {}
+	if config.Profile == "" {
+		return noop, nil
+	}
+
+	name := config.Profile
+	if name == autoProfile {
+		detected, err := detectProfile(config)
+		if err != nil {
+			log.Printf("Warning: could not detect a profile, using chart defaults: %v", err)
+			return noop, nil
+		}
+		if detected == "" {
+			log.Printf("No profile matches the cluster, using chart defaults")
+			return noop, nil
+		}
+		log.Printf("Detected profile %s", detected)
+		name = detected
+	}
+
+	available, err := listProfiles(config.chartPath())
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(available, name) {
+		if config.Profile == autoProfile {
+			log.Printf("Warning: chart has no %s profile, using chart defaults", name)
+			return noop, nil
+		}
+		if len(available) == 0 {
+			return nil, fmt.Errorf("profile %s not found: chart has no profiles", name)
+		}
+		return nil, fmt.Errorf("profile %s not found (available: %s)", name, strings.Join(available, ", "))
+	}
+
+	config.activeProfile = name
+	chartPath := config.chartPath()
+	if info, err := os.Stat(chartPath); err == nil && info.IsDir() {
+		config.profileValuesFile = filepath.Join(chartPath, profilesDir, name+".yaml")
+		log.Printf("Using profile %s", name)
+		return noop, nil
+	}
+
+	data, err := readChartFile(chartPath, profilesDir+"/"+name+".yaml")
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp("", "install-app-profile-*.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("failed to write profile %s: %w", name, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("failed to write profile %s: %w", name, err)
+	}
+
+	config.profileValuesFile = f.Name()
+	log.Printf("Using profile %s", name)
+	return func() { os.Remove(f.Name()) }, nil
+}
+
+// listProfiles returns the profile names shipped with a chart folder or archive.
+func listProfiles(chartPath string) ([]string, error) {
+	var files []string
+
+	info, err := os.Stat(chartPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chart: %w", err)
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(filepath.Join(chartPath, profilesDir))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read profiles: %w", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, entry.Name())
+			}
+		}
+	} else {
+		err := walkArchive(chartPath, func(name string, _ io.Reader) (bool, error) {
+			if dir, file := filepath.Split(name); dir == profilesDir+"/" {
+				files = append(files, file)
+			}
+			return false, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var profiles []string
+	for _, file := range files {
+		if strings.HasSuffix(file, ".yaml") {
+			profiles = append(profiles, strings.TrimSuffix(file, ".yaml"))
+		}
+	}
+	sort.Strings(profiles)
+	return profiles, nil
+}
+
+// walkArchive calls fn for every regular file of a chart archive with its path
+// relative to the chart's top-level folder, until fn returns true or an error.
+func walkArchive(archive string, fn func(name string, r io.Reader) (bool, error)) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return fmt.Errorf("failed to open chart archive: %w", err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read chart archive %s: %w", archive, err)
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read chart archive %s: %w", archive, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		parts := strings.SplitN(hdr.Name, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		done, err := fn(parts[1], tr)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// detectProfile picks a profile from the target cluster's nodes: kind nodes have a
+// kind:// provider ID, minikube nodes carry the minikube.k8s.io/name label, Docker
+// Desktop's node is named docker-desktop, and other clusters of largeClusterNodes
+// or more nodes are "large". It returns "" when nothing matches.
+func detectProfile(config *Config) (string, error) {
+	out, err := exec.Command("kubectl", kubectlArgs(config, "get", "nodes", "-o", "json")...).Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to list nodes: %w", err)
+	}
+
+	var nodes struct {
+		Items []struct {
+			Metadata struct {
+				Name   string            `json:"name"`
+				Labels map[string]string `json:"labels"`
+			} `json:"metadata"`
+			Spec struct {
+				ProviderID string `json:"providerID"`
+			} `json:"spec"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &nodes); err != nil {
+		return "", fmt.Errorf("failed to parse node list: %w", err)
+	}
+
+	for _, node := range nodes.Items {
+		switch {
+		case strings.HasPrefix(node.Spec.ProviderID, "kind://"):
+			return "kind", nil
+		case node.Metadata.Labels["minikube.k8s.io/name"] != "":
+			return "minikube", nil
+		case node.Metadata.Name == "docker-desktop":
+			return "local", nil
+		}
+	}
+	if len(nodes.Items) >= largeClusterNodes {
+		return "large", nil
+	}
+	return "", nil
+}
+
+// kubectlArgs appends the kubeconfig and context of config to a kubectl command line.
+func kubectlArgs(config *Config, args ...string) []string {
+	if config.KubeConfig != "" {
+		args = append(args, "--kubeconfig", config.KubeConfig)
+	}
+	if config.KubeContext != "" {
+		args = append(args, "--context", config.KubeContext)
+	}
+	return args
+}
+
+// helmKubeArgs appends the kubeconfig and context of config to a helm command line.
+func helmKubeArgs(config *Config, args ...string) []string {
+	if config.KubeConfig != "" {
+		args = append(args, "--kubeconfig", config.KubeConfig)
+	}
+	if config.KubeContext != "" {
+		args = append(args, "--kube-context", config.KubeContext)
+	}
+	return args
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const (
+	// provisionedAnnotation records the labels and annotations install-app set on a
+	// namespace, so those dropped from the configuration are removed on the next install.
+	provisionedAnnotation = "install-app/provisioned"
+
+	// defaultDenyPolicyName is the NetworkPolicy of -default-deny.
+	defaultDenyPolicyName = "install-app-default-deny"
+
+	// Modes of -default-deny.
+	defaultDenyIngress = "ingress"
+	defaultDenyAll     = "all"
+)
+
+// Pod Security Admission modes and levels, see
+// https://kubernetes.io/docs/concepts/security/pod-security-admission/.
+var (
+	podSecurityModes  = []string{"enforce", "audit", "warn"}
+	podSecurityLevels = []string{"privileged", "baseline", "restricted"}
+)
+
+// provisionedKinds are the kinds a -namespace-quota template may render, and with the
+// default-deny NetworkPolicy the objects install-app reconciles in each namespace.
+var provisionedKinds = []string{"ResourceQuota", "LimitRange"}
+
+// namespaceProvisioning is how install-app governs the namespaces the release owns:
+// their labels and annotations, and the objects rendered from the quota template.
+type namespaceProvisioning struct {
+	labels      map[string]string
+	annotations map[string]string
+	quota       *template.Template
+	defaultDeny string
+}
+
+// provisionedKeys is the value of provisionedAnnotation.
+type provisionedKeys struct {
+	Labels      []string `json:"labels,omitempty"`
+	Annotations []string `json:"annotations,omitempty"`
+}
+
+// releaseNetwork is the traffic of the release that -default-deny keeps allowed
+// besides that between a namespace's own pods: from the release's other namespaces,
+// from anywhere to its NodePort and LoadBalancer Services and, with all, to its
+// other namespaces and the API server.
+type releaseNetwork struct {
+	namespaces []string
+	services   []k8sResource
+	apiServer  []interface{}
+}
+
+// quotaTemplateData is what a -namespace-quota template sees.
+type quotaTemplateData struct {
+	Namespace string
+	Release   string
+	Profile   string
+	Instance  string
+}
+
+// resolveNamespaceProvisioning checks -pod-security, -namespace-label,
+// -namespace-annotation, -namespace-quota and -default-deny. prepareNamespaces
+// reconciles them in each namespace the release owns, see provisionNamespace.
+func resolveNamespaceProvisioning(config *Config) error {
+	p := &namespaceProvisioning{labels: map[string]string{}, annotations: map[string]string{}}
+
+	if config.PodSecurity != "" {
+		levels := map[string]string{}
+		for _, item := range strings.Split(config.PodSecurity, ",") {
+			mode, level, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				// A bare level applies to every mode.
+				for _, m := range podSecurityModes {
+					levels[m] = mode
+				}
+				continue
+			}
+			if !slices.Contains(podSecurityModes, mode) {
+				return fmt.Errorf("invalid -pod-security mode %q: must be one of %s", mode, strings.Join(podSecurityModes, ", "))
+			}
+			levels[mode] = level
+		}
+		for mode, level := range levels {
+			if !slices.Contains(podSecurityLevels, level) {
+				return fmt.Errorf("invalid -pod-security level %q: must be one of %s", level, strings.Join(podSecurityLevels, ", "))
+			}
+			p.labels["pod-security.kubernetes.io/"+mode] = level
+		}
+	}
+
+	for _, set := range []struct {
+		flag   string
+		values listFlags
+		into   map[string]string
+	}{
+		{"-namespace-label", config.NamespaceLabels, p.labels},
+		{"-namespace-annotation", config.NamespaceAnnotations, p.annotations},
+	} {
+		for _, item := range set.values {
+			for _, pair := range strings.Split(item, ",") {
+				key, value, ok := strings.Cut(pair, "=")
+				if !ok || !labelKey.MatchString(key) {
+					return fmt.Errorf("invalid %s %s: expected key=value", set.flag, pair)
+				}
+				set.into[key] = value
+			}
+		}
+	}
+
+	if config.NamespaceQuota != "" {
+		data, err := os.ReadFile(config.NamespaceQuota)
+		if err != nil {
+			return fmt.Errorf("failed to read namespace quota template: %w", err)
+		}
+		p.quota, err = template.New(config.NamespaceQuota).Option("missingkey=error").Parse(string(data))
+		if err != nil {
+			return fmt.Errorf("invalid namespace quota template: %w", err)
+		}
+		// Render it once now, so mistakes show up before anything is installed.
+		if _, err := p.objects(config, config.Namespace, releaseNetwork{}); err != nil {
+			return err
+		}
+	}
+
+	switch config.DefaultDeny {
+	case "", defaultDenyIngress, defaultDenyAll:
+		p.defaultDeny = config.DefaultDeny
+	default:
+		return fmt.Errorf("invalid -default-deny %q: must be %s or %s", config.DefaultDeny, defaultDenyIngress, defaultDenyAll)
+	}
+
+	if len(p.labels) == 0 && len(p.annotations) == 0 && p.quota == nil && p.defaultDeny == "" {
+		return nil
+	}
+	config.provisioning = p
+	return nil
+}
+
+// objects returns the objects to keep in a namespace: those of the quota template and
+// the default-deny NetworkPolicies, labeled as managed by install-app.
+func (p *namespaceProvisioning) objects(config *Config, namespace string, network releaseNetwork) ([]map[string]interface{}, error) {
+	var objects []map[string]interface{}
+	if p.quota != nil {
+		var b bytes.Buffer
+		data := quotaTemplateData{Namespace: namespace, Release: config.ReleaseName, Profile: config.activeProfile,
+			Instance: config.Instance}
+		if err := p.quota.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("namespace quota template: %w", err)
+		}
+		docs, err := parseYAMLDocuments(b.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("namespace quota template: %w", err)
+		}
+		for _, doc := range docs {
+			obj, _ := doc.(map[string]interface{})
+			kind, _ := obj["kind"].(string)
+			metadata, _ := obj["metadata"].(map[string]interface{})
+			if name, _ := metadata["name"].(string); name == "" || !slices.Contains(provisionedKinds, kind) {
+				return nil, fmt.Errorf("namespace quota template: documents must be named %s objects",
+					strings.Join(provisionedKinds, " or "))
+			}
+			objects = append(objects, obj)
+		}
+	}
+
+	if p.defaultDeny != "" {
+		// Traffic between the release's pods stays allowed, and with all so do DNS and
+		// the API server; everything else in the policy types is denied.
+		peers := []interface{}{map[string]interface{}{"podSelector": map[string]interface{}{}}}
+		if len(network.namespaces) > 0 {
+			names := make([]interface{}, len(network.namespaces))
+			for i, ns := range network.namespaces {
+				names[i] = ns
+			}
+			peers = append(peers, map[string]interface{}{"namespaceSelector": map[string]interface{}{
+				"matchExpressions": []interface{}{map[string]interface{}{
+					"key": "kubernetes.io/metadata.name", "operator": "In", "values": names,
+				}},
+			}})
+		}
+		policyTypes := []interface{}{"Ingress"}
+		spec := map[string]interface{}{
+			"podSelector": map[string]interface{}{},
+			"ingress":     []interface{}{map[string]interface{}{"from": peers}},
+		}
+		if p.defaultDeny == defaultDenyAll {
+			policyTypes = append(policyTypes, "Egress")
+			spec["egress"] = append([]interface{}{
+				map[string]interface{}{"to": peers},
+				map[string]interface{}{
+					"to": []interface{}{map[string]interface{}{"namespaceSelector": map[string]interface{}{}}},
+					"ports": []interface{}{
+						map[string]interface{}{"protocol": "UDP", "port": 53},
+						map[string]interface{}{"protocol": "TCP", "port": 53},
+					},
+				},
+			}, network.apiServer...)
+		}
+		spec["policyTypes"] = policyTypes
+		objects = append(objects, map[string]interface{}{
+			"apiVersion": "networking.k8s.io/v1",
+			"kind":       "NetworkPolicy",
+			"metadata":   map[string]interface{}{"name": defaultDenyPolicyName},
+			"spec":       spec,
+		})
+		objects = append(objects, exposedServicePolicies(network.services, namespace)...)
+	}
+
+	for _, obj := range objects {
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		metadata["namespace"] = namespace
+		labels, _ := metadata["labels"].(map[string]interface{})
+		if labels == nil {
+			labels = map[string]interface{}{}
+		}
+		labels["app.kubernetes.io/managed-by"] = "install-app"
+		metadata["labels"] = labels
+		obj["metadata"] = metadata
+	}
+	return objects, nil
+}
+
+// provisionNamespace reconciles a namespace with the provisioning configuration:
+// it sets the labels and annotations and removes those an earlier install set that
+// are no longer configured, and applies the quota and network policy objects and
+// deletes the ones install-app created before that are no longer rendered. Without
+// any configuration it only cleans up after an earlier install that had some.
+func provisionNamespace(config *Config, namespace string, network releaseNetwork) error {
+	p := config.provisioning
+	if p == nil {
+		p = &namespaceProvisioning{}
+	}
+	objects, err := p.objects(config, namespace, network)
+	if err != nil {
+		return err
+	}
+	if config.DryRun {
+		if config.provisioning != nil {
+			log.Printf("Dry run: not provisioning namespace %s with %d labels, %d annotations and %d objects",
+				namespace, len(p.labels), len(p.annotations), len(objects))
+		}
+		return nil
+	}
+
+	var current struct {
+		Metadata struct {
+			Labels      map[string]string `json:"labels"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("kubectl", kubectlArgs(config, "get", "namespace", namespace, "-o", "json")...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		// Without provisioning options there is nothing to clean up in a new namespace.
+		if strings.Contains(stderr.String(), "NotFound") && config.provisioning == nil {
+			return nil
+		}
+		return fmt.Errorf("failed to get namespace %s: %w: %s", namespace, err, strings.TrimSpace(stderr.String()))
+	}
+	if err := json.Unmarshal(out, &current); err != nil {
+		return fmt.Errorf("failed to parse namespace %s: %w", namespace, err)
+	}
+	raw, provisioned := current.Metadata.Annotations[provisionedAnnotation]
+	if config.provisioning == nil && !provisioned {
+		return nil
+	}
+	var previous provisionedKeys
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &previous); err != nil {
+			log.Printf("Warning: ignoring invalid %s annotation of namespace %s: %v", provisionedAnnotation, namespace, err)
+		}
+	}
+
+	annotations := map[string]string{}
+	for k, v := range p.annotations {
+		annotations[k] = v
+	}
+	if config.provisioning != nil {
+		keys := provisionedKeys{Labels: sortedStringKeys(p.labels), Annotations: sortedStringKeys(p.annotations)}
+		record, err := json.Marshal(keys)
+		if err != nil {
+			return err
+		}
+		annotations[provisionedAnnotation] = string(record)
+	} else {
+		previous.Annotations = append(previous.Annotations, provisionedAnnotation)
+	}
+	for _, change := range []struct {
+		verb     string
+		set      map[string]string
+		previous []string
+	}{
+		{"label", p.labels, previous.Labels},
+		{"annotate", annotations, previous.Annotations},
+	} {
+		args := []string{change.verb, "namespace", namespace, "--overwrite"}
+		for _, key := range sortedStringKeys(change.set) {
+			args = append(args, key+"="+change.set[key])
+		}
+		for _, key := range change.previous {
+			if _, ok := change.set[key]; !ok {
+				args = append(args, key+"-")
+			}
+		}
+		if len(args) == 4 {
+			continue
+		}
+		if out, err := exec.Command("kubectl", kubectlArgs(config, args...)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to %s namespace %s: %w: %s", change.verb, namespace, err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	if len(objects) > 0 {
+		items := make([]interface{}, len(objects))
+		for i, obj := range objects {
+			items[i] = obj
+		}
+		manifest, err := json.Marshal(map[string]interface{}{"apiVersion": "v1", "kind": "List", "items": items})
+		if err != nil {
+			return err
+		}
+		cmd := exec.Command("kubectl", kubectlArgs(config, "apply", "-f", "-")...)
+		cmd.Stdin = bytes.NewReader(manifest)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to apply the objects of namespace %s: %w: %s", namespace, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if err := pruneProvisionedObjects(config, namespace, objects); err != nil {
+		return err
+	}
+
+	if config.provisioning == nil {
+		log.Printf("Removed the provisioning of an earlier install from namespace %s", namespace)
+		return nil
+	}
+	names := "none"
+	for i, obj := range objects {
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		if i == 0 {
+			names = ""
+		} else {
+			names += ", "
+		}
+		names += fmt.Sprintf("%s/%s", obj["kind"], metadata["name"])
+	}
+	log.Printf("Provisioned namespace %s: %d labels, %d annotations, objects: %s", namespace, len(p.labels),
+		len(p.annotations), names)
+	return nil
+}
+
+// newReleaseNetwork collects the traffic the default-deny policies of the release's
+// namespaces must let through, see releaseNetwork.
+func newReleaseNetwork(config *Config, namespaces []string, resources []k8sResource) (releaseNetwork, error) {
+	network := releaseNetwork{namespaces: namespaces}
+	p := config.provisioning
+	if p == nil || p.defaultDeny == "" {
+		return network, nil
+	}
+	for _, res := range resources {
+		spec, _ := res.Object["spec"].(map[string]interface{})
+		if res.Kind == "Service" && (spec["type"] == "NodePort" || spec["type"] == "LoadBalancer") {
+			network.services = append(network.services, res)
+		}
+	}
+	if p.defaultDeny != defaultDenyAll || config.DryRun {
+		return network, nil
+	}
+
+	// NetworkPolicies see the API server's endpoints rather than the kubernetes
+	// Service, so allow egress to those addresses and ports.
+	out, err := exec.Command("kubectl", kubectlArgs(config, "get", "endpoints", "kubernetes", "-n", "default", "-o", "json")...).Output()
+	if err != nil {
+		return network, fmt.Errorf("failed to get the API server endpoints for -default-deny %s: %w", defaultDenyAll, err)
+	}
+	var endpoints struct {
+		Subsets []struct {
+			Addresses []struct {
+				IP string `json:"ip"`
+			} `json:"addresses"`
+			Ports []struct {
+				Port     int    `json:"port"`
+				Protocol string `json:"protocol"`
+			} `json:"ports"`
+		} `json:"subsets"`
+	}
+	if err := json.Unmarshal(out, &endpoints); err != nil {
+		return network, fmt.Errorf("failed to parse the API server endpoints: %w", err)
+	}
+	for _, subset := range endpoints.Subsets {
+		var to, ports []interface{}
+		for _, address := range subset.Addresses {
+			cidr := address.IP + "/32"
+			if strings.Contains(address.IP, ":") {
+				cidr = address.IP + "/128"
+			}
+			to = append(to, map[string]interface{}{"ipBlock": map[string]interface{}{"cidr": cidr}})
+		}
+		for _, port := range subset.Ports {
+			protocol := port.Protocol
+			if protocol == "" {
+				protocol = "TCP"
+			}
+			ports = append(ports, map[string]interface{}{"protocol": protocol, "port": port.Port})
+		}
+		if len(to) > 0 {
+			network.apiServer = append(network.apiServer, map[string]interface{}{"to": to, "ports": ports})
+		}
+	}
+	if len(network.apiServer) == 0 {
+		return network, fmt.Errorf("the kubernetes Service in default has no endpoints to allow for -default-deny %s", defaultDenyAll)
+	}
+	return network, nil
+}
+
+// exposedServicePolicies returns a NetworkPolicy per NodePort or LoadBalancer Service
+// in namespace that admits traffic from anywhere to its pods on its target ports, so
+// the default-deny policy doesn't cut the release off from outside the cluster.
+func exposedServicePolicies(services []k8sResource, namespace string) []map[string]interface{} {
+	var policies []map[string]interface{}
+	for _, svc := range services {
+		spec, _ := svc.Object["spec"].(map[string]interface{})
+		selector, _ := spec["selector"].(map[string]interface{})
+		if svc.Namespace != namespace || len(selector) == 0 {
+			continue
+		}
+		var ports []interface{}
+		servicePorts, _ := spec["ports"].([]interface{})
+		for _, item := range servicePorts {
+			port, _ := item.(map[string]interface{})
+			target, ok := port["targetPort"]
+			if !ok {
+				target = port["port"]
+			}
+			protocol, _ := port["protocol"].(string)
+			if protocol == "" {
+				protocol = "TCP"
+			}
+			ports = append(ports, map[string]interface{}{"protocol": protocol, "port": target})
+		}
+		policies = append(policies, map[string]interface{}{
+			"apiVersion": "networking.k8s.io/v1",
+			"kind":       "NetworkPolicy",
+			"metadata":   map[string]interface{}{"name": defaultDenyPolicyName + "-allow-" + svc.Name},
+			"spec": map[string]interface{}{
+				"podSelector": map[string]interface{}{"matchLabels": selector},
+				"policyTypes": []interface{}{"Ingress"},
+				"ingress":     []interface{}{map[string]interface{}{"ports": ports}},
+			},
+		})
+	}
+	return policies
+}
+
+// pruneProvisionedObjects deletes the quotas, limit ranges and network policies
+// install-app created in a namespace that aren't among the objects to keep.
+func pruneProvisionedObjects(config *Config, namespace string, keep []map[string]interface{}) error {
+	out, err := exec.Command("kubectl", kubectlArgs(config, "get", "resourcequotas,limitranges,networkpolicies",
+		"-n", namespace, "-l", "app.kubernetes.io/managed-by=install-app", "-o", "json")...).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list the objects of namespace %s: %w", namespace, err)
+	}
+	var list struct {
+		Items []struct {
+			Kind     string `json:"kind"`
+			Metadata struct {
+				Name string `json:"name"`
+			} `json:"metadata"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(out, &list); err != nil {
+		return fmt.Errorf("failed to parse the objects of namespace %s: %w", namespace, err)
+	}
+	for _, item := range list.Items {
+		kept := slices.ContainsFunc(keep, func(obj map[string]interface{}) bool {
+			metadata, _ := obj["metadata"].(map[string]interface{})
+			return obj["kind"] == item.Kind && metadata["name"] == item.Metadata.Name
+		})
+		if kept {
+			continue
+		}
+		log.Printf("Deleting %s %s/%s, no longer provisioned", item.Kind, namespace, item.Metadata.Name)
+		ref := strings.ToLower(item.Kind) + "/" + item.Metadata.Name
+		if out, err := exec.Command("kubectl", kubectlArgs(config, "delete", ref, "-n", namespace)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to delete %s/%s: %w: %s", namespace, ref, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+func sortedStringKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
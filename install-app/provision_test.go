@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestDefaultDenyPolicies(t *testing.T) {
+	service := func(name, namespace, serviceType string) k8sResource {
+		return k8sResource{Kind: "Service", Name: name, Namespace: namespace, Object: map[string]interface{}{
+			"spec": map[string]interface{}{
+				"type":     serviceType,
+				"selector": map[string]interface{}{"name": name},
+				"ports":    []interface{}{map[string]interface{}{"port": 80.0, "targetPort": 8079.0}},
+			},
+		}}
+	}
+	resources := []k8sResource{
+		service("front-end", "sock-shop", "NodePort"),
+		service("carts", "sock-shop", "ClusterIP"),
+		service("grafana", "monitoring", "LoadBalancer"),
+	}
+	config := &Config{DryRun: true, provisioning: &namespaceProvisioning{defaultDeny: defaultDenyAll}}
+	network, err := newReleaseNetwork(config, []string{"sock-shop", "monitoring"}, resources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.apiServer = []interface{}{map[string]interface{}{
+		"to": []interface{}{map[string]interface{}{"ipBlock": map[string]interface{}{"cidr": "10.0.0.1/32"}}},
+	}}
+
+	objects, err := config.provisioning.objects(config, "sock-shop", network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, obj := range objects {
+		names = append(names, obj["metadata"].(map[string]interface{})["name"].(string))
+	}
+	if got, want := strings.Join(names, ","), "install-app-default-deny,install-app-default-deny-allow-front-end"; got != want {
+		t.Fatalf("objects = %s, want %s", got, want)
+	}
+
+	deny, _ := json.Marshal(objects[0]["spec"])
+	for _, want := range []string{
+		`"ingress":[{"from":[{"podSelector":{}},{"namespaceSelector":{"matchExpressions":[{"key":"kubernetes.io/metadata.name","operator":"In","values":["sock-shop","monitoring"]}]}}]}]`,
+		`{"ipBlock":{"cidr":"10.0.0.1/32"}}`,
+		`"policyTypes":["Ingress","Egress"]`,
+	} {
+		if !strings.Contains(string(deny), want) {
+			t.Errorf("default-deny spec %s lacks %s", deny, want)
+		}
+	}
+	allow, _ := json.Marshal(objects[1]["spec"])
+	if want := `{"ingress":[{"ports":[{"port":8079,"protocol":"TCP"}]}],"podSelector":{"matchLabels":{"name":"front-end"}},"policyTypes":["Ingress"]}`; string(allow) != want {
+		t.Errorf("allow spec = %s, want %s", allow, want)
+	}
+}
+
+func TestDefaultDenyIngressOnly(t *testing.T) {
+	config := &Config{provisioning: &namespaceProvisioning{defaultDeny: defaultDenyIngress}}
+	objects, err := config.provisioning.objects(config, "sock-shop", releaseNetwork{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 1 {
+		t.Fatalf("got %d objects, want the default-deny policy", len(objects))
+	}
+	spec, _ := json.Marshal(objects[0]["spec"])
+	if strings.Contains(string(spec), "egress") || !strings.Contains(string(spec), `"policyTypes":["Ingress"]`) {
+		t.Errorf("ingress mode spec = %s", spec)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+)
+
+var quantityRegexp = regexp.MustCompile(quantityPattern)
+
+// quantitySuffixes are the multipliers of Kubernetes resource quantity suffixes.
+var quantitySuffixes = map[string]float64{
+	"":   1,
+	"m":  1e-3,
+	"k":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"P":  1e15,
+	"E":  1e18,
+	"Ki": 1 << 10,
+	"Mi": 1 << 20,
+	"Gi": 1 << 30,
+	"Ti": 1 << 40,
+	"Pi": 1 << 50,
+	"Ei": 1 << 60,
+}
+
+// parseQuantity converts a resource quantity ("250m", "1.5Gi", 2) to its value in
+// base units (cores or bytes).
+func parseQuantity(v interface{}) (float64, bool) {
+	if n, ok := jsonNumber(v); ok {
+		return n, true
+	}
+	s, ok := v.(string)
+	if !ok || !quantityRegexp.MatchString(s) {
+		return 0, false
+	}
+
+	m := quantityRegexp.FindStringSubmatch(s)
+	suffix := m[len(m)-1]
+	n, err := strconv.ParseFloat(s[:len(s)-len(suffix)], 64)
+	if err != nil || math.IsInf(n, 0) {
+		return 0, false
+	}
+	return n * quantitySuffixes[suffix], true
+}
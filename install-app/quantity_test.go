@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want float64
+		ok   bool
+	}{
+		{"250m", 0.25, true},
+		{"1.5Gi", 1.5 * (1 << 30), true},
+		{"512Mi", 512 << 20, true},
+		{"2k", 2000, true},
+		{"1e3", 1000, true},
+		{"+.5", 0.5, true},
+		{"100", 100, true},
+		{int64(2), 2, true},
+		{0.5, 0.5, true},
+		{"", 0, false},
+		{"1 Gi", 0, false},
+		{"1gi", 0, false},
+		{"-1", 0, false},
+		{"1e999", 0, false},
+		{true, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseQuantity(tt.in)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseQuantity(%#v) = %v, %v, want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ociScheme = "oci://"
+
+// isRemoteChart reports whether the chart comes from an OCI registry or a classic
+// index.yaml chart repository rather than a folder under ChartsPath.
+func (c *Config) isRemoteChart() bool {
+	return c.Chart != ""
+}
+
+// remoteChartName returns the chart name of a remote reference: the last path
+// segment of an OCI reference, or the chart name itself for repository charts.
+func remoteChartName(chart string) string {
+	return path.Base(strings.TrimSuffix(strings.TrimPrefix(chart, ociScheme), "/"))
+}
+
+// defaultCacheDir returns the directory remote charts are cached in.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "install-app", "charts")
+}
+
+var unsafeCacheChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// chartCacheDir returns the cache directory for one remote chart source, so the
+// same chart name from two registries never shares an entry.
+func chartCacheDir(config *Config) string {
+	source := config.Chart
+	if config.Repo != "" {
+		source = strings.TrimSuffix(config.Repo, "/") + "/" + config.Chart
+	}
+	source = strings.TrimPrefix(source, ociScheme)
+	source = strings.TrimPrefix(strings.TrimPrefix(source, "https://"), "http://")
+	return filepath.Join(config.CacheDir, unsafeCacheChars.ReplaceAllString(source, "_"))
+}
+
+// fetchRemoteChart makes a packaged copy of the remote chart available in the local
+// cache and points the config at it. A pinned -version that is already cached is
+// used without contacting the registry; unpinned charts are always pulled, falling
+// back to the newest cached archive when the registry is unreachable.
+func fetchRemoteChart(config *Config) error {
+	cacheDir := chartCacheDir(config)
+	name := remoteChartName(config.Chart)
+
+	if config.Version != "" {
+		cached := filepath.Join(cacheDir, fmt.Sprintf("%s-%s.tgz", name, config.Version))
+		if _, err := os.Stat(cached); err == nil {
+			log.Printf("Using cached chart %s", cached)
+			config.resolvedChart = cached
+			return nil
+		}
+	}
+
+	archive, err := pullChart(config, cacheDir)
+	if err != nil {
+		if config.Version == "" {
+			if cached := newestArchive(cacheDir, name); cached != "" {
+				log.Printf("Warning: %v; using cached chart %s", err, cached)
+				config.resolvedChart = cached
+				return nil
+			}
+		}
+		return err
+	}
+
+	log.Printf("Cached chart %s", archive)
+	config.resolvedChart = archive
+	return nil
+}
+
+// pullChart downloads the chart archive and its provenance file into a scratch
+// directory and then moves them into cacheDir, so an interrupted pull never leaves
+// a partial archive in the cache.
+func pullChart(config *Config, cacheDir string) (string, error) {
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create chart cache: %w", err)
+	}
+	scratch, err := os.MkdirTemp(cacheDir, ".pull-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create chart cache: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	args := []string{"pull", config.Chart, "--destination", scratch}
+	if config.Repo != "" {
+		args = append(args, "--repo", config.Repo)
+	}
+	if config.Version != "" {
+		args = append(args, "--version", config.Version)
+	}
+	if config.Keyring != "" {
+		args = append(args, "--keyring", config.Keyring)
+	}
+	if config.PlainHTTP {
+		args = append(args, "--plain-http")
+	}
+
+	// verifyChart checks remote charts against their provenance file. helm fails the
+	// pull when the repository doesn't serve one, so then pull the archive alone and
+	// leave the verdict to verifyChart.
+	if err := runHelmPull(ctx, config, append(args, "--prov")); err != nil {
+		log.Printf("Warning: %v; pulling the chart without a provenance file", err)
+		if err := os.RemoveAll(scratch); err != nil {
+			return "", err
+		}
+		if err := os.Mkdir(scratch, 0o700); err != nil {
+			return "", fmt.Errorf("failed to create chart cache: %w", err)
+		}
+		if err := runHelmPull(ctx, config, args); err != nil {
+			return "", err
+		}
+	}
+
+	archives, err := filepath.Glob(filepath.Join(scratch, "*.tgz"))
+	if err != nil || len(archives) != 1 {
+		return "", fmt.Errorf("expected one chart archive from helm pull, found %d", len(archives))
+	}
+
+	files, err := filepath.Glob(filepath.Join(scratch, "*"))
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if err := os.Rename(f, filepath.Join(cacheDir, filepath.Base(f))); err != nil {
+			return "", fmt.Errorf("failed to store chart in cache: %w", err)
+		}
+	}
+	return filepath.Join(cacheDir, filepath.Base(archives[0])), nil
+}
+
+func runHelmPull(ctx context.Context, config *Config, args []string) error {
+	log.Printf("Pulling chart: helm %s", strings.Join(args, " "))
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "helm", args...)
+	cmd.Stdout = config.progressOutput()
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to pull chart %s: %w (%s)", config.Chart, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// newestArchive returns the <name>-<version>.tgz archive in dir with the highest
+// version, or "" if there is none.
+func newestArchive(dir, name string) string {
+	archives, err := filepath.Glob(filepath.Join(dir, name+"-*.tgz"))
+	if err != nil || len(archives) == 0 {
+		return ""
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		vi := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(archives[i]), name+"-"), ".tgz")
+		vj := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(archives[j]), name+"-"), ".tgz")
+		return compareVersions(vi, vj) < 0
+	})
+	return archives[len(archives)-1]
+}
+
+// compareVersions compares two dotted versions numerically (1.10.0 > 1.9.0), with
+// a pre-release suffix sorting before the release itself.
+func compareVersions(a, b string) int {
+	a, b = strings.TrimPrefix(a, "v"), strings.TrimPrefix(b, "v")
+	aCore, aPre, _ := strings.Cut(a, "-")
+	bCore, bPre, _ := strings.Cut(b, "-")
+
+	aParts, bParts := strings.Split(aCore, "."), strings.Split(bCore, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var an, bn int
+		if i < len(aParts) {
+			fmt.Sscanf(aParts[i], "%d", &an)
+		}
+		if i < len(bParts) {
+			fmt.Sscanf(bParts[i], "%d", &bn)
+		}
+		if an != bn {
+			if an < bn {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	switch {
+	case aPre == bPre:
+		return 0
+	case aPre == "":
+		return 1
+	case bPre == "":
+		return -1
+	default:
+		return strings.Compare(aPre, bPre)
+	}
+}
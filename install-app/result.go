@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// installResult summarises an install for -output json and -result-file, so that
+// scripts don't have to scrape the log.
+type installResult struct {
+	Release   string `json:"release"`
+	Namespace string `json:"namespace"`
+	Chart     string `json:"chart"`
+	Version   string `json:"version,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	DryRun    bool   `json:"dryRun,omitempty"`
+	// Status is "deployed", "dry-run", or "failed" with Error set.
+	Status    string               `json:"status"`
+	Error     string               `json:"error,omitempty"`
+	NodePorts []nodePortAssignment `json:"nodePorts,omitempty"`
+	// Services and ExcludedServices list the microservices installed and left out
+	// with -services.
+	Services         []string `json:"services,omitempty"`
+	ExcludedServices []string `json:"excludedServices,omitempty"`
+	// Prerequisites are the cluster prerequisites the chart needed.
+	Prerequisites []prerequisiteResult `json:"prerequisites,omitempty"`
+	// Credentials are the credentials of the chart, without their passwords.
+	Credentials []credentialResult `json:"credentials,omitempty"`
+	// Policy lists the rendered objects breaking policy rules.
+	Policy []policyFinding `json:"policy,omitempty"`
+	// Compatibility and Preflight are the checks of -preflight-mode.
+	Compatibility *compatibilityReport `json:"compatibility,omitempty"`
+	Preflight     *preflightReport     `json:"preflight,omitempty"`
+	// Fit lists the requests and heap sizes -fit-to-cluster scaled down.
+	Fit    *fitResult     `json:"fit,omitempty"`
+	Access *accessSummary `json:"access,omitempty"`
+}
+
+// progressOutput is where helm and kubectl progress goes: stdout, unless stdout is
+// reserved for the JSON result.
+func (c *Config) progressOutput() io.Writer {
+	if c.Output == "json" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// writeResult completes the result with the outcome of the install and writes it to
+// -result-file and, with -output json, to stdout.
+func writeResult(config *Config, installErr error) error {
+	if config.Output != "json" && config.ResultFile == "" {
+		return nil
+	}
+
+	result := config.result
+	if result == nil {
+		result = &installResult{}
+	}
+	result.Release = config.ReleaseName
+	result.Namespace = config.Namespace
+	result.Chart = config.FolderName
+	if config.isRemoteChart() {
+		result.Chart = config.Chart
+	}
+	result.Version = config.resolvedVersion
+	if result.Version == "" {
+		result.Version = config.Version
+	}
+	result.Instance = config.Instance
+	result.DryRun = config.DryRun
+	result.Status = "deployed"
+	if config.DryRun {
+		result.Status = "dry-run"
+	}
+	if installErr != nil {
+		result.Status = "failed"
+		result.Error = installErr.Error()
+	}
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if config.ResultFile != "" {
+		if err := os.WriteFile(config.ResultFile, data, 0644); err != nil {
+			return fmt.Errorf("failed to write result file: %w", err)
+		}
+	}
+	if config.Output == "json" {
+		_, err = os.Stdout.Write(data)
+	}
+	return err
+}
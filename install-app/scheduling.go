@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// schedulingRule sets scheduling fields in the rendered pod templates whose labels
+// match Selector, or in every pod template without one.
+type schedulingRule struct {
+	Selector          string                   `json:"selector,omitempty"`
+	NodeSelector      map[string]string        `json:"nodeSelector,omitempty"`
+	Tolerations       []map[string]interface{} `json:"tolerations,omitempty"`
+	Affinity          map[string]interface{}   `json:"affinity,omitempty"`
+	PriorityClassName string                   `json:"priorityClassName,omitempty"`
+}
+
+func (r schedulingRule) String() string {
+	var parts []string
+	for key, value := range r.NodeSelector {
+		parts = append(parts, "nodeSelector "+key+"="+value)
+	}
+	sort.Strings(parts)
+	for _, t := range r.Tolerations {
+		parts = append(parts, "toleration "+formatToleration(t))
+	}
+	for _, key := range sortedKeys(r.Affinity) {
+		parts = append(parts, key)
+	}
+	if r.PriorityClassName != "" {
+		parts = append(parts, "priorityClassName "+r.PriorityClassName)
+	}
+	pods := "all pods"
+	if r.Selector != "" {
+		pods = "pods matching " + r.Selector
+	}
+	return pods + ": " + strings.Join(parts, ", ")
+}
+
+// tolerationEffects are the taint effects a toleration can name.
+var tolerationEffects = []string{"NoSchedule", "PreferNoSchedule", "NoExecute"}
+
+// resolveScheduling collects the scheduling rules: the config file's scheduling
+// entries, then one for the -node-selector, -toleration, -affinity and
+// -priority-class flags limited to -scheduling-selector. Helm's post-renderer applies
+// them, see postRendererArgs.
+func resolveScheduling(config *Config) error {
+	rules := append([]schedulingRule(nil), config.Scheduling...)
+
+	var rule schedulingRule
+	for _, item := range config.NodeSelector {
+		for _, pair := range strings.Split(item, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok || key == "" {
+				return fmt.Errorf("invalid -node-selector %s: expected key=value", pair)
+			}
+			if rule.NodeSelector == nil {
+				rule.NodeSelector = map[string]string{}
+			}
+			rule.NodeSelector[key] = value
+		}
+	}
+	for _, item := range config.Tolerations {
+		for _, spec := range strings.Split(item, ",") {
+			toleration, err := parseToleration(spec)
+			if err != nil {
+				return err
+			}
+			rule.Tolerations = append(rule.Tolerations, toleration)
+		}
+	}
+	if config.Affinity != "" {
+		affinity, err := parseAffinity(config.Affinity)
+		if err != nil {
+			return err
+		}
+		rule.Affinity = affinity
+	}
+	rule.PriorityClassName = config.PriorityClass
+	if rule.NodeSelector != nil || rule.Tolerations != nil || rule.Affinity != nil || rule.PriorityClassName != "" {
+		rule.Selector = config.SchedulingSelector
+		rules = append(rules, rule)
+	} else if config.SchedulingSelector != "" {
+		return fmt.Errorf("-scheduling-selector needs -node-selector, -toleration, -affinity or -priority-class")
+	}
+
+	for i, r := range rules {
+		if _, err := parseLabelSelector(r.Selector); err != nil {
+			return fmt.Errorf("invalid scheduling selector %q: %w", r.Selector, err)
+		}
+		for _, t := range r.Tolerations {
+			if effect, _ := t["effect"].(string); effect != "" && !slices.Contains(tolerationEffects, effect) {
+				return fmt.Errorf("invalid toleration effect %q: must be one of %s", effect, strings.Join(tolerationEffects, ", "))
+			}
+		}
+		rules[i].Affinity, _ = normalizeNumbers(r.Affinity).(map[string]interface{})
+		for j, t := range r.Tolerations {
+			rules[i].Tolerations[j], _ = normalizeNumbers(t).(map[string]interface{})
+		}
+		log.Printf("Scheduling %s", r)
+	}
+	config.scheduling = rules
+	return nil
+}
+
+// parseToleration parses a toleration written like a taint, key[=value][:effect]. A
+// toleration without a value tolerates the key with any value.
+func parseToleration(spec string) (map[string]interface{}, error) {
+	spec = strings.TrimSpace(spec)
+	keyValue, effect, _ := strings.Cut(spec, ":")
+	key, value, hasValue := strings.Cut(keyValue, "=")
+	if key == "" {
+		return nil, fmt.Errorf("invalid -toleration %q: expected key[=value][:effect]", spec)
+	}
+	toleration := map[string]interface{}{"key": key, "operator": "Exists"}
+	if hasValue {
+		toleration["operator"] = "Equal"
+		toleration["value"] = value
+	}
+	if effect != "" {
+		toleration["effect"] = effect
+	}
+	return toleration, nil
+}
+
+func formatToleration(t map[string]interface{}) string {
+	s := scalarString(t["key"])
+	if t["operator"] != "Exists" {
+		s += "=" + scalarString(t["value"])
+	}
+	if effect, _ := t["effect"].(string); effect != "" {
+		s += ":" + effect
+	}
+	return s
+}
+
+// parseAffinity parses -affinity, a pod affinity in JSON or YAML, or @file to read it
+// from a file.
+func parseAffinity(value string) (map[string]interface{}, error) {
+	data := []byte(value)
+	if path, ok := strings.CutPrefix(value, "@"); ok {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("failed to read -affinity: %w", err)
+		}
+	}
+	parsed, err := parseYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid -affinity: %w", err)
+	}
+	affinity, ok := parsed.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid -affinity: expected a mapping of nodeAffinity, podAffinity or podAntiAffinity")
+	}
+	for key := range affinity {
+		if key != "nodeAffinity" && key != "podAffinity" && key != "podAntiAffinity" {
+			return nil, fmt.Errorf("invalid -affinity: unknown field %s", key)
+		}
+	}
+	return affinity, nil
+}
+
+// podTemplate returns the pod labels and pod spec of a pod or of the pod template of a
+// workload.
+func podTemplate(kind string, obj map[string]interface{}) (map[string]string, map[string]interface{}) {
+	template := obj
+	spec, _ := obj["spec"].(map[string]interface{})
+	switch kind {
+	case "Pod":
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		template, _ = spec["template"].(map[string]interface{})
+	case "CronJob":
+		jobTemplate, _ := spec["jobTemplate"].(map[string]interface{})
+		jobSpec, _ := jobTemplate["spec"].(map[string]interface{})
+		template, _ = jobSpec["template"].(map[string]interface{})
+	default:
+		return nil, nil
+	}
+	metadata, _ := template["metadata"].(map[string]interface{})
+	podSpec, _ := template["spec"].(map[string]interface{})
+	labels := map[string]string{}
+	if m, ok := metadata["labels"].(map[string]interface{}); ok {
+		for k, v := range m {
+			labels[k] = scalarString(v)
+		}
+	}
+	return labels, podSpec
+}
+
+// applyScheduling applies the rules matching a pod template to its spec and reports
+// whether any did. Node selectors are merged, tolerations added, and affinity
+// types and the priority class replaced.
+func applyScheduling(rules []schedulingRule, labels map[string]string, podSpec map[string]interface{}) bool {
+	applied := false
+	for _, rule := range rules {
+		selector, _ := parseLabelSelector(rule.Selector)
+		if !selector.matches(labels) {
+			continue
+		}
+		applied = true
+		if len(rule.NodeSelector) > 0 {
+			nodeSelector, _ := podSpec["nodeSelector"].(map[string]interface{})
+			if nodeSelector == nil {
+				nodeSelector = map[string]interface{}{}
+			}
+			for k, v := range rule.NodeSelector {
+				nodeSelector[k] = v
+			}
+			podSpec["nodeSelector"] = nodeSelector
+		}
+		tolerations, _ := podSpec["tolerations"].([]interface{})
+		for _, t := range rule.Tolerations {
+			if !slices.ContainsFunc(tolerations, func(existing interface{}) bool {
+				return jsonEqual(existing, map[string]interface{}(t))
+			}) {
+				tolerations = append(tolerations, copyValues(map[string]interface{}(t)))
+			}
+		}
+		if len(tolerations) > 0 {
+			podSpec["tolerations"] = tolerations
+		}
+		if len(rule.Affinity) > 0 {
+			affinity, _ := podSpec["affinity"].(map[string]interface{})
+			if affinity == nil {
+				affinity = map[string]interface{}{}
+			}
+			for k, v := range rule.Affinity {
+				affinity[k] = copyValues(v)
+			}
+			podSpec["affinity"] = affinity
+		}
+		if rule.PriorityClassName != "" {
+			podSpec["priorityClassName"] = rule.PriorityClassName
+			// The admission controller sets the priority from the class and rejects a
+			// pod whose priority was set for another class.
+			delete(podSpec, "priority")
+		}
+	}
+	return applied
+}
+
+// checkSchedulingTargets warns about scheduling rules whose selector matches none of
+// the rendered pod templates.
+func checkSchedulingTargets(config *Config, resources []k8sResource) {
+	for _, rule := range config.scheduling {
+		selector, _ := parseLabelSelector(rule.Selector)
+		matched := slices.ContainsFunc(resources, func(res k8sResource) bool {
+			labels, podSpec := podTemplate(res.Kind, res.Object)
+			return podSpec != nil && selector.matches(labels)
+		})
+		if !matched {
+			log.Printf("Warning: scheduling selector %q matches no rendered pod", rule.Selector)
+		}
+	}
+}
+
+// labelRequirement is one requirement of a label selector or of a node selector term.
+// Operator is In, NotIn, Exists, DoesNotExist, Gt or Lt.
+type labelRequirement struct {
+	Key      string
+	Operator string
+	Values   []string
+}
+
+// labelSelector is a conjunction of requirements; the empty selector matches
+// everything.
+type labelSelector []labelRequirement
+
+var (
+	labelKey       = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_./]*[A-Za-z0-9])?$`)
+	setRequirement = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\(([^)]*)\)$`)
+)
+
+// parseLabelSelector parses kubectl's label selector syntax: key=value, key==value,
+// key!=value, key in (a,b), key notin (a,b), key and !key, separated by commas.
+func parseLabelSelector(s string) (labelSelector, error) {
+	var selector labelSelector
+	for _, term := range splitSelector(s) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var r labelRequirement
+		if m := setRequirement.FindStringSubmatch(term); m != nil {
+			r = labelRequirement{Key: m[1], Operator: "In"}
+			if m[2] == "notin" {
+				r.Operator = "NotIn"
+			}
+			for _, v := range strings.Split(m[3], ",") {
+				r.Values = append(r.Values, strings.TrimSpace(v))
+			}
+		} else if key, value, ok := strings.Cut(term, "!="); ok {
+			r = labelRequirement{Key: strings.TrimSpace(key), Operator: "NotIn", Values: []string{strings.TrimSpace(value)}}
+		} else if key, value, ok := strings.Cut(term, "="); ok {
+			value = strings.TrimPrefix(value, "=")
+			r = labelRequirement{Key: strings.TrimSpace(key), Operator: "In", Values: []string{strings.TrimSpace(value)}}
+		} else if key, ok := strings.CutPrefix(term, "!"); ok {
+			r = labelRequirement{Key: strings.TrimSpace(key), Operator: "DoesNotExist"}
+		} else {
+			r = labelRequirement{Key: term, Operator: "Exists"}
+		}
+		if !labelKey.MatchString(r.Key) {
+			return nil, fmt.Errorf("invalid label key %q", r.Key)
+		}
+		selector = append(selector, r)
+	}
+	return selector, nil
+}
+
+// splitSelector splits a selector on the commas outside of parentheses.
+func splitSelector(s string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, s[start:])
+}
+
+func (s labelSelector) matches(labels map[string]string) bool {
+	for _, r := range s {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r labelRequirement) matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case "In":
+		return ok && slices.Contains(r.Values, value)
+	case "NotIn":
+		return !ok || !slices.Contains(r.Values, value)
+	case "Exists":
+		return ok
+	case "DoesNotExist":
+		return !ok
+	case "Gt", "Lt":
+		if !ok || len(r.Values) != 1 {
+			return false
+		}
+		have, err1 := strconv.ParseInt(value, 10, 64)
+		want, err2 := strconv.ParseInt(r.Values[0], 10, 64)
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		return (r.Operator == "Gt" && have > want) || (r.Operator == "Lt" && have < want)
+	}
+	return false
+}
+
+// nodeTaint is a taint of a node.
+type nodeTaint struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Effect string `json:"effect"`
+}
+
+// podFitsNode reports whether the scheduler may place a pod on a node: the node has
+// the labels of the pod's nodeSelector, matches one of the terms of its required node
+// affinity, and the pod tolerates the node's NoSchedule and NoExecute taints.
+func podFitsNode(podSpec map[string]interface{}, labels map[string]string, taints []nodeTaint) bool {
+	nodeSelector, _ := podSpec["nodeSelector"].(map[string]interface{})
+	for k, v := range nodeSelector {
+		if value, ok := labels[k]; !ok || value != scalarString(v) {
+			return false
+		}
+	}
+
+	affinity, _ := podSpec["affinity"].(map[string]interface{})
+	nodeAffinity, _ := affinity["nodeAffinity"].(map[string]interface{})
+	required, _ := nodeAffinity["requiredDuringSchedulingIgnoredDuringExecution"].(map[string]interface{})
+	if terms, ok := required["nodeSelectorTerms"].([]interface{}); ok && len(terms) > 0 {
+		if !slices.ContainsFunc(terms, func(term interface{}) bool { return nodeSelectorTermMatches(term, labels) }) {
+			return false
+		}
+	}
+
+	tolerations, _ := podSpec["tolerations"].([]interface{})
+	for _, taint := range taints {
+		if taint.Effect != "NoSchedule" && taint.Effect != "NoExecute" {
+			continue
+		}
+		if !slices.ContainsFunc(tolerations, func(t interface{}) bool { return tolerates(t, taint) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// nodeSelectorTermMatches matches the label expressions of a node selector term.
+// Field expressions (metadata.name) aren't checked.
+func nodeSelectorTermMatches(term interface{}, labels map[string]string) bool {
+	m, _ := term.(map[string]interface{})
+	expressions, _ := m["matchExpressions"].([]interface{})
+	for _, item := range expressions {
+		e, _ := item.(map[string]interface{})
+		r := labelRequirement{Key: scalarString(e["key"]), Operator: scalarString(e["operator"])}
+		values, _ := e["values"].([]interface{})
+		for _, v := range values {
+			r.Values = append(r.Values, scalarString(v))
+		}
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// tolerates reports whether a toleration of a pod spec tolerates a taint.
+func tolerates(toleration interface{}, taint nodeTaint) bool {
+	t, _ := toleration.(map[string]interface{})
+	if effect, _ := t["effect"].(string); effect != "" && effect != taint.Effect {
+		return false
+	}
+	key, _ := t["key"].(string)
+	if t["operator"] == "Exists" {
+		return key == "" || key == taint.Key
+	}
+	value, _ := t["value"].(string)
+	return key == taint.Key && value == taint.Value
+}
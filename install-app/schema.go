@@ -0,0 +1,363 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// valuesSchemaFile is the JSON schema Helm validates chart values against.
+const valuesSchemaFile = "values.schema.json"
+
+// quantityPattern matches Kubernetes resource quantities such as 100m, 1.5, 512Mi or 1e3.
+const quantityPattern = `^[+]?([0-9]+(\.[0-9]*)?|\.[0-9]+)([eE][+-]?[0-9]+)?(m|k|M|G|T|P|E|Ki|Mi|Gi|Ti|Pi|Ei)?$`
+
+// valuesValidationError lists every problem found in the merged values.
+type valuesValidationError struct {
+	Source   string
+	Problems []schemaProblem
+}
+
+func (e *valuesValidationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = "  " + p.String()
+	}
+	return fmt.Sprintf("values do not match %s:\n%s", e.Source, strings.Join(lines, "\n"))
+}
+
+// prepareValues merges the values the chart will be rendered with, writes them to
+// -values-output and validates them, so mistakes are reported before anything
+// touches the cluster.
+func prepareValues(config *Config) error {
+	if !config.ValidateValues && config.ValuesOutput == "" {
+		return nil
+	}
+
+	values, err := computeValues(config)
+	if err != nil {
+		return err
+	}
+	if err := writeValuesArtifact(config, values); err != nil {
+		return err
+	}
+	if !config.ValidateValues {
+		return nil
+	}
+	return validateValues(config, values)
+}
+
+// validateValues checks merged values against the chart's values.schema.json, or a
+// schema generated from its values.yaml when it doesn't ship one.
+func validateValues(config *Config, values map[string]interface{}) error {
+	schema, source, err := loadValuesSchema(config.chartPath())
+	if err != nil {
+		return err
+	}
+
+	problems := validateJSONSchema(schema, values)
+	problems = append(problems, checkResourceLimits(values, "$")...)
+	dependencies, err := checkComponentDependencies(config.chartPath(), values)
+	if err != nil {
+		return err
+	}
+	problems = append(problems, dependencies...)
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Path < problems[j].Path })
+	if len(problems) > 0 {
+		return &valuesValidationError{Source: source, Problems: problems}
+	}
+	log.Printf("Values match %s", source)
+	return nil
+}
+
+// loadValuesSchema returns the schema shipped with a chart, or one generated from its
+// values.yaml, and a description of where it came from.
+func loadValuesSchema(chartPath string) (map[string]interface{}, string, error) {
+	data, err := readChartFile(chartPath, valuesSchemaFile)
+	if err == nil {
+		doc, err := decodeJSONValue(data)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid %s: %w", valuesSchemaFile, err)
+		}
+		schema, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, "", fmt.Errorf("invalid %s: must contain an object", valuesSchemaFile)
+		}
+		return schema, valuesSchemaFile, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, "", err
+	}
+
+	schema, err := generateChartSchema(chartPath)
+	if err != nil {
+		return nil, "", err
+	}
+	return schema, "the schema generated from values.yaml", nil
+}
+
+// generateChartSchema generates a values schema from a chart's values.yaml.
+func generateChartSchema(chartPath string) (map[string]interface{}, error) {
+	data, err := readChartFile(chartPath, "values.yaml")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	values, err := readValuesFile("values.yaml", data)
+	if err != nil {
+		return nil, err
+	}
+	schema := generateValuesSchema(values, commentedValues(data))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	return schema, nil
+}
+
+// generateValuesSchema derives a strict schema from default values: maps only accept
+// the keys they declare (or show commented out), scalars keep their type, replicas
+// can't be negative, ports must be valid and resources must be valid quantities.
+// Empty maps are left open for arbitrary keys.
+func generateValuesSchema(values map[string]interface{}, commented map[string]map[string]interface{}) map[string]interface{} {
+	return objectSchema("", values, commented)
+}
+
+func objectSchema(path string, values map[string]interface{}, commented map[string]map[string]interface{}) map[string]interface{} {
+	if len(values) == 0 && len(commented[path]) == 0 {
+		return map[string]interface{}{"type": "object"}
+	}
+
+	properties := map[string]interface{}{}
+	for key, value := range commented[path] {
+		properties[key] = valueSchema(joinValuesPath(path, key), key, value, commented)
+	}
+	for key, value := range values {
+		properties[key] = valueSchema(joinValuesPath(path, key), key, value, commented)
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+func valueSchema(path, key string, value interface{}, commented map[string]map[string]interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if key == "resources" {
+			return resourcesSchema(v)
+		}
+		return objectSchema(path, v, commented)
+	case []interface{}:
+		schema := map[string]interface{}{"type": "array"}
+		if itemType := commonJSONType(v); itemType != "" {
+			schema["items"] = map[string]interface{}{"type": itemType}
+		}
+		return schema
+	case nil:
+		return map[string]interface{}{}
+	}
+
+	schema := map[string]interface{}{"type": scalarJSONType(value)}
+	if schema["type"] == "integer" {
+		switch key {
+		case "replicas":
+			schema["minimum"] = 0
+		case "port", "targetPort", "nodePort", "containerPort":
+			schema["minimum"] = 1
+			schema["maximum"] = 65535
+		}
+	}
+	if key == "imagePullPolicy" {
+		schema["enum"] = []interface{}{"Always", "IfNotPresent", "Never"}
+	}
+	if key == "type" && strings.HasSuffix(path, ".service.type") {
+		schema["enum"] = []interface{}{"ClusterIP", "NodePort", "LoadBalancer", "ExternalName"}
+	}
+	return schema
+}
+
+// resourcesSchema accepts requests and limits of cpu, memory, ephemeralStorage and any
+// resource the defaults name, each a non-negative quantity.
+func resourcesSchema(defaults map[string]interface{}) map[string]interface{} {
+	names := map[string]bool{"cpu": true, "memory": true, "ephemeralStorage": true}
+	for _, section := range []string{"requests", "limits"} {
+		if m, ok := defaults[section].(map[string]interface{}); ok {
+			for name := range m {
+				names[name] = true
+			}
+		}
+	}
+
+	quantities := map[string]interface{}{}
+	for name := range names {
+		quantities[name] = map[string]interface{}{
+			"type":    []interface{}{"string", "integer", "number"},
+			"pattern": quantityPattern,
+			"minimum": 0,
+		}
+	}
+	section := map[string]interface{}{
+		"type":                 "object",
+		"properties":           quantities,
+		"additionalProperties": false,
+	}
+	return map[string]interface{}{
+		"type":                 "object",
+		"properties":           map[string]interface{}{"requests": section, "limits": section},
+		"additionalProperties": false,
+	}
+}
+
+func scalarJSONType(v interface{}) string {
+	switch v.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int64, int:
+		return "integer"
+	case float64:
+		return "number"
+	}
+	return ""
+}
+
+// commonJSONType returns the scalar type shared by every item of a list, or "".
+func commonJSONType(list []interface{}) string {
+	common := ""
+	for i, item := range list {
+		t := scalarJSONType(item)
+		if t == "" || (i > 0 && t != common) {
+			return ""
+		}
+		common = t
+	}
+	return common
+}
+
+func joinValuesPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+var commentedKeyLine = regexp.MustCompile(`^(\s*)#\s*([a-z][A-Za-z0-9_-]*):(\s.*)?$`)
+var valuesKeyLine = regexp.MustCompile(`^(\s*)([A-Za-z_][A-Za-z0-9_-]*):(\s|$)`)
+
+// commentedValues finds keys that values.yaml documents as commented-out examples
+// ("# username: """) so the generated schema accepts them. The result maps the
+// dotted path of the parent map to the example keys and values.
+func commentedValues(data []byte) map[string]map[string]interface{} {
+	type level struct {
+		indent int
+		key    string
+	}
+	var stack []level
+	result := map[string]map[string]interface{}{}
+
+	parentPath := func(indent int) string {
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		keys := make([]string, len(stack))
+		for i, l := range stack {
+			keys[i] = l.key
+		}
+		return strings.Join(keys, ".")
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if m := commentedKeyLine.FindStringSubmatch(line); m != nil {
+			parent := parentPath(len(m[1]))
+			doc, err := parseYAML([]byte(m[2] + ":" + m[3]))
+			if err != nil {
+				continue
+			}
+			entry, _ := doc.(map[string]interface{})
+			if result[parent] == nil {
+				result[parent] = map[string]interface{}{}
+			}
+			result[parent][m[2]] = entry[m[2]]
+			continue
+		}
+		if m := valuesKeyLine.FindStringSubmatch(line); m != nil {
+			parentPath(len(m[1]))
+			stack = append(stack, level{indent: len(m[1]), key: m[2]})
+		}
+	}
+	return result
+}
+
+// checkResourceLimits reports resource requests that exceed their limits anywhere in
+// the values.
+func checkResourceLimits(values interface{}, path string) []schemaProblem {
+	var problems []schemaProblem
+	switch v := values.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			child := jsonPathKey(path, key)
+			if resources, ok := v[key].(map[string]interface{}); ok && key == "resources" {
+				requests, _ := resources["requests"].(map[string]interface{})
+				limits, _ := resources["limits"].(map[string]interface{})
+				for _, name := range sortedKeys(requests) {
+					request, okRequest := parseQuantity(requests[name])
+					limit, okLimit := parseQuantity(limits[name])
+					if okRequest && okLimit && request > limit {
+						problems = append(problems, schemaProblem{
+							Path:    jsonPathKey(child+".requests", name),
+							Message: fmt.Sprintf("request %v exceeds limit %v", requests[name], limits[name]),
+						})
+					}
+				}
+				continue
+			}
+			problems = append(problems, checkResourceLimits(v[key], child)...)
+		}
+	case []interface{}:
+		for i, item := range v {
+			problems = append(problems, checkResourceLimits(item, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return problems
+}
+
+// runSchema implements `install-app schema`, printing the values schema install-app
+// validates a chart against. With -generate it ignores a shipped values.schema.json,
+// so the output can seed one.
+func runSchema(args []string) error {
+	config := &Config{}
+	var generate bool
+
+	flags := flag.NewFlagSet("schema", flag.ExitOnError)
+	flags.StringVar(&config.FolderName, "folder", "", "Name of the folder containing the chart (required)")
+	flags.StringVar(&config.Version, "version", "", "Chart version (defaults to the latest)")
+	flags.StringVar(&config.ChartsPath, "charts-path", "", "Base path where charts are located (defaults to the embedded charts, or "+defaultChartsPath+")")
+	flags.BoolVar(&generate, "generate", false, "Generate the schema from values.yaml even if the chart ships "+valuesSchemaFile)
+	flags.Parse(args)
+
+	if config.FolderName == "" {
+		return fmt.Errorf("folder name is required. Use -folder flag")
+	}
+	cleanup, err := resolveChartsPath(config)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if err := validateChartFolder(config); err != nil {
+		return err
+	}
+
+	var schema map[string]interface{}
+	if generate {
+		schema, err = generateChartSchema(config.chartPath())
+	} else {
+		schema, _, err = loadValuesSchema(config.chartPath())
+	}
+	if err != nil {
+		return err
+	}
+	return printJSON(schema)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// servicesValueAnnotation is the Chart.yaml annotation naming the list value that
+// selects which microservices the chart installs (empty for all), e.g.
+//
+//	install-app/services-value: sockShop.services
+const servicesValueAnnotation = "install-app/services-value"
+
+// microservice is a microservice of an application in the ChartServiceVersion.
+type microservice struct {
+	Name      string   `json:"name"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+// resolveServices narrows the install to the -services microservices and everything
+// they depend on: the dependsOn of the ChartServiceVersion plus the services the
+// rendered containers reference in their env, args and command.
+func resolveServices(config *Config) (func(), error) {
+	requested := annotationList(strings.Join(config.Services, ","))
+	if len(requested) == 0 {
+		return func() {}, nil
+	}
+
+	annotations, err := chartAnnotations(config.chartPath())
+	if err != nil {
+		return nil, err
+	}
+	key := annotations[servicesValueAnnotation]
+	if key == "" {
+		return nil, fmt.Errorf("chart does not support -services: Chart.yaml has no %s annotation", servicesValueAnnotation)
+	}
+
+	known, err := chartMicroservices(config)
+	if err != nil {
+		return nil, err
+	}
+	resources, err := renderChart(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(known) == 0 {
+		// Without a ChartServiceVersion entry, every rendered Deployment is a service.
+		for _, res := range resources {
+			if res.Kind == "Deployment" {
+				known[res.Name] = &microservice{Name: res.Name}
+			}
+		}
+	}
+
+	deps := map[string][]string{}
+	for name, svc := range known {
+		deps[name] = append(deps[name], svc.DependsOn...)
+	}
+	for _, res := range resources {
+		if _, ok := known[res.Name]; !ok || (res.Kind != "Deployment" && res.Kind != "StatefulSet") {
+			continue
+		}
+		for _, host := range referencedHosts(res.Object) {
+			if _, ok := known[host]; ok && host != res.Name {
+				deps[res.Name] = append(deps[res.Name], host)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(known))
+	for name := range known {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	included := map[string]bool{}
+	queue := append([]string{}, requested...)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if included[name] {
+			continue
+		}
+		if _, ok := known[name]; !ok {
+			return nil, fmt.Errorf("unknown service %s (available: %s)", name, strings.Join(names, ", "))
+		}
+		included[name] = true
+		queue = append(queue, deps[name]...)
+	}
+
+	var install, added, excluded []string
+	for _, name := range names {
+		switch {
+		case !included[name]:
+			excluded = append(excluded, name)
+		case !slices.Contains(requested, name):
+			added = append(added, name)
+			install = append(install, name)
+		default:
+			install = append(install, name)
+		}
+	}
+	log.Printf("Installing services: %s", strings.Join(install, ", "))
+	if len(added) > 0 {
+		log.Printf("Added as dependencies: %s", strings.Join(added, ", "))
+	}
+	if len(excluded) > 0 {
+		log.Printf("Excluded services: %s", strings.Join(excluded, ", "))
+	}
+	config.result.Services = install
+	config.result.ExcludedServices = excluded
+
+	list, err := json.Marshal(install)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if err := parseSetValues(values, key+"="+string(list), setJSON); err != nil {
+		return nil, err
+	}
+	path, err := writeTempValues("install-app-services-*.yaml", values)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write service values: %w", err)
+	}
+	config.servicesValuesFile = path
+	return func() { os.Remove(path) }, nil
+}
+
+// chartMicroservices returns the microservices the ChartServiceVersion next to the
+// charts lists for the chart, keyed by name. It is empty for remote charts and
+// charts the ChartServiceVersion doesn't list.
+func chartMicroservices(config *Config) (map[string]*microservice, error) {
+	known := map[string]*microservice{}
+	if config.isRemoteChart() {
+		return known, nil
+	}
+	data, err := os.ReadFile(filepath.Join(config.ChartsPath, chartServiceVersionFile))
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var csv struct {
+		Spec struct {
+			Applications []struct {
+				Name          string         `json:"name"`
+				Microservices []microservice `json:"microservices"`
+			} `json:"applications"`
+		} `json:"spec"`
+	}
+	if err := decodeYAMLInto(data, &csv); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", chartServiceVersionFile, err)
+	}
+	for _, app := range csv.Spec.Applications {
+		if app.Name != config.FolderName {
+			continue
+		}
+		for i := range app.Microservices {
+			known[app.Microservices[i].Name] = &app.Microservices[i]
+		}
+	}
+	return known, nil
+}
+
+var hostToken = regexp.MustCompile(`[a-z0-9][-a-z0-9.]*`)
+
+// referencedHosts returns the host names (first DNS label) that the containers of a
+// workload mention in their env values, args and command, e.g. "user-db" for
+// MONGO_HOST=user-db:27017.
+func referencedHosts(object map[string]interface{}) []string {
+	spec, _ := object["spec"].(map[string]interface{})
+	template, _ := spec["template"].(map[string]interface{})
+	podSpec, _ := template["spec"].(map[string]interface{})
+
+	var texts []string
+	for _, field := range []string{"initContainers", "containers"} {
+		containers, _ := podSpec[field].([]interface{})
+		for _, c := range containers {
+			container, _ := c.(map[string]interface{})
+			env, _ := container["env"].([]interface{})
+			for _, e := range env {
+				if entry, ok := e.(map[string]interface{}); ok {
+					if value, ok := entry["value"].(string); ok {
+						texts = append(texts, value)
+					}
+				}
+			}
+			for _, list := range []string{"args", "command"} {
+				items, _ := container[list].([]interface{})
+				for _, item := range items {
+					if s, ok := item.(string); ok {
+						texts = append(texts, s)
+					}
+				}
+			}
+		}
+	}
+
+	var hosts []string
+	for _, text := range texts {
+		for _, token := range hostToken.FindAllString(text, -1) {
+			host, _, _ := strings.Cut(token, ".")
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSetValues(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "script.sh")
+	if err := os.WriteFile(file, []byte("#!/bin/sh\necho hi\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		expr string
+		kind setKind
+		want map[string]interface{}
+	}{
+		// null is kept as a value: merging it into the chart's values deletes the key.
+		{"typed", "a=1,b=true,c=null,d=text,e=007,f=-2,g=1.5", setTyped, map[string]interface{}{
+			"a": int64(1), "b": true, "c": nil, "d": "text", "e": "007", "f": int64(-2), "g": "1.5",
+		}},
+		{"nested", "a.b.c=x,a.d=y", setTyped, map[string]interface{}{
+			"a": map[string]interface{}{"b": map[string]interface{}{"c": "x"}, "d": "y"},
+		}},
+		{"list value", "a={x,1,true},b={}", setTyped, map[string]interface{}{
+			"a": []interface{}{"x", int64(1), true}, "b": []interface{}{},
+		}},
+		{"list index", "a[1]=x,a[0].b=y", setTyped, map[string]interface{}{
+			"a": []interface{}{map[string]interface{}{"b": "y"}, "x"},
+		}},
+		{"escapes", `a\.b=x\,y,c=z`, setTyped, map[string]interface{}{"a.b": "x,y", "c": "z"}},
+		{"empty value", "a=", setTyped, map[string]interface{}{"a": ""}},
+		{"string", "a=1,b=true", setString, map[string]interface{}{"a": "1", "b": "true"}},
+		{"json", `a={"b":[1,2.5]},c="x,y",d=null`, setJSON, map[string]interface{}{
+			"a": map[string]interface{}{"b": []interface{}{int64(1), 2.5}}, "c": "x,y", "d": nil,
+		}},
+		{"file", "script=" + file, setFile, map[string]interface{}{"script": "#!/bin/sh\necho hi\n"}},
+	}
+	for _, tt := range tests {
+		values := map[string]interface{}{}
+		if err := parseSetValues(values, tt.expr, tt.kind); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(values, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, values, tt.want)
+		}
+	}
+}
+
+func TestParseSetValuesErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		kind setKind
+	}{
+		{"a", setTyped},
+		{"a,b=1", setTyped},
+		{"=1", setTyped},
+		{"a[x]=1", setTyped},
+		{"a[-1]=1", setTyped},
+		{"a[0=1", setTyped},
+		{"a={x,y", setTyped},
+		{"a=1,a.b=2", setTyped},
+		{"a=1,a[0]=2", setTyped},
+		{"a[0][0]=1", setTyped},
+		{"a={", setJSON},
+		{`a="x"y`, setJSON},
+		{"a=/does/not/exist", setFile},
+	}
+	for _, tt := range tests {
+		if err := parseSetValues(map[string]interface{}{}, tt.expr, tt.kind); err == nil {
+			t.Errorf("%q: expected an error", tt.expr)
+		}
+	}
+}
+
+// TestUserValuesSetOrder checks that --set style expressions apply by flag, the way
+// helm applies them, not in the order they were given.
+func TestUserValuesSetOrder(t *testing.T) {
+	config := &Config{
+		SetValues:         setFlags{"a=1"},
+		SetStringValues:   setFlags{"b=user"},
+		SetJSONValues:     setFlags{"a=0", "c=0"},
+		nodePortOverrides: []string{"b=30001", "c=30002"},
+		fitOverrides:      []string{"d=fit"},
+		namespaceOverride: "d=ns",
+	}
+	values, err := userValues(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"a": int64(1), "b": "user", "c": int64(30002), "d": "ns"}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %#v, want %#v", values, want)
+	}
+
+	var args []string
+	for i, arg := range helmValuesArgs(config) {
+		if i%2 == 0 {
+			args = append(args, arg)
+		}
+	}
+	if got := strings.Join(args, " "); got != "--set-json --set-json --set --set --set --set-string --set-string --set-string" {
+		t.Errorf("helm flags: %s", got)
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// readChartFile returns a file of a chart folder or packaged chart archive, by its
+// path relative to the chart root. It returns an error satisfying os.IsNotExist when
+// the chart has no such file.
+func readChartFile(chartPath, name string) ([]byte, error) {
+	info, err := os.Stat(chartPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chart: %w", err)
+	}
+	if info.IsDir() {
+		return os.ReadFile(filepath.Join(chartPath, name))
+	}
+
+	var data []byte
+	err = walkArchive(chartPath, func(file string, r io.Reader) (bool, error) {
+		if file != name {
+			return false, nil
+		}
+		var err error
+		data, err = io.ReadAll(r)
+		return true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, &os.PathError{Op: "open", Path: chartPath + ":" + name, Err: os.ErrNotExist}
+	}
+	return data, nil
+}
+
+// readValuesFile parses a values file into a map. An empty file is an empty map.
+func readValuesFile(path string, data []byte) (map[string]interface{}, error) {
+	doc, err := parseYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	if doc == nil {
+		return map[string]interface{}{}, nil
+	}
+	values, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must contain a mapping", path)
+	}
+	return values, nil
+}
+
+// computeValues merges the values helm will render the chart with, in helm's order:
+// the chart's values.yaml, then the user-supplied values, see userValues.
+func computeValues(config *Config) (map[string]interface{}, error) {
+	data, err := readChartFile(config.chartPath(), "values.yaml")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	values, err := readValuesFile("values.yaml", data)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := userValues(config)
+	if err != nil {
+		return nil, err
+	}
+	return mergeValues(values, overrides), nil
+}
+
+// userValues merges the values given for an install the way helm does: the profile,
+// each -values file in order, the config file's inline values, then the --set style
+// expressions of setExpressions. Nulls are kept so they can delete chart defaults.
+func userValues(config *Config) (map[string]interface{}, error) {
+	overrides := map[string]interface{}{}
+
+	files := []string{config.instanceValuesFile, config.profileValuesFile, config.componentsValuesFile, config.servicesValuesFile}
+	if config.credentialValues != nil {
+		files = append(files, credentialValuesArg())
+	}
+	files = append(files, config.ValuesFiles...)
+	for _, path := range files {
+		if path == "" {
+			continue
+		}
+		data, err := readUserValuesFile(config, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read values file: %w", err)
+		}
+		fileValues, err := readValuesFile(path, data)
+		if err != nil {
+			return nil, err
+		}
+		overrides = overlayValues(overrides, fileValues)
+	}
+
+	if len(config.Values) > 0 {
+		overrides = overlayValues(overrides, copyValues(config.Values).(map[string]interface{}))
+	}
+
+	// Like helm, all --set style expressions are parsed into the same map, so a
+	// later expression can index into a list set by an earlier one.
+	for _, set := range setExpressions(config) {
+		for _, expr := range set.exprs {
+			if err := parseSetValues(overrides, expr, set.kind); err != nil {
+				return nil, fmt.Errorf("invalid %s %s: %w", set.flag, expr, err)
+			}
+		}
+	}
+	return overrides, nil
+}
+
+// setExpressionGroup is the expressions of one --set style flag.
+type setExpressionGroup struct {
+	flag  string
+	kind  setKind
+	exprs []string
+}
+
+// setExpressions returns the --set style expressions of an install by flag, in the
+// order helm applies them whatever their position on the command line: every
+// --set-json, then every --set, --set-string and --set-file. The overrides install-app
+// computes itself (NodePorts, prerequisites, fit-to-cluster requests and the
+// namespace, see resolveNamespace) follow the user's expressions of the same flag.
+func setExpressions(config *Config) []setExpressionGroup {
+	sets := append(append(slices.Clip(config.SetValues), config.nodePortOverrides...), config.prerequisiteOverrides...)
+	strs := append(slices.Clip(config.SetStringValues), config.fitOverrides...)
+	if config.namespaceOverride != "" {
+		strs = append(strs, config.namespaceOverride)
+	}
+	return []setExpressionGroup{
+		{"--set-json", setJSON, config.SetJSONValues},
+		{"--set", setTyped, sets},
+		{"--set-string", setString, strs},
+		{"--set-file", setFile, config.SetFileValues},
+	}
+}
+
+// overlayValues merges src over dst like helm merges values files: nested maps are
+// merged, anything else (including null) replaces the value in dst.
+func overlayValues(dst, src map[string]interface{}) map[string]interface{} {
+	for key, value := range src {
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		srcMap, srcIsMap := value.(map[string]interface{})
+		if dstIsMap && srcIsMap {
+			dst[key] = overlayValues(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+	return dst
+}
+
+// writeValuesArtifact writes the merged values to config.ValuesOutput, if set, so a
+// run's effective configuration can be archived alongside its results.
+func writeValuesArtifact(config *Config, values map[string]interface{}) error {
+	if config.ValuesOutput == "" {
+		return nil
+	}
+	if dir := filepath.Dir(config.ValuesOutput); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to write merged values: %w", err)
+		}
+	}
+	if err := os.WriteFile(config.ValuesOutput, marshalYAML(values), 0o600); err != nil {
+		return fmt.Errorf("failed to write merged values: %w", err)
+	}
+	log.Printf("Wrote merged values to %s", config.ValuesOutput)
+	return nil
+}
+
+// mergeValues merges overrides into base the way helm coalesces values: nested maps
+// are merged key by key, anything else replaces the base value, and a null override
+// deletes the key.
+func mergeValues(base, overrides map[string]interface{}) map[string]interface{} {
+	for key, override := range overrides {
+		if override == nil {
+			delete(base, key)
+			continue
+		}
+		baseMap, baseIsMap := base[key].(map[string]interface{})
+		overrideMap, overrideIsMap := override.(map[string]interface{})
+		if baseIsMap && overrideIsMap {
+			base[key] = mergeValues(baseMap, overrideMap)
+			continue
+		}
+		base[key] = override
+	}
+	return base
+}
+
+// copyValues returns a deep copy of a decoded values document.
+func copyValues(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			m[k] = copyValues(child)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, child := range t {
+			l[i] = copyValues(child)
+		}
+		return l
+	}
+	return v
+}
+
+// setKind selects how parseSetValues reads values.
+type setKind int
+
+const (
+	setTyped  setKind = iota // --set: integers, true/false and null are typed
+	setString                // --set-string: values are always strings
+	setFile                  // --set-file: values are paths whose contents become the value
+	setJSON                  // --set-json: values are JSON
+)
+
+// parseSetValues applies a helm --set style expression ("a.b=1,c[0]=x,d={e,f}") to
+// values, reading the values as kind describes.
+func parseSetValues(values map[string]interface{}, expr string, kind setKind) error {
+	p := &setParser{s: []rune(expr), kind: kind}
+	for !p.done() {
+		path, err := p.key()
+		if err != nil {
+			return err
+		}
+		value, err := p.value()
+		if err != nil {
+			return err
+		}
+		if err := setValuePath(values, path, value); err != nil {
+			return err
+		}
+		if !p.done() {
+			p.pos++ // the ',' separating pairs
+		}
+	}
+	return nil
+}
+
+// setParser is a subset of helm's strvals parser: dotted keys, list indexes, escaped
+// separators and {a,b} list values.
+type setParser struct {
+	s    []rune
+	pos  int
+	kind setKind
+}
+
+func (p *setParser) done() bool { return p.pos >= len(p.s) }
+
+// key reads a key path up to '='. Path elements are strings, or ints for [n].
+func (p *setParser) key() ([]interface{}, error) {
+	var path []interface{}
+	var name strings.Builder
+	start := p.pos
+	for {
+		if p.done() {
+			return nil, fmt.Errorf("key %q has no value", string(p.s[start:]))
+		}
+		c := p.s[p.pos]
+		p.pos++
+		switch c {
+		case '\\':
+			if p.done() {
+				return nil, fmt.Errorf("unterminated escape in key")
+			}
+			name.WriteRune(p.s[p.pos])
+			p.pos++
+		case ',':
+			return nil, fmt.Errorf("key %q has no value", string(p.s[start:p.pos-1]))
+		case '.':
+			if name.Len() > 0 {
+				path = append(path, name.String())
+				name.Reset()
+			}
+		case '[':
+			if name.Len() > 0 {
+				path = append(path, name.String())
+				name.Reset()
+			}
+			end := p.pos
+			for end < len(p.s) && p.s[end] != ']' {
+				end++
+			}
+			if end == len(p.s) {
+				return nil, fmt.Errorf("unterminated list index in key")
+			}
+			index, err := strconv.Atoi(string(p.s[p.pos:end]))
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf("invalid list index %q", string(p.s[p.pos:end]))
+			}
+			path = append(path, index)
+			p.pos = end + 1
+		case '=':
+			if name.Len() > 0 {
+				path = append(path, name.String())
+			}
+			if len(path) == 0 {
+				return nil, fmt.Errorf("empty key")
+			}
+			return path, nil
+		default:
+			name.WriteRune(c)
+		}
+	}
+}
+
+// value reads a value up to the next unescaped ',' (or a whole {a,b} list).
+func (p *setParser) value() (interface{}, error) {
+	switch p.kind {
+	case setJSON:
+		return p.jsonValue()
+	case setFile:
+		path, _ := p.scalar(",")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		return string(data), nil
+	}
+
+	if !p.done() && p.s[p.pos] == '{' {
+		p.pos++
+		list := []interface{}{}
+		if !p.done() && p.s[p.pos] == '}' {
+			p.pos++
+			return list, nil
+		}
+		for {
+			item, end := p.scalar(",}")
+			list = append(list, p.convert(item))
+			if end == 0 {
+				return nil, fmt.Errorf("unterminated list value")
+			}
+			if end == '}' {
+				return list, nil
+			}
+		}
+	}
+	item, _ := p.scalar(",")
+	return p.convert(item), nil
+}
+
+// scalar reads up to one of the stop runes, which is consumed (except ',' ending a
+// pair) and returned; 0 means the input ended.
+func (p *setParser) scalar(stop string) (string, rune) {
+	var b strings.Builder
+	for !p.done() {
+		c := p.s[p.pos]
+		if c == '\\' && p.pos+1 < len(p.s) {
+			b.WriteRune(p.s[p.pos+1])
+			p.pos += 2
+			continue
+		}
+		if strings.ContainsRune(stop, c) {
+			if c != ',' || stop != "," {
+				p.pos++
+			}
+			return b.String(), c
+		}
+		b.WriteRune(c)
+		p.pos++
+	}
+	return b.String(), 0
+}
+
+// jsonValue decodes one JSON value, which must be followed by ',' or the end.
+func (p *setParser) jsonValue() (interface{}, error) {
+	rest := string(p.s[p.pos:])
+	dec := json.NewDecoder(strings.NewReader(rest))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("invalid JSON value: %w", err)
+	}
+	p.pos += utf8.RuneCountInString(rest[:dec.InputOffset()])
+	for !p.done() && unicode.IsSpace(p.s[p.pos]) {
+		p.pos++
+	}
+	if !p.done() && p.s[p.pos] != ',' {
+		return nil, fmt.Errorf("unexpected %q after JSON value", string(p.s[p.pos:]))
+	}
+	return normalizeJSONNumbers(v), nil
+}
+
+// convert types a --set value: integers without leading zeros, booleans and null.
+func (p *setParser) convert(s string) interface{} {
+	if p.kind != setTyped {
+		return s
+	}
+	switch s {
+	case "true":
+		return true
+	case "false":
+		return false
+	case "null":
+		return nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && (s == "0" || !strings.HasPrefix(strings.TrimPrefix(s, "-"), "0")) {
+		return n
+	}
+	return s
+}
+
+// setValuePath sets the value at path, creating intermediate maps and lists.
+func setValuePath(values map[string]interface{}, path []interface{}, value interface{}) error {
+	var parent interface{} = values
+	for i, elem := range path {
+		last := i == len(path)-1
+		switch key := elem.(type) {
+		case string:
+			m, ok := parent.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s is not a map", formatSetPath(path[:i]))
+			}
+			if last {
+				m[key] = value
+				return nil
+			}
+			if _, ok := m[key]; !ok {
+				m[key] = newSetContainer(path[i+1])
+			}
+			parent = m[key]
+			// Lists are replaced in place, so keep a pointer-like handle through the map.
+			if _, isList := parent.([]interface{}); isList {
+				parent = listSlot{m: m, key: key}
+			}
+		case int:
+			slot, ok := parent.(listSlot)
+			if !ok {
+				return fmt.Errorf("%s is not a list", formatSetPath(path[:i]))
+			}
+			list, _ := slot.m[slot.key].([]interface{})
+			for len(list) <= key {
+				list = append(list, nil)
+			}
+			slot.m[slot.key] = list
+			if last {
+				list[key] = value
+				return nil
+			}
+			if list[key] == nil {
+				list[key] = newSetContainer(path[i+1])
+			}
+			parent = list[key]
+			if _, isList := parent.([]interface{}); isList {
+				return fmt.Errorf("nested lists are not supported in %s", formatSetPath(path))
+			}
+		}
+	}
+	return nil
+}
+
+// listSlot refers to a list stored under a map key so it can be grown.
+type listSlot struct {
+	m   map[string]interface{}
+	key string
+}
+
+func newSetContainer(next interface{}) interface{} {
+	if _, ok := next.(int); ok {
+		return []interface{}{}
+	}
+	return map[string]interface{}{}
+}
+
+func formatSetPath(path []interface{}) string {
+	var b strings.Builder
+	for _, elem := range path {
+		switch key := elem.(type) {
+		case string:
+			if b.Len() > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(key)
+		case int:
+			fmt.Fprintf(&b, "[%d]", key)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	bundleManifestFile = "bundle/charts.sha256"
+
+	// exitIntegrityFailure is the process exit code used when chart verification
+	// fails, so callers can tell tampering apart from ordinary install failures.
+	exitIntegrityFailure = 3
+)
+
+// chartIntegrityError reports a chart that does not match the manifest compiled
+// into the binary, or that could not be verified at all.
+type chartIntegrityError struct {
+	Chart    string
+	Problems []string
+}
+
+func (e *chartIntegrityError) Error() string {
+	return fmt.Sprintf("chart integrity check failed for %s: %s (use -allow-unverified to install anyway)",
+		e.Chart, strings.Join(e.Problems, "; "))
+}
+
+// loadChartManifest reads the sha256sum-style manifest embedded at build time and
+// returns the hex digest of every chart file keyed by its path relative to the
+// charts root (for example "sock-shop/values.yaml").
+func loadChartManifest() map[string]string {
+	manifest := make(map[string]string)
+
+	data, err := bundleFS.ReadFile(bundleManifestFile)
+	if err != nil {
+		return manifest
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), "  ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		path := strings.TrimPrefix(strings.TrimPrefix(fields[1], "./"), "charts/")
+		manifest[path] = fields[0]
+	}
+	return manifest
+}
+
+// verifyChart checks the chart folder against the embedded content manifest, or,
+// when the manifest has no entry for the chart, against a Helm provenance file for a
+// packaged copy of it. Remote charts are checked against the provenance file pulled
+// with them. Failures are returned as *chartIntegrityError unless
+// -allow-unverified is set, in which case they are only logged.
+func verifyChart(config *Config) error {
+	err := checkChartIntegrity(config)
+	if err == nil {
+		return nil
+	}
+	if config.AllowUnverified {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	return err
+}
+
+func checkChartIntegrity(config *Config) error {
+	chartPath := config.chartPath()
+	if config.isRemoteChart() {
+		return checkArchiveProvenance(chartPath, config.Keyring)
+	}
+
+	manifest := loadChartManifest()
+
+	rel, err := filepath.Rel(config.ChartsPath, chartPath)
+	if err != nil {
+		return err
+	}
+	prefix := filepath.ToSlash(rel) + "/"
+	expected := make(map[string]string)
+	for path, sum := range manifest {
+		if strings.HasPrefix(path, prefix) {
+			expected[strings.TrimPrefix(path, prefix)] = sum
+		}
+	}
+
+	if len(expected) > 0 {
+		problems, err := compareChartFiles(chartPath, expected)
+		if err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			return &chartIntegrityError{Chart: chartPath, Problems: problems}
+		}
+		log.Printf("Verified %d chart files in %s against the embedded manifest", len(expected), chartPath)
+		return nil
+	}
+
+	archive, err := findProvenanceArchive(config.ChartsPath, config.FolderName, config.resolvedVersion)
+	if err != nil {
+		return err
+	}
+	if archive == "" && len(manifest) == 0 {
+		// A binary built with plain `go build` embeds no manifest at all.
+		return &chartIntegrityError{
+			Chart: chartPath,
+			Problems: []string{"this binary has no embedded chart manifest and the chart has no .prov provenance file " +
+				"(build the binary with make binary, which runs go generate)"},
+		}
+	}
+	if archive == "" {
+		return &chartIntegrityError{
+			Chart: chartPath,
+			Problems: []string{"no embedded manifest entry and no .prov provenance file for this chart " +
+				"(rebuild with make binary to add it to the manifest)"},
+		}
+	}
+
+	if err := checkArchiveProvenance(archive, config.Keyring); err != nil {
+		return err
+	}
+
+	// Install from the verified archive rather than the unverified folder next to it.
+	config.resolvedChart = archive
+	return nil
+}
+
+// checkArchiveProvenance verifies a packaged chart against the .prov file next to it.
+func checkArchiveProvenance(archive, keyring string) error {
+	if _, err := os.Stat(archive + ".prov"); err != nil {
+		return &chartIntegrityError{Chart: archive, Problems: []string{"no .prov provenance file for this chart archive"}}
+	}
+	if err := verifyProvenance(archive, keyring); err != nil {
+		return &chartIntegrityError{Chart: archive, Problems: []string{err.Error()}}
+	}
+	log.Printf("Verified %s against its provenance file", archive)
+	return nil
+}
+
+// compareChartFiles hashes every file below chartPath and reports files that are
+// modified, missing or not part of the manifest.
+func compareChartFiles(chartPath string, expected map[string]string) ([]string, error) {
+	var problems []string
+	seen := make(map[string]bool)
+
+	err := filepath.WalkDir(chartPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(chartPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+
+		want, ok := expected[rel]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("unexpected file %s", rel))
+			return nil
+		}
+		got, err := sha256File(path)
+		if err != nil {
+			return err
+		}
+		if got != want {
+			problems = append(problems, fmt.Sprintf("modified file %s", rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash chart files: %w", err)
+	}
+
+	for rel := range expected {
+		if !seen[rel] {
+			problems = append(problems, fmt.Sprintf("missing file %s", rel))
+		}
+	}
+
+	sort.Strings(problems)
+	return problems, nil
+}
+
+func sha256File(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// findProvenanceArchive returns the packaged chart (<folder>-<version>.tgz) in
+// chartsPath that has a matching .prov file, or "" if there is none.
+func findProvenanceArchive(chartsPath, folderName, version string) (string, error) {
+	if version == "" {
+		version = "*"
+	}
+	provs, err := filepath.Glob(filepath.Join(chartsPath, folderName+"-"+version+".tgz.prov"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(provs)
+	for i := len(provs) - 1; i >= 0; i-- {
+		archive := strings.TrimSuffix(provs[i], ".prov")
+		if _, err := os.Stat(archive); err == nil {
+			return archive, nil
+		}
+	}
+	return "", nil
+}
+
+// verifyProvenance runs `helm verify`, which checks the archive digest and the PGP
+// signature in the .prov file against the keyring.
+func verifyProvenance(archive, keyring string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	args := []string{"verify", archive}
+	if keyring != "" {
+		args = append(args, "--keyring", keyring)
+	}
+
+	out, err := exec.CommandContext(ctx, "helm", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("helm verify failed: %v (%s)", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// chartVersion is one installable version of a chart folder.
+type chartVersion struct {
+	Version string
+	Path    string
+}
+
+// listChartVersions returns the versions of a chart folder in ascending order. A
+// folder is either a single chart (ChartsPath/<folder>/Chart.yaml) or holds one
+// chart per version (ChartsPath/<folder>/<version>/Chart.yaml) so several versions
+// can be installed side by side for regression benchmarks.
+func listChartVersions(chartsPath, folderName string) ([]chartVersion, error) {
+	folder := filepath.Join(chartsPath, folderName)
+
+	if _, err := os.Stat(filepath.Join(folder, "Chart.yaml")); err == nil {
+		version, err := readChartVersion(folder)
+		if err != nil {
+			return nil, err
+		}
+		return []chartVersion{{Version: version, Path: folder}}, nil
+	}
+
+	entries, err := os.ReadDir(folder)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chart folder: %w", err)
+	}
+
+	var versions []chartVersion
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(folder, entry.Name())
+		if _, err := os.Stat(filepath.Join(dir, "Chart.yaml")); err != nil {
+			continue
+		}
+		version, err := readChartVersion(dir)
+		if err != nil {
+			return nil, err
+		}
+		if version != entry.Name() {
+			return nil, fmt.Errorf("chart version %s in %s does not match its folder name", version, dir)
+		}
+		versions = append(versions, chartVersion{Version: version, Path: dir})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i].Version, versions[j].Version) < 0
+	})
+	return versions, nil
+}
+
+// selectChartVersion picks the requested version, or the latest when version is "".
+func selectChartVersion(versions []chartVersion, version string) (chartVersion, error) {
+	if len(versions) == 0 {
+		return chartVersion{}, fmt.Errorf("no chart versions found")
+	}
+	if version == "" {
+		return versions[len(versions)-1], nil
+	}
+	for _, v := range versions {
+		if v.Version == strings.TrimPrefix(version, "v") {
+			return v, nil
+		}
+	}
+
+	available := make([]string, len(versions))
+	for i, v := range versions {
+		available[i] = v.Version
+	}
+	return chartVersion{}, fmt.Errorf("version %s not found (available: %s)", version, strings.Join(available, ", "))
+}
+
+// readChartVersion returns the top-level version field of a chart's Chart.yaml.
+func readChartVersion(chartDir string) (string, error) {
+	return readChartField(chartDir, "version")
+}
+
+// readChartField returns a top-level scalar field of a chart's Chart.yaml.
+func readChartField(chartDir, field string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(chartDir, "Chart.yaml"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read Chart.yaml: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.Trim(strings.TrimSpace(strings.TrimPrefix(line, field+":")), "\"'"), nil
+		}
+	}
+	return "", fmt.Errorf("no %s field in %s", field, filepath.Join(chartDir, "Chart.yaml"))
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v2"
+)
+
+// YAML is read with go-yaml v2, the library behind helm's values loading, so that
+// plain scalars resolve the way helm sees them (YAML 1.1: yes/on are booleans, 0755
+// is octal and 1_000 is a number). The writer below renders decoded documents back
+// as block-style YAML.
+//
+// Decoded documents use the same types as encoding/json, except that integers are
+// int64: map[string]interface{}, []interface{}, string, bool, int64, float64, nil.
+
+// splitYAMLDocuments splits a multi-document stream on "---" separator lines.
+// Empty documents (only comments or whitespace) are dropped.
+func splitYAMLDocuments(data []byte) [][]byte {
+	var docs [][]byte
+	var current []string
+
+	flush := func() {
+		doc := strings.Join(current, "\n")
+		current = nil
+		for _, line := range strings.Split(doc, "\n") {
+			trimmed := strings.TrimSpace(line)
+			if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				docs = append(docs, []byte(doc))
+				return
+			}
+		}
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "---" || strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "---\t") {
+			flush()
+			rest := strings.TrimSpace(strings.TrimPrefix(line, "---"))
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				current = append(current, rest)
+			}
+			continue
+		}
+		if line == "..." {
+			continue
+		}
+		current = append(current, strings.TrimRight(line, "\r"))
+	}
+	flush()
+	return docs
+}
+
+// parseYAMLDocuments parses every document of a multi-document stream.
+func parseYAMLDocuments(data []byte) ([]interface{}, error) {
+	var docs []interface{}
+	for i, doc := range splitYAMLDocuments(data) {
+		v, err := parseYAML(doc)
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %w", i+1, err)
+		}
+		docs = append(docs, v)
+	}
+	return docs, nil
+}
+
+// parseYAML parses a single YAML document.
+func parseYAML(data []byte) (interface{}, error) {
+	var v interface{}
+	if err := yaml.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return normalizeYAML(v), nil
+}
+
+// normalizeYAML converts go-yaml's decoded types to the ones parseYAML returns.
+// Mapping keys become strings the way helm's YAML-to-JSON conversion formats them.
+func normalizeYAML(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			m[scalarString(normalizeYAML(k))] = normalizeYAML(child)
+		}
+		return m
+	case []interface{}:
+		for i, child := range t {
+			t[i] = normalizeYAML(child)
+		}
+	case int:
+		return int64(t)
+	case uint64:
+		return float64(t)
+	}
+	return v
+}
+
+// decodeYAMLInto parses a single YAML document into v through its JSON encoding, so
+// that v's json tags name the keys.
+func decodeYAMLInto(data []byte, v interface{}) error {
+	doc, err := parseYAML(data)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
+
+// scalarString formats a decoded scalar as a mapping key.
+func scalarString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return t
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	return fmt.Sprint(v)
+}
+
+// marshalYAML renders a decoded document as block-style YAML with sorted keys.
+func marshalYAML(v interface{}) []byte {
+	var b bytes.Buffer
+	writeYAMLNode(&b, v, 0)
+	return b.Bytes()
+}
+
+// marshalYAMLDocuments renders documents as a "---" separated stream.
+func marshalYAMLDocuments(docs []interface{}) []byte {
+	var b bytes.Buffer
+	for _, doc := range docs {
+		b.WriteString("---\n")
+		b.Write(marshalYAML(doc))
+	}
+	return b.Bytes()
+}
+
+func writeYAMLNode(b *bytes.Buffer, v interface{}, indent int) {
+	pad := strings.Repeat(" ", indent)
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			b.WriteString(pad + "{}\n")
+			return
+		}
+		for _, k := range sortedKeys(t) {
+			b.WriteString(pad + formatYAMLString(k, indent) + ":")
+			writeYAMLChild(b, t[k], indent)
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			b.WriteString(pad + "[]\n")
+			return
+		}
+		for _, item := range t {
+			b.WriteString(pad + "-")
+			switch c := item.(type) {
+			case map[string]interface{}:
+				if len(c) == 0 {
+					b.WriteString(" {}\n")
+					continue
+				}
+				// Render the mapping indented, then pull its first line up next to the dash.
+				var inner bytes.Buffer
+				writeYAMLNode(&inner, c, indent+2)
+				b.WriteString(" ")
+				b.Write(inner.Bytes()[indent+2:])
+			case []interface{}:
+				if len(c) == 0 {
+					b.WriteString(" []\n")
+					continue
+				}
+				var inner bytes.Buffer
+				writeYAMLNode(&inner, c, indent+2)
+				b.WriteString(" ")
+				b.Write(inner.Bytes()[indent+2:])
+			default:
+				b.WriteString(" " + formatYAMLScalar(item, indent+2) + "\n")
+			}
+		}
+	default:
+		b.WriteString(pad + formatYAMLScalar(v, indent) + "\n")
+	}
+}
+
+func writeYAMLChild(b *bytes.Buffer, v interface{}, indent int) {
+	switch c := v.(type) {
+	case map[string]interface{}:
+		if len(c) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+		b.WriteString("\n")
+		writeYAMLNode(b, c, indent+2)
+	case []interface{}:
+		if len(c) == 0 {
+			b.WriteString(" []\n")
+			return
+		}
+		b.WriteString("\n")
+		writeYAMLNode(b, c, indent+2)
+	default:
+		b.WriteString(" " + formatYAMLScalar(v, indent+2) + "\n")
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatYAMLScalar(v interface{}, indent int) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(t)
+	case int:
+		return strconv.Itoa(t)
+	case int64:
+		return strconv.FormatInt(t, 10)
+	case float64:
+		switch {
+		case math.IsInf(t, 1):
+			return ".inf"
+		case math.IsInf(t, -1):
+			return "-.inf"
+		case math.IsNaN(t):
+			return ".nan"
+		case t == math.Trunc(t) && math.Abs(t) < 1e15:
+			return strconv.FormatFloat(t, 'f', 1, 64)
+		}
+		return strconv.FormatFloat(t, 'g', -1, 64)
+	case json.Number:
+		return t.String()
+	case string:
+		return formatYAMLString(t, indent)
+	}
+	return formatYAMLString(fmt.Sprint(v), indent)
+}
+
+// formatYAMLString quotes a string when it would otherwise be read back as a
+// different type or would break the block structure. Multi-line strings use a
+// literal block scalar.
+func formatYAMLString(s string, indent int) string {
+	if strings.Contains(s, "\n") && !strings.ContainsAny(s, "\r\t") && utf8.ValidString(s) &&
+		!strings.HasPrefix(s, " ") && !strings.HasPrefix(s, "\n") {
+		body := strings.TrimRight(s, "\n")
+		header := "|-"
+		switch trailing := len(s) - len(body); {
+		case trailing == 1:
+			header = "|"
+		case trailing > 1:
+			header = "|+"
+		}
+		// "|" and "|+" imply the final newline; "|+" keeps the blank lines before it.
+		content := s
+		if header != "|-" {
+			content = strings.TrimSuffix(s, "\n")
+		}
+		pad := strings.Repeat(" ", indent)
+		var b strings.Builder
+		b.WriteString(header)
+		for _, line := range strings.Split(content, "\n") {
+			b.WriteString("\n")
+			if line != "" {
+				b.WriteString(pad + line)
+			}
+		}
+		return b.String()
+	}
+
+	if needsYAMLQuotes(s) {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func needsYAMLQuotes(s string) bool {
+	if s == "" || strings.TrimSpace(s) != s {
+		return true
+	}
+	for _, r := range s {
+		if r < 0x20 || r == 0x7f || !utf8.ValidRune(r) {
+			return true
+		}
+	}
+	// Anything a YAML 1.1 reader such as helm's wouldn't read back as the same string:
+	// numbers, booleans, null, and text with structure such as "a: b" or "a #b".
+	var v interface{}
+	if err := yaml.Unmarshal([]byte(s), &v); err != nil || v != s {
+		return true
+	}
+	return strings.ContainsAny(s[:1], "-?:,[]{}#&*!|>'\"%@`")
+}
+
+// decodeJSONValue decodes JSON into the same types parseYAML produces.
+func decodeJSONValue(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return normalizeJSONNumbers(v), nil
+}
+
+// normalizeJSONNumbers converts json.Number values to int64 or float64 so that
+// JSON-decoded data has the same types as parsed YAML.
+func normalizeJSONNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			t[k] = normalizeJSONNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range t {
+			t[i] = normalizeJSONNumbers(child)
+		}
+	case json.Number:
+		if n, err := t.Int64(); err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
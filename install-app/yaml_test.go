@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want interface{}
+	}{
+		{"empty", "# only a comment\n", nil},
+		{"scalars", "a: 1\nb: 1.5\nc: true\nd: ~\ne: text\nf: \"quoted: #x\"\ng: 'it''s'\n", map[string]interface{}{
+			"a": int64(1), "b": 1.5, "c": true, "d": nil, "e": "text", "f": "quoted: #x", "g": "it's",
+		}},
+		{"numbers", "hex: 0x1F\noct: 0o17\nexp: 1e3\ninf: -.inf\nversion: 1.2.3\n", map[string]interface{}{
+			"hex": int64(31), "oct": int64(15), "exp": 1000.0, "inf": math.Inf(-1), "version": "1.2.3",
+		}},
+		// helm reads values with go-yaml v2, which follows YAML 1.1.
+		{"YAML 1.1", "yes: yes\na: on\nb: Off\nc: n\nmode: 0755\nbin: 0b101\nunderscore: 1_000\nexp: 1.0e3\nsexagesimal: 1:20\ndate: 2024-01-01\n",
+			map[string]interface{}{
+				"true": true, "a": true, "b": false, "c": false, "mode": int64(493), "bin": int64(5), "underscore": int64(1000),
+				"exp": 1000.0, "sexagesimal": "1:20", "date": "2024-01-01",
+			}},
+		{"nested", "a:\n  b:\n    - x\n    - k: 1\n      z: 2\n  c: []\n", map[string]interface{}{
+			"a": map[string]interface{}{
+				"b": []interface{}{"x", map[string]interface{}{"k": int64(1), "z": int64(2)}},
+				"c": []interface{}{},
+			},
+		}},
+		{"sequence at key indent", "list:\n- a\n- b\nnext: 1\n", map[string]interface{}{
+			"list": []interface{}{"a", "b"}, "next": int64(1),
+		}},
+		{"flow", "m: {a: 1, b: [x, \"y, z\"]}\n", map[string]interface{}{
+			"m": map[string]interface{}{"a": int64(1), "b": []interface{}{"x", "y, z"}},
+		}},
+		{"comment", "a: value # comment\nb: \"#not\"\n", map[string]interface{}{"a": "value", "b": "#not"}},
+		{"literal block", "s: |\n  one\n  two\nt: x\n", map[string]interface{}{"s": "one\ntwo\n", "t": "x"}},
+		{"strip block", "s: |-\n  one\n\n  two\n", map[string]interface{}{"s": "one\n\ntwo"}},
+		{"folded block", "s: >\n  one\n  two\n", map[string]interface{}{"s": "one two\n"}},
+		{"plain continuation", "s: one\n  two\n", map[string]interface{}{"s": "one two"}},
+		{"anchor", "a: &x 1\n", map[string]interface{}{"a": int64(1)}},
+	}
+	for _, tt := range tests {
+		got, err := parseYAML([]byte(tt.in))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, in := range []string{
+		"a: *alias\n",
+		"a: 1\n b: 2\n",
+		"a: \"unterminated\n",
+	} {
+		if _, err := parseYAML([]byte(in)); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestParseYAMLDocuments(t *testing.T) {
+	docs, err := parseYAMLDocuments([]byte("---\na: 1\n---\n# empty\n---\nb: 2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{map[string]interface{}{"a": int64(1)}, map[string]interface{}{"b": int64(2)}}
+	if !reflect.DeepEqual(docs, want) {
+		t.Errorf("got %#v, want %#v", docs, want)
+	}
+}
+
+// TestYAMLStringRoundTrip checks that strings come back as strings, also for the
+// YAML 1.1 readers helm uses.
+func TestYAMLStringRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"", " padded", "plain", "1", "-1", "1.5", "1e3", ".5", "+.5", "+1", "1_000", "0b101", "0o17", "017",
+		"0x1F", "08", "1.2.3", "true", "yes", "No", "off", "~", "null", ".inf", "-.inf", ".nan",
+		"key: value", "trailing:", "a #b", "#x", "- item", "[x]", "{x}", "*alias", "&anchor", "!tag",
+		"%x", "@x", "`x`", "'q'", "\"q\"", "tab\there", "one\ntwo\n", "one\ntwo", "one\n\n", "é",
+	} {
+		out := marshalYAML(map[string]interface{}{"k": s})
+		got, err := parseYAML(out)
+		if err != nil {
+			t.Errorf("%q: %v in %q", s, err, out)
+			continue
+		}
+		if v := got.(map[string]interface{})["k"]; v != s {
+			t.Errorf("%q: read back %#v from %q", s, v, out)
+		}
+	}
+}
+
+func TestNeedsYAMLQuotes(t *testing.T) {
+	for _, s := range []string{"1_000", "0b101", "0o17", "017", "+.5", "+1", "1e3", "0x1F", "08"} {
+		if !needsYAMLQuotes(s) {
+			t.Errorf("%q is a number to YAML 1.1 readers and must be quoted", s)
+		}
+	}
+	for _, s := range []string{"plain", "1.2.3", "v1", "10Gi", "100m", "a_1"} {
+		if needsYAMLQuotes(s) {
+			t.Errorf("%q needs no quotes", s)
+		}
+	}
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	doc := map[string]interface{}{
+		"int":    int64(8080),
+		"float":  8080.0,
+		"frac":   0.25,
+		"bool":   false,
+		"null":   nil,
+		"string": "text",
+		"list":   []interface{}{int64(1), "two", map[string]interface{}{"a": "b", "c": []interface{}{}}},
+		"empty":  map[string]interface{}{},
+		"nested": map[string]interface{}{"deeper": map[string]interface{}{"x": "y"}},
+		"block":  "line one\nline two\n",
+	}
+	out := marshalYAML(doc)
+	got, err := parseYAML(out)
+	if err != nil {
+		t.Fatalf("%v in\n%s", err, out)
+	}
+	if !reflect.DeepEqual(got, doc) {
+		t.Errorf("got %#v from\n%s", got, out)
+	}
+	if !strings.Contains(string(out), "float: 8080.0\n") {
+		t.Errorf("floats must stay floats:\n%s", out)
+	}
+}
+
+func TestDecodeYAMLInto(t *testing.T) {
+	var v struct {
+		Name  string   `json:"name"`
+		Ports []int    `json:"ports"`
+		Tags  []string `json:"tags"`
+	}
+	if err := decodeYAMLInto([]byte("name: web\nports: [80, 443]\ntags:\n  - a\n"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Name != "web" || !reflect.DeepEqual(v.Ports, []int{80, 443}) || !reflect.DeepEqual(v.Tags, []string{"a"}) {
+		t.Errorf("got %+v", v)
+	}
+	if err := decodeYAMLInto([]byte("name: [1]\n"), &v); err == nil {
+		t.Error("expected a type error")
+	}
+}